@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 	"gorm.io/gorm"
 	"github.com/glebarez/sqlite"
 )
@@ -37,6 +39,14 @@ type Cart struct {
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+type ProductPage struct {
+	Data       []Product `json:"data"`
+	Total      int64     `json:"total"`
+	Page       int       `json:"page,omitempty"`
+	PerPage    int       `json:"per_page"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
 func main() {
 	db, err := gorm.Open(sqlite.Open("test.db"), &gorm.Config{})
 	if err != nil {
@@ -44,7 +54,19 @@ func main() {
 	}
 	db.AutoMigrate(&Product{}, &Cart{}, &Category{})
 
+	e := newServer(db)
+	e.Logger.Fatal(e.Start(":1323"))
+}
+
+// newServer rejestruje middleware i trasy API na podanej bazie
+func newServer(db *gorm.DB) *echo.Echo {
 	e := echo.New()
+	// przeglądarka odczyta nagłówki stronicowania tylko wtedy, gdy są wystawione przez CORS
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:  []string{"*"},
+		AllowMethods:  []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		ExposeHeaders: []string{"X-Total-Count", "X-Next-Cursor"},
+	}))
 	e.Use(DBMiddleware(db))
 
 	e.POST("/test", func(c echo.Context) error {
@@ -68,8 +90,7 @@ func main() {
 	// Kategorie
 	e.POST("/categories", createCategory)
 	e.GET("/categories/:id", getCategory)
-
-	e.Logger.Fatal(e.Start(":1323"))
+	return e
 }
 
 func DBMiddleware(db *gorm.DB) echo.MiddlewareFunc {
@@ -102,11 +123,56 @@ func getProduct(c echo.Context) error {
 	return c.JSON(http.StatusOK, p)
 }
 
+// getAllProducts zwraca tablicę produktów - najwyżej per_page (bez parametrów stronicowania maxPerPage).
+// Liczba wszystkich pasujących i kursor następnej strony trafiają do nagłówków X-Total-Count i X-Next-Cursor,
+// a ?envelope=true zwraca stronę jako obiekt ProductPage.
 func getAllProducts(c echo.Context) error {
 	db := c.Get("db").(*gorm.DB)
-	var products []Product
-	db.Preload("Category").Find(&products)
-	return c.JSON(http.StatusOK, products)
+	params, err := parseProductListParams(c)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	if err := db.Model(&Product{}).Scopes(params.filters()...).Count(&total).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not count products")
+	}
+
+	query := db.Preload("Category").Scopes(params.filters()...).Scopes(SortProducts(params.Sort))
+	if params.Cursor != nil {
+		// jeden rekord więcej, żeby wiedzieć czy istnieje następna strona
+		query = query.Scopes(AfterCursor(params.Sort, params.Cursor)).Limit(params.PerPage + 1)
+	} else {
+		query = query.Scopes(Paginate(params.Page, params.PerPage))
+	}
+
+	products := []Product{}
+	if err := query.Find(&products).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch products")
+	}
+
+	response := ProductPage{Data: products, Total: total, PerPage: params.PerPage}
+	hasMore := false
+	if params.Cursor != nil {
+		hasMore = len(products) > params.PerPage
+		if hasMore {
+			response.Data = products[:params.PerPage]
+		}
+	} else {
+		response.Page = params.Page
+		hasMore = int64((params.Page-1)*params.PerPage+len(products)) < total
+	}
+	if hasMore && len(response.Data) > 0 {
+		response.NextCursor = encodeCursor(params.Sort, response.Data[len(response.Data)-1])
+	}
+	if params.Envelope {
+		return c.JSON(http.StatusOK, response)
+	}
+	c.Response().Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	if response.NextCursor != "" {
+		c.Response().Header().Set("X-Next-Cursor", response.NextCursor)
+	}
+	return c.JSON(http.StatusOK, response.Data)
 }
 
 func updateProduct(c echo.Context) error {
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// Dozwolone pola sortowania (klucz z ?sort= -> kolumna w bazie)
+var productSortColumns = map[string]string{
+	"id":         "products.id",
+	"name":       "products.name",
+	"price":      "products.price",
+	"created_at": "products.created_at",
+}
+
+// Scope'y GORM dla produktów - do użycia w dowolnym handlerze przez db.Scopes(...)
+
+func FilterByCategory(categoryID uint) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if categoryID == 0 {
+			return db
+		}
+		return db.Where("products.category_id = ?", categoryID)
+	}
+}
+
+func FilterByPrice(min, max *float64) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if min != nil {
+			db = db.Where("products.price >= ?", *min)
+		}
+		if max != nil {
+			db = db.Where("products.price <= ?", *max)
+		}
+		return db
+	}
+}
+
+// likeEscaper zamienia znaki specjalne LIKE na literały (wzorzec używa ESCAPE '\')
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func SearchProducts(q string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		q = strings.TrimSpace(q)
+		if q == "" {
+			return db
+		}
+		like := "%" + likeEscaper.Replace(strings.ToLower(q)) + "%"
+		return db.Where(`LOWER(products.name) LIKE ? ESCAPE '\' OR LOWER(products.description) LIKE ? ESCAPE '\'`, like, like)
+	}
+}
+
+func SortProducts(sort productSort) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		dir := "ASC"
+		if sort.Desc {
+			dir = "DESC"
+		}
+		// id jako drugi klucz zapewnia stabilną kolejność (potrzebne dla kursora)
+		return db.Order(sort.Column + " " + dir).Order("products.id " + dir)
+	}
+}
+
+func Paginate(page, perPage int) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if page < 1 {
+			page = 1
+		}
+		return db.Offset((page - 1) * perPage).Limit(perPage)
+	}
+}
+
+// AfterCursor zwraca rekordy leżące za kursorem w kolejności wyznaczonej przez sort
+func AfterCursor(sort productSort, cur *productCursor) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if cur == nil {
+			return db
+		}
+		op := ">"
+		if sort.Desc {
+			op = "<"
+		}
+		if sort.Column == "products.id" {
+			return db.Where("products.id "+op+" ?", cur.ID)
+		}
+		value := cur.Value
+		if sort.Key == "created_at" {
+			// czas musi trafić do zapytania jako time.Time, żeby format zgadzał się z zapisanym w bazie
+			if s, ok := value.(string); ok {
+				if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+					value = t
+				}
+			}
+		}
+		return db.Where(
+			fmt.Sprintf("(%s %s ?) OR (%s = ? AND products.id %s ?)", sort.Column, op, sort.Column, op),
+			value, value, cur.ID,
+		)
+	}
+}
+
+type productSort struct {
+	Key    string
+	Column string
+	Desc   bool
+}
+
+type productCursor struct {
+	Sort  string      `json:"s"`
+	Value interface{} `json:"v"`
+	ID    uint        `json:"id"`
+}
+
+func encodeCursor(sort productSort, p Product) string {
+	var value interface{}
+	switch sort.Key {
+	case "name":
+		value = p.Name
+	case "price":
+		value = p.Price
+	case "created_at":
+		value = p.CreatedAt
+	default:
+		value = p.ID
+	}
+	raw, _ := json.Marshal(productCursor{Sort: sort.Key, Value: value, ID: p.ID})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (*productCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cur productCursor
+	if err := json.Unmarshal(raw, &cur); err != nil {
+		return nil, err
+	}
+	return &cur, nil
+}
+
+// Parametry listowania produktów odczytane z query stringa
+type productListParams struct {
+	Envelope   bool
+	Page       int
+	PerPage    int
+	Cursor     *productCursor
+	CategoryID uint
+	MinPrice   *float64
+	MaxPrice   *float64
+	Query      string
+	Sort       productSort
+}
+
+func parseProductListParams(c echo.Context) (*productListParams, error) {
+	params := &productListParams{Page: 1, PerPage: defaultPerPage}
+
+	if v := c.QueryParam("envelope"); v != "" {
+		envelope, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid envelope")
+		}
+		params.Envelope = envelope
+	}
+	// bez parametrów stronicowania zwracamy pierwsze maxPerPage produktów, resztę wskazuje X-Next-Cursor
+	if !params.Envelope && c.QueryParam("page") == "" && c.QueryParam("per_page") == "" && c.QueryParam("cursor") == "" {
+		params.PerPage = maxPerPage
+	}
+
+	if v := c.QueryParam("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid page")
+		}
+		params.Page = page
+	}
+	if v := c.QueryParam("per_page"); v != "" {
+		perPage, err := strconv.Atoi(v)
+		if err != nil || perPage < 1 || perPage > maxPerPage {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("per_page must be between 1 and %d", maxPerPage))
+		}
+		params.PerPage = perPage
+	}
+	if v := c.QueryParam("cursor"); v != "" {
+		cur, err := decodeCursor(v)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid cursor")
+		}
+		params.Cursor = cur
+	}
+	if v := c.QueryParam("category_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid category_id")
+		}
+		params.CategoryID = uint(id)
+	}
+	for name, dst := range map[string]**float64{"min_price": &params.MinPrice, "max_price": &params.MaxPrice} {
+		if v := c.QueryParam(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid "+name)
+			}
+			*dst = &f
+		}
+	}
+	params.Query = c.QueryParam("q")
+
+	sortKey := strings.TrimSpace(c.QueryParam("sort"))
+	if sortKey == "" {
+		sortKey = "id"
+	}
+	desc := strings.HasPrefix(sortKey, "-")
+	sortKey = strings.TrimPrefix(sortKey, "-")
+	column, ok := productSortColumns[sortKey]
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid sort field")
+	}
+	params.Sort = productSort{Key: sortKey, Column: column, Desc: desc}
+	if params.Cursor != nil && params.Cursor.Sort != sortKey {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Cursor does not match sort field")
+	}
+
+	return params, nil
+}
+
+// Filtry bez paginacji - wspólne dla liczenia i pobierania strony
+func (p *productListParams) filters() []func(*gorm.DB) *gorm.DB {
+	return []func(*gorm.DB) *gorm.DB{
+		FilterByCategory(p.CategoryID),
+		FilterByPrice(p.MinPrice, p.MaxPrice),
+		SearchProducts(p.Query),
+	}
+}
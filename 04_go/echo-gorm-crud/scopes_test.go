@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+func newTestServer(t *testing.T) (*echo.Echo, *gorm.DB) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&Product{}, &Cart{}, &Category{}); err != nil {
+		t.Fatal(err)
+	}
+	return newServer(db), db
+}
+
+func getProducts(t *testing.T, e *echo.Echo, target string) (*httptest.ResponseRecorder, []Product) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set(echo.HeaderOrigin, "http://localhost:3000")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	var products []Product
+	if rec.Code == http.StatusOK {
+		json.Unmarshal(rec.Body.Bytes(), &products)
+	}
+	return rec, products
+}
+
+func TestProductListPagesWithHeaders(t *testing.T) {
+	e, db := newTestServer(t)
+	for _, p := range []Product{{Name: "Kubek", Price: 25}, {Name: "Talerz", Price: 40.5}, {Name: "Miska", Price: 12.99}} {
+		if err := db.Create(&p).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec, products := getProducts(t, e, "/products?sort=-price&per_page=2")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(products) != 2 || products[0].Name != "Talerz" || products[1].Name != "Kubek" {
+		t.Fatalf("unexpected first page: %+v", products)
+	}
+	if got := rec.Header().Get("X-Total-Count"); got != "3" {
+		t.Errorf("X-Total-Count = %q", got)
+	}
+	cursor := rec.Header().Get("X-Next-Cursor")
+	if cursor == "" {
+		t.Fatal("missing X-Next-Cursor")
+	}
+	// CORS wystawia nagłówki stronicowania przeglądarce
+	if got := rec.Header().Get(echo.HeaderAccessControlExposeHeaders); got != "X-Total-Count,X-Next-Cursor" {
+		t.Errorf("Access-Control-Expose-Headers = %q", got)
+	}
+
+	rec, products = getProducts(t, e, "/products?sort=-price&per_page=2&cursor="+cursor)
+	if len(products) != 1 || products[0].Name != "Miska" {
+		t.Fatalf("unexpected second page: %+v", products)
+	}
+	if rec.Header().Get("X-Next-Cursor") != "" {
+		t.Error("last page has no next cursor")
+	}
+}
+
+func TestProductListFiltersAndEnvelope(t *testing.T) {
+	e, db := newTestServer(t)
+	for _, p := range []Product{{Name: "Kubek 100%", Price: 25}, {Name: "Kubek", Price: 30}, {Name: "Talerz", Price: 40}} {
+		if err := db.Create(&p).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// % w zapytaniu jest literałem, a nie wzorcem LIKE
+	_, products := getProducts(t, e, "/products?q=100%25")
+	if len(products) != 1 || products[0].Name != "Kubek 100%" {
+		t.Errorf("q=100%%: %+v", products)
+	}
+	_, products = getProducts(t, e, "/products?min_price=26&max_price=35")
+	if len(products) != 1 || products[0].Name != "Kubek" {
+		t.Errorf("price range: %+v", products)
+	}
+
+	rec, _ := getProducts(t, e, "/products?envelope=true&per_page=1&page=2")
+	var page ProductPage
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || page.Page != 2 || len(page.Data) != 1 || page.Data[0].Name != "Kubek" || page.NextCursor == "" {
+		t.Errorf("unexpected envelope: %+v", page)
+	}
+
+	for _, target := range []string{"/products?per_page=101", "/products?sort=secret", "/products?cursor=nie-kursor!"} {
+		if rec, _ := getProducts(t, e, target); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", target, rec.Code)
+		}
+	}
+}
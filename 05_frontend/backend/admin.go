@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Zaplecze sklepu (zmiany statusów zamówień, zwroty, księgowanie przelewów, przegląd ryzyka)
+// jest dostępne tylko z tokenem z ADMIN_TOKENS, np. "anna:token-anny,magazyn:token-magazynu".
+// Nazwa przypisana do tokenu trafia do historii zmian jako actor - klient nie może jej podać sam.
+var adminTokens = envString("ADMIN_TOKENS", "")
+
+const (
+	adminTokenHeader   = "X-Admin-Token"
+	minAdminTokenBytes = 16
+)
+
+var ErrInvalidAdminTokens = errors.New("ADMIN_TOKENS must be a list of name:token with tokens of at least 16 characters")
+
+// parseAdminTokens zwraca skrót tokenu -> nazwa operatora; tokeny są przechowywane
+// tylko jako skróty, tak jak tokeny klientów
+func parseAdminTokens(s string) (map[string]string, error) {
+	admins := make(map[string]string)
+	if strings.TrimSpace(s) == "" {
+		return admins, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		name, token, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || len(token) < minAdminTokenBytes {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidAdminTokens, name)
+		}
+		hash := hashCustomerToken(token)
+		if _, dup := admins[hash]; dup {
+			return nil, fmt.Errorf("%w: %q reuses a token", ErrInvalidAdminTokens, name)
+		}
+		admins[hash] = name
+	}
+	return admins, nil
+}
+
+// AdminMiddleware rozpoznaje operatora po nagłówku X-Admin-Token; żądania bez tokenu
+// przechodzą dalej anonimowo, a z nieznanym tokenem są odrzucane
+func AdminMiddleware(admins map[string]string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token := c.Request().Header.Get(adminTokenHeader)
+			if token == "" {
+				return next(c)
+			}
+			name, ok := admins[hashCustomerToken(token)]
+			if !ok {
+				return echo.NewHTTPError(http.StatusForbidden, "Invalid admin token")
+			}
+			c.Set("admin", name)
+			return next(c)
+		}
+	}
+}
+
+// AdminOnly wpuszcza na trasę tylko operatorów rozpoznanych przez AdminMiddleware
+func AdminOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if _, ok := c.Get("admin").(string); !ok {
+			return echo.NewHTTPError(http.StatusForbidden, "Admin token required")
+		}
+		return next(c)
+	}
+}
+
+// requestActor podpisuje zmiany w historii nazwą operatora z tokenu; nagłówkom klienta nie ufamy
+func requestActor(c echo.Context) string {
+	if admin, ok := c.Get("admin").(string); ok {
+		return admin
+	}
+	return "api"
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Płatności BLIK. Klient podaje 6-cyfrowy kod, płatność czeka na potwierdzenie
+// w aplikacji bankowej (awaiting_confirmation), a frontend odpytuje GET /payments/:id.
+// Potwierdzenie przychodzi webhookiem, a lokalnie z symulatora /simulator/blik/:id/*.
+// Przed płatnością koszyk przechodzi checkout, więc sumy nie zmienią się w trakcie oczekiwania.
+
+var blikConfirmationTimeout = envDuration("BLIK_CONFIRMATION_TIMEOUT", 2*time.Minute)
+
+// BlikGateway to opcjonalna funkcja bramki: wysłanie kodu BLIK do banku
+type BlikGateway interface {
+	StartBlik(ctx context.Context, code string, amount Money, reference string) (string, error)
+}
+
+// BlikSimulator pozwala lokalnie zasymulować decyzję klienta w aplikacji bankowej
+type BlikSimulator interface {
+	ResolveBlik(reference string, approve bool) error
+}
+
+// Kod BLIK, który fałszywa bramka od razu odrzuca
+const FakeBlikDeclined = "000000"
+
+func (g *FakeGateway) StartBlik(ctx context.Context, code string, amount Money, reference string) (string, error) {
+	if code == FakeBlikDeclined {
+		return "", ErrPaymentDeclined
+	}
+	auth := FakeGatewayAuthorization{Reference: "fake_blik_" + randomHex(12), Amount: amount, State: fakeAwaiting}
+	if err := g.db.Create(&auth).Error; err != nil {
+		return "", err
+	}
+	return auth.Reference, nil
+}
+
+func (g *FakeGateway) ResolveBlik(reference string, approve bool) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	auth, err := g.authorization(reference)
+	if err != nil {
+		return err
+	}
+	if auth.State != fakeAwaiting {
+		return ErrInvalidGatewayState
+	}
+	auth.State = fakeVoided
+	if approve {
+		auth.State = fakeCaptured
+	}
+	return g.db.Save(auth).Error
+}
+
+func validBlikCode(code string) bool {
+	if len(code) != 6 {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// startBlikPayment zamyka koszyk (jeśli nie przeszedł checkoutu) i wysyła kod BLIK do bramki
+func startBlikPayment(c echo.Context, cart *Cart, order *Order, totals *CartTotals, amount Money, code string) error {
+	db := c.Get("db").(*gorm.DB)
+	gateway := c.Get("gateway").(PaymentGateway)
+	blik, ok := gateway.(BlikGateway)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "BLIK is not supported by the payment gateway")
+	}
+
+	record, err := beginAwaitingPayment(db, cart, order, totals, amount, PaymentMethodBlik, gateway.Name())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), paymentGatewayTimeout)
+	defer cancel()
+	ref, err := blik.StartBlik(ctx, code, amount, fmt.Sprintf("payment-%d", record.ID))
+	if err != nil {
+		failPayment(db, record, PaymentFailed, err)
+		return gatewayError(err)
+	}
+	if err := markPaymentAwaiting(db, record, ref, blikConfirmationTimeout); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not record payment")
+	}
+	return c.JSON(http.StatusAccepted, record)
+}
+
+// simulateBlik symuluje potwierdzenie (approve) lub odrzucenie płatności w aplikacji bankowej
+func simulateBlik(approve bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := c.Get("db").(*gorm.DB)
+		gateways := c.Get("gateways").(Gateways)
+		var record Payment
+		if err := db.Where("method = ?", PaymentMethodBlik).First(&record, c.Param("id")).Error; err != nil {
+			return echo.NewHTTPError(http.StatusNotFound, "BLIK payment not found")
+		}
+		expireAwaitingPayment(db, gateways, &record)
+		if record.Status != PaymentAwaitingConfirmation {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, "Payment is not awaiting confirmation")
+		}
+
+		gateway, err := gateways.Lookup(record.Gateway)
+		if err != nil {
+			return gatewayError(err)
+		}
+		simulator, ok := gateway.(BlikSimulator)
+		if !ok {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, "Payment gateway cannot simulate BLIK")
+		}
+		if err := simulator.ResolveBlik(record.GatewayReference, approve); err != nil {
+			return gatewayError(err)
+		}
+		var paidEvent *OrderEvent
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if !approve {
+				return failPendingPayment(tx, &record, "rejected in bank app")
+			}
+			var err error
+			_, paidEvent, err = settlePendingPayment(tx, &record, "blik")
+			return err
+		})
+		if errors.Is(err, ErrPaymentChanged) {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, "Payment is not awaiting confirmation")
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not update payment")
+		}
+		if paidEvent != nil {
+			orderEvents.Publish(*paidEvent)
+		}
+		return c.JSON(http.StatusOK, record)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func newBlikTestServer(t *testing.T) (*echo.Echo, *gorm.DB, *FakeGateway) {
+	e, db, gateway := newPaymentTestServer(t)
+	e.POST("/simulator/blik/:id/confirm", simulateBlik(true))
+	e.POST("/simulator/blik/:id/reject", simulateBlik(false))
+	return e, db, gateway
+}
+
+// startBlik rozpoczyna płatność BLIK za cały koszyk i zwraca zapisaną płatność
+func startBlik(t *testing.T, e *echo.Echo, db *gorm.DB, cart *Cart) Payment {
+	t.Helper()
+	totals, err := ComputeTotals(db, cart)
+	require.NoError(t, err)
+	rec := doRequest(e, http.MethodPost, "/payments",
+		fmt.Sprintf(`{"cart_id":%d,"method":"blik","blik_code":"123456","amount":%s}`, cart.ID, totals.Total.Decimal()))
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var payment Payment
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &payment))
+	require.Equal(t, PaymentAwaitingConfirmation, payment.Status)
+	return payment
+}
+
+func TestBlikConfirmationSettlesOrder(t *testing.T) {
+	e, db, _ := newBlikTestServer(t)
+	cart, product := newTestCart(t, db, 5, 2)
+	payment := startBlik(t, e, db, cart)
+
+	rec := doRequest(e, http.MethodPost, fmt.Sprintf("/simulator/blik/%d/confirm", payment.ID), "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, db.First(&payment, payment.ID).Error)
+	assert.Equal(t, PaymentCaptured, payment.Status)
+	assert.NotNil(t, payment.CapturedAt)
+	var order Order
+	require.NoError(t, db.First(&order, *payment.OrderID).Error)
+	assert.Equal(t, OrderPaid, order.Status)
+	assert.Equal(t, 3, productStock(t, db, product.ID))
+
+	// drugie potwierdzenie niczego nie zmienia
+	rec = doRequest(e, http.MethodPost, fmt.Sprintf("/simulator/blik/%d/confirm", payment.ID), "")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	rec = doRequest(e, http.MethodPost, fmt.Sprintf("/simulator/blik/%d/reject", payment.ID), "")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	require.NoError(t, db.First(&payment, payment.ID).Error)
+	assert.Equal(t, PaymentCaptured, payment.Status)
+}
+
+func TestBlikRejectionFailsPayment(t *testing.T) {
+	e, db, _ := newBlikTestServer(t)
+	cart, _ := newTestCart(t, db, 5, 1)
+	totals, err := ComputeTotals(db, cart)
+	require.NoError(t, err)
+
+	rec := doRequest(e, http.MethodPost, "/payments",
+		fmt.Sprintf(`{"cart_id":%d,"method":"blik","blik_code":"12345","amount":%s}`, cart.ID, totals.Total.Decimal()))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code, "BLIK code has six digits")
+	rec = doRequest(e, http.MethodPost, "/payments",
+		fmt.Sprintf(`{"cart_id":%d,"method":"blik","blik_code":%q,"amount":%s}`, cart.ID, FakeBlikDeclined, totals.Total.Decimal()))
+	assert.Equal(t, http.StatusPaymentRequired, rec.Code)
+
+	payment := startBlik(t, e, db, cart)
+	rec = doRequest(e, http.MethodPost, fmt.Sprintf("/simulator/blik/%d/reject", payment.ID), "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, db.First(&payment, payment.ID).Error)
+	assert.Equal(t, PaymentFailed, payment.Status)
+	assert.Equal(t, "rejected in bank app", payment.ErrorReason)
+	var order Order
+	require.NoError(t, db.First(&order, *payment.OrderID).Error)
+	assert.Equal(t, OrderPending, order.Status)
+}
+
+func TestBlikConfirmationAfterTimeoutIsRefused(t *testing.T) {
+	e, db, gateway := newBlikTestServer(t)
+	cart, _ := newTestCart(t, db, 5, 1)
+	payment := startBlik(t, e, db, cart)
+	require.NoError(t, db.Model(&Payment{}).Where("id = ?", payment.ID).Update("expires_at", time.Now().Add(-time.Second)).Error)
+
+	rec := doRequest(e, http.MethodPost, fmt.Sprintf("/simulator/blik/%d/confirm", payment.ID), "")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	require.NoError(t, db.First(&payment, payment.ID).Error)
+	assert.Equal(t, PaymentFailed, payment.Status)
+	assert.ErrorIs(t, gateway.ResolveBlik(payment.GatewayReference, true), ErrInvalidGatewayState)
+}
+
+func TestPendingPaymentIsSettledOnlyOnce(t *testing.T) {
+	e, db, _ := newBlikTestServer(t)
+	cart, _ := newTestCart(t, db, 5, 1)
+	payment := startBlik(t, e, db, cart)
+	var stale Payment
+	require.NoError(t, db.First(&stale, payment.ID).Error)
+	// w międzyczasie płatność wygasła (sweeper) - wczytany wcześniej stan jest nieaktualny
+	require.NoError(t, db.Model(&Payment{}).Where("id = ?", payment.ID).Update("status", PaymentFailed).Error)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		_, _, err := settlePendingPayment(tx, &stale, "test")
+		return err
+	})
+	assert.ErrorIs(t, err, ErrPaymentChanged)
+	assert.ErrorIs(t, failPendingPayment(db, &stale, "rejected"), ErrPaymentChanged)
+
+	require.NoError(t, db.First(&payment, payment.ID).Error)
+	assert.Equal(t, PaymentFailed, payment.Status)
+	assert.Empty(t, payment.ErrorReason)
+	var stored Cart
+	require.NoError(t, db.First(&stored, cart.ID).Error)
+	assert.Equal(t, CartCheckedOut, stored.Status)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Walidacja danych karty. Numer karty (PAN) istnieje tylko w żądaniu i w bramce:
+// od razu po walidacji zamieniany jest na token, a w bazie i odpowiedziach
+// pojawia się wyłącznie marka i zamaskowany numer.
+
+const (
+	CardVisa       = "visa"
+	CardMastercard = "mastercard"
+	CardAmex       = "amex"
+	CardDiscover   = "discover"
+)
+
+var (
+	ErrInvalidCardNumber = errors.New("invalid card number")
+	ErrUnsupportedCard   = errors.New("unsupported card brand")
+	ErrInvalidExpiry     = errors.New("invalid expiry date")
+	ErrCardExpired       = errors.New("card expired")
+	ErrInvalidCVC        = errors.New("invalid cvc")
+)
+
+// CardDetails to zwalidowane dane karty przekazywane do tokenizacji
+type CardDetails struct {
+	Number   string
+	Brand    string
+	ExpMonth int
+	ExpYear  int
+	CVC      string
+}
+
+func (card CardDetails) Last4() string {
+	return card.Number[len(card.Number)-4:]
+}
+
+func (card CardDetails) Masked() string {
+	return "**** " + card.Last4()
+}
+
+type cardBrandRule struct {
+	brand    string
+	prefixes [][2]int // zakresy prefiksów (włącznie), porównywane na długości dolnej granicy
+	lengths  []int
+	cvcLen   int
+}
+
+var cardBrandRules = []cardBrandRule{
+	{CardAmex, [][2]int{{34, 34}, {37, 37}}, []int{15}, 4},
+	{CardVisa, [][2]int{{4, 4}}, []int{13, 16, 19}, 3},
+	{CardMastercard, [][2]int{{51, 55}, {2221, 2720}}, []int{16}, 3},
+	{CardDiscover, [][2]int{{6011, 6011}, {644, 649}, {65, 65}}, []int{16, 19}, 3},
+}
+
+// ValidateCard sprawdza numer (Luhn + marka), datę ważności i CVC
+func ValidateCard(number string, expMonth, expYear int, cvc string, now time.Time) (*CardDetails, error) {
+	number = normalizeCardNumber(number)
+	if number == "" || !luhnValid(number) {
+		return nil, ErrInvalidCardNumber
+	}
+	rule, ok := detectCardBrand(number)
+	if !ok {
+		return nil, ErrUnsupportedCard
+	}
+
+	if expYear >= 0 && expYear < 100 {
+		expYear += 2000
+	}
+	if expMonth < 1 || expMonth > 12 || expYear < 2000 || expYear > now.Year()+20 {
+		return nil, ErrInvalidExpiry
+	}
+	// karta jest ważna do końca miesiąca podanego na awersie
+	if !now.Before(time.Date(expYear, time.Month(expMonth)+1, 1, 0, 0, 0, 0, time.UTC)) {
+		return nil, ErrCardExpired
+	}
+
+	if len(cvc) != rule.cvcLen || strings.Trim(cvc, "0123456789") != "" {
+		return nil, ErrInvalidCVC
+	}
+	return &CardDetails{Number: number, Brand: rule.brand, ExpMonth: expMonth, ExpYear: expYear, CVC: cvc}, nil
+}
+
+// normalizeCardNumber usuwa spacje i myślniki; zwraca "" gdy zostają inne znaki niż cyfry
+func normalizeCardNumber(number string) string {
+	number = strings.NewReplacer(" ", "", "-", "").Replace(number)
+	if len(number) < 12 || len(number) > 19 || strings.Trim(number, "0123456789") != "" {
+		return ""
+	}
+	return number
+}
+
+func luhnValid(number string) bool {
+	sum := 0
+	for i := 0; i < len(number); i++ {
+		d := int(number[len(number)-1-i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+func detectCardBrand(number string) (cardBrandRule, bool) {
+	for _, rule := range cardBrandRules {
+		if !containsInt(rule.lengths, len(number)) {
+			continue
+		}
+		for _, r := range rule.prefixes {
+			n := numberPrefix(number, digitCount(r[0]))
+			if n >= r[0] && n <= r[1] {
+				return rule, true
+			}
+		}
+	}
+	return cardBrandRule{}, false
+}
+
+func numberPrefix(number string, digits int) int {
+	n := 0
+	for i := 0; i < digits && i < len(number); i++ {
+		n = n*10 + int(number[i]-'0')
+	}
+	return n
+}
+
+func digitCount(n int) int {
+	count := 1
+	for n >= 10 {
+		n /= 10
+		count++
+	}
+	return count
+}
+
+func containsInt(values []int, v int) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var cardTestNow = time.Date(2026, time.October, 16, 12, 0, 0, 0, time.UTC)
+
+func TestValidateCardBrands(t *testing.T) {
+	cases := []struct {
+		number string
+		cvc    string
+		brand  string
+	}{
+		{"4242424242424242", "123", CardVisa},
+		{"4222222222222", "123", CardVisa},
+		{"4242 4242 4242 4242", "123", CardVisa},
+		{"4242-4242-4242-4242", "123", CardVisa},
+		{"5555555555554444", "123", CardMastercard},
+		{"2223003122003222", "123", CardMastercard},
+		{"378282246310005", "1234", CardAmex},
+		{"6011111111111117", "123", CardDiscover},
+		{"6445644564456445", "123", CardDiscover},
+		{"6500000000000002", "123", CardDiscover},
+	}
+	for _, tc := range cases {
+		card, err := ValidateCard(tc.number, 12, 2030, tc.cvc, cardTestNow)
+		if assert.NoError(t, err, tc.number) {
+			assert.Equal(t, tc.brand, card.Brand, tc.number)
+			assert.NotContains(t, card.Number, " ")
+			assert.NotContains(t, card.Number, "-")
+		}
+	}
+}
+
+func TestValidateCardNumber(t *testing.T) {
+	cases := map[string]error{
+		"4242424242424241":     ErrInvalidCardNumber, // zła suma kontrolna Luhna
+		"4242x42424242424":     ErrInvalidCardNumber,
+		"42424242":             ErrInvalidCardNumber, // za krótki
+		"42424242424242424242": ErrInvalidCardNumber, // za długi
+		"":                     ErrInvalidCardNumber,
+		"3530111333300000":     ErrUnsupportedCard, // JCB
+	}
+	for number, want := range cases {
+		_, err := ValidateCard(number, 12, 2030, "123", cardTestNow)
+		assert.ErrorIs(t, err, want, number)
+	}
+	// Luhn poprawny, ale długość niezgodna z marką
+	_, err := ValidateCard("42424242424242", 12, 2030, "123", cardTestNow)
+	assert.ErrorIs(t, err, ErrUnsupportedCard)
+}
+
+func TestLuhnValid(t *testing.T) {
+	assert.True(t, luhnValid("79927398713"))
+	assert.False(t, luhnValid("79927398710"))
+	assert.True(t, luhnValid("0"))
+}
+
+func TestValidateCardExpiry(t *testing.T) {
+	cases := []struct {
+		month, year int
+		want        error
+	}{
+		{10, 2026, nil}, // ważna do końca bieżącego miesiąca
+		{10, 26, nil},   // rok dwucyfrowy
+		{1, 2046, nil},
+		{9, 2026, ErrCardExpired},
+		{12, 25, ErrCardExpired},
+		{0, 2030, ErrInvalidExpiry},
+		{13, 2030, ErrInvalidExpiry},
+		{12, 1999, ErrInvalidExpiry},
+		{12, 2047, ErrInvalidExpiry},
+	}
+	for _, tc := range cases {
+		_, err := ValidateCard("4242424242424242", tc.month, tc.year, "123", cardTestNow)
+		if tc.want == nil {
+			assert.NoError(t, err, "%02d/%d", tc.month, tc.year)
+		} else {
+			assert.ErrorIs(t, err, tc.want, "%02d/%d", tc.month, tc.year)
+		}
+	}
+
+	// pierwszego dnia kolejnego miesiąca karta jest już przeterminowana
+	_, err := ValidateCard("4242424242424242", 10, 2026, "123", time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC))
+	assert.ErrorIs(t, err, ErrCardExpired)
+}
+
+func TestValidateCardCVC(t *testing.T) {
+	_, err := ValidateCard("378282246310005", 12, 2030, "123", cardTestNow)
+	assert.ErrorIs(t, err, ErrInvalidCVC)
+	_, err = ValidateCard("4242424242424242", 12, 2030, "1234", cardTestNow)
+	assert.ErrorIs(t, err, ErrInvalidCVC)
+	_, err = ValidateCard("4242424242424242", 12, 2030, "12a", cardTestNow)
+	assert.ErrorIs(t, err, ErrInvalidCVC)
+}
+
+func TestCardDetailsMasked(t *testing.T) {
+	card, err := ValidateCard("4242 4242 4242 4242", 12, 2030, "123", cardTestNow)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "4242", card.Last4())
+		assert.Equal(t, "**** 4242", card.Masked())
+		assert.Equal(t, 2030, card.ExpYear)
+	}
+}
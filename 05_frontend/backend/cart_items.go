@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Pozycje koszyka: ilość + cena jednostkowa zapamiętana w chwili dodania produktu
+
+type CartItem struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CartID    uint      `gorm:"uniqueIndex:idx_cart_item_product" json:"cart_id"`
+	ProductID uint      `gorm:"uniqueIndex:idx_cart_item_product" json:"product_id"`
+	Product   Product   `gorm:"foreignKey:ProductID" json:"product"`
+	Quantity  int       `json:"quantity"`
+	UnitPrice Money     `gorm:"embedded;embeddedPrefix:unit_price_" json:"unit_price"`
+	LineTotal Money     `gorm:"-" json:"line_total"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const maxItemQuantity = 999
+
+var (
+	ErrInvalidQuantity = errors.New("invalid quantity")
+	ErrCartItemMissing = errors.New("cart item not found")
+)
+
+// loadCart wczytuje koszyk razem z pozycjami i wylicza sumy
+func loadCart(db *gorm.DB, id interface{}) (*Cart, error) {
+	var cart Cart
+	if err := db.Preload("Items", func(db *gorm.DB) *gorm.DB { return db.Order("cart_items.id") }).
+		Preload("Items.Product", func(db *gorm.DB) *gorm.DB { return db.Unscoped() }).First(&cart, id).Error; err != nil {
+		return nil, err
+	}
+	if err := cart.computeSubtotal(); err != nil {
+		return nil, fmt.Errorf("cart %d: %w", cart.ID, err)
+	}
+	return &cart, nil
+}
+
+func (cart *Cart) computeSubtotal() error {
+	cart.Subtotal = NewMoney(0, DefaultCurrency)
+	for i := range cart.Items {
+		item := &cart.Items[i]
+		if i == 0 {
+			cart.Subtotal.Currency = item.UnitPrice.Currency
+		}
+		var err error
+		if item.LineTotal, err = item.UnitPrice.Mul(int64(item.Quantity)); err != nil {
+			return err
+		}
+		if cart.Subtotal, err = cart.Subtotal.Add(item.LineTotal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Quantities zwraca productID -> ilość, w formacie używanym przez rezerwacje
+func (cart *Cart) Quantities() map[uint]int {
+	quantities := make(map[uint]int, len(cart.Items))
+	for _, item := range cart.Items {
+		quantities[item.ProductID] += item.Quantity
+	}
+	return quantities
+}
+
+// AddCartItem dodaje produkt do koszyka lub zwiększa ilość istniejącej pozycji
+func AddCartItem(db *gorm.DB, cartID, productID uint, qty int) error {
+	if qty < 1 {
+		return ErrInvalidQuantity
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := ensureCartOpen(tx, cartID); err != nil {
+			return err
+		}
+		var product Product
+		if err := tx.First(&product, productID).Error; err != nil {
+			return err
+		}
+
+		var item CartItem
+		err := tx.Where("cart_id = ? AND product_id = ?", cartID, productID).Take(&item).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			var other CartItem
+			if tx.Where("cart_id = ?", cartID).Take(&other).Error == nil && other.UnitPrice.Currency != product.Price.Currency {
+				return ErrCurrencyMismatch
+			}
+			item = CartItem{CartID: cartID, ProductID: productID, UnitPrice: product.Price}
+		} else if err != nil {
+			return err
+		}
+
+		item.Quantity += qty
+		if item.Quantity > maxItemQuantity {
+			return ErrInvalidQuantity
+		}
+		if err := ReserveStock(tx, cartID, productID, item.Quantity); err != nil {
+			return err
+		}
+		if err := tx.Save(&item).Error; err != nil {
+			return err
+		}
+		return checkCartTotal(tx, cartID)
+	})
+}
+
+// SetCartItemQuantity ustawia ilość pozycji; 0 usuwa pozycję z koszyka
+func SetCartItemQuantity(db *gorm.DB, cartID, itemID uint, qty int) error {
+	if qty < 0 || qty > maxItemQuantity {
+		return ErrInvalidQuantity
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := ensureCartOpen(tx, cartID); err != nil {
+			return err
+		}
+		var item CartItem
+		if err := tx.Where("id = ? AND cart_id = ?", itemID, cartID).Take(&item).Error; err != nil {
+			return ErrCartItemMissing
+		}
+		if qty == 0 {
+			return removeCartItem(tx, item)
+		}
+		if err := ReserveStock(tx, cartID, item.ProductID, qty); err != nil {
+			return err
+		}
+		if err := tx.Model(&item).Update("quantity", qty).Error; err != nil {
+			return err
+		}
+		return checkCartTotal(tx, cartID)
+	})
+}
+
+// checkCartTotal wycofuje zmianę, po której suma koszyka nie mieści się w int64
+func checkCartTotal(tx *gorm.DB, cartID uint) error {
+	_, err := loadCart(tx, cartID)
+	return err
+}
+
+func RemoveCartItem(db *gorm.DB, cartID, itemID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := ensureCartOpen(tx, cartID); err != nil {
+			return err
+		}
+		var item CartItem
+		if err := tx.Where("id = ? AND cart_id = ?", itemID, cartID).Take(&item).Error; err != nil {
+			return ErrCartItemMissing
+		}
+		return removeCartItem(tx, item)
+	})
+}
+
+func removeCartItem(tx *gorm.DB, item CartItem) error {
+	if err := tx.Delete(&item).Error; err != nil {
+		return err
+	}
+	return ReleaseReservation(tx, item.CartID, item.ProductID)
+}
+
+// cartItemError tłumaczy błędy operacji na pozycjach na odpowiedzi HTTP
+func cartItemError(err error) error {
+	switch {
+	case errors.Is(err, ErrInsufficientStock):
+		return echo.NewHTTPError(http.StatusConflict, "Insufficient stock")
+	case errors.Is(err, ErrInvalidQuantity):
+		return echo.NewHTTPError(http.StatusBadRequest, "Quantity must be between 1 and "+strconv.Itoa(maxItemQuantity))
+	case errors.Is(err, ErrCurrencyMismatch):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Product currency does not match cart currency")
+	case errors.Is(err, ErrInvalidAmount):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Cart total is out of range")
+	case errors.Is(err, ErrCartLocked):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Cart can no longer be modified")
+	case errors.Is(err, ErrCartItemMissing):
+		return echo.NewHTTPError(http.StatusNotFound, "Cart item not found")
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Product not found")
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, "Could not update cart")
+}
+
+func parseUintParam(c echo.Context, name string) (uint, error) {
+	v, err := strconv.ParseUint(c.Param(name), 10, 64)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "Invalid "+name)
+	}
+	return uint(v), nil
+}
+
+func addCartItem(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	cartID, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	var body struct {
+		ProductID uint `json:"product_id"`
+		Quantity  *int `json:"quantity"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	qty := 1
+	if body.Quantity != nil {
+		qty = *body.Quantity
+	}
+
+	if _, err := loadCart(db, cartID); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Cart not found")
+	}
+	if err := AddCartItem(db, cartID, body.ProductID, qty); err != nil {
+		return cartItemError(err)
+	}
+	cart, _ := loadCart(db, cartID)
+	return c.JSON(http.StatusOK, cart)
+}
+
+func updateCartItem(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	cartID, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	itemID, err := parseUintParam(c, "itemId")
+	if err != nil {
+		return err
+	}
+	var body struct {
+		Quantity *int `json:"quantity"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if body.Quantity == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "quantity is required")
+	}
+
+	if _, err := loadCart(db, cartID); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Cart not found")
+	}
+	if err := SetCartItemQuantity(db, cartID, itemID, *body.Quantity); err != nil {
+		return cartItemError(err)
+	}
+	cart, _ := loadCart(db, cartID)
+	return c.JSON(http.StatusOK, cart)
+}
+
+func deleteCartItem(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	cartID, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	itemID, err := parseUintParam(c, "itemId")
+	if err != nil {
+		return err
+	}
+
+	if _, err := loadCart(db, cartID); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Cart not found")
+	}
+	if err := RemoveCartItem(db, cartID, itemID); err != nil {
+		return cartItemError(err)
+	}
+	cart, _ := loadCart(db, cartID)
+	return c.JSON(http.StatusOK, cart)
+}
+
+// MigrateCartProducts przenosi zawartość starej tabeli cart_products (many2many)
+// do cart_items z ilością 1 i bieżącą ceną produktu, po czym usuwa tabelę.
+func MigrateCartProducts(db *gorm.DB) error {
+	if !db.Migrator().HasTable("cart_products") {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Exec(`INSERT INTO cart_items (cart_id, product_id, quantity, unit_price_amount, unit_price_currency, created_at, updated_at)
+			SELECT cp.cart_id, cp.product_id, COUNT(*), p.price_amount, p.price_currency, ?, ?
+			FROM cart_products cp JOIN products p ON p.id = cp.product_id
+			WHERE NOT EXISTS (SELECT 1 FROM cart_items ci WHERE ci.cart_id = cp.cart_id AND ci.product_id = cp.product_id)
+			GROUP BY cp.cart_id, cp.product_id`, now, now).Error
+		if err != nil {
+			return err
+		}
+		return tx.Migrator().DropTable("cart_products")
+	})
+}
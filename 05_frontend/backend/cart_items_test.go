@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func newCartTestServer(t *testing.T) (*echo.Echo, *gorm.DB) {
+	db := newTestDB(t, schemaModels...)
+	e := echo.New()
+	e.Use(DBMiddleware(db))
+	e.POST("/carts", createCart)
+	e.GET("/carts/:id", getCart)
+	e.POST("/carts/:id/products", addProductToCart)
+	e.DELETE("/carts/:id/products/:productId", removeProductFromCart)
+	e.POST("/carts/:id/items", addCartItem)
+	e.PATCH("/carts/:id/items/:itemId", updateCartItem)
+	e.DELETE("/carts/:id/items/:itemId", deleteCartItem)
+	return e, db
+}
+
+func decodeCart(t *testing.T, rec *httptest.ResponseRecorder) Cart {
+	t.Helper()
+	var cart Cart
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &cart))
+	return cart
+}
+
+func TestCartItemsKeepQuantityAndPriceSnapshot(t *testing.T) {
+	e, db := newCartTestServer(t)
+	product := Product{Name: "Kubek", Price: NewMoney(1999, "PLN"), Currency: "PLN"}
+	require.NoError(t, db.Create(&product).Error)
+
+	rec := doRequest(e, http.MethodPost, "/carts", "")
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	cart := decodeCart(t, rec)
+	assert.Equal(t, CartOpen, cart.Status)
+	assert.NotNil(t, cart.Items)
+	assert.Zero(t, cart.Subtotal.Amount)
+
+	cartURL := fmt.Sprintf("/carts/%d", cart.ID)
+	rec = doRequest(e, http.MethodPost, cartURL+"/items", fmt.Sprintf(`{"product_id":%d,"quantity":2}`, product.ID))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	// starszy endpoint dokłada jedną sztukę do tej samej pozycji
+	rec = doRequest(e, http.MethodPost, cartURL+"/products", fmt.Sprintf(`{"product_id":%d}`, product.ID))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// zmiana ceny produktu nie zmienia ceny w koszyku
+	require.NoError(t, db.Model(&product).Update("price_amount", 2999).Error)
+
+	rec = doRequest(e, http.MethodGet, cartURL, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	cart = decodeCart(t, rec)
+	require.Len(t, cart.Items, 1)
+	item := cart.Items[0]
+	assert.Equal(t, product.ID, item.ProductID)
+	assert.Equal(t, "Kubek", item.Product.Name)
+	assert.Equal(t, 3, item.Quantity)
+	assert.Equal(t, NewMoney(1999, "PLN"), item.UnitPrice)
+	assert.Equal(t, NewMoney(5997, "PLN"), item.LineTotal)
+	assert.Equal(t, NewMoney(5997, "PLN"), cart.Subtotal)
+
+	rec = doRequest(e, http.MethodGet, "/carts/999999", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestCartItemQuantityUpdates(t *testing.T) {
+	e, db := newCartTestServer(t)
+	cart, product := newTestCart(t, db, 5, 2)
+	itemURL := fmt.Sprintf("/carts/%d/items/%d", cart.ID, cart.Items[0].ID)
+
+	rec := doRequest(e, http.MethodPatch, itemURL, `{"quantity":4}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, 4, decodeCart(t, rec).Items[0].Quantity)
+
+	rec = doRequest(e, http.MethodPatch, itemURL, `{"quantity":6}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = doRequest(e, http.MethodPatch, itemURL, `{"quantity":-1}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(e, http.MethodPatch, itemURL, `{}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = doRequest(e, http.MethodPatch, itemURL, `{"quantity":0}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Empty(t, decodeCart(t, rec).Items)
+
+	available, err := AvailableStock(db, *product)
+	require.NoError(t, err)
+	assert.Equal(t, 5, *available, "removing the item releases its reservation")
+
+	rec = doRequest(e, http.MethodDelete, itemURL, "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestCartItemsRejectMixedCurrencies(t *testing.T) {
+	e, db := newCartTestServer(t)
+	cart, _ := newTestCart(t, db, 5, 1)
+	euro := Product{Name: "Mug", Price: NewMoney(500, "EUR"), Currency: "EUR"}
+	require.NoError(t, db.Create(&euro).Error)
+
+	rec := doRequest(e, http.MethodPost, fmt.Sprintf("/carts/%d/items", cart.ID), fmt.Sprintf(`{"product_id":%d}`, euro.ID))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+}
+
+func TestLockedCartRejectsItemChanges(t *testing.T) {
+	e, db := newCartTestServer(t)
+	cart, product := newTestCart(t, db, 5, 1)
+	require.NoError(t, db.Model(&Cart{}).Where("id = ?", cart.ID).Update("status", CartPaid).Error)
+
+	rec := doRequest(e, http.MethodPost, fmt.Sprintf("/carts/%d/items", cart.ID), fmt.Sprintf(`{"product_id":%d}`, product.ID))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	rec = doRequest(e, http.MethodDelete, fmt.Sprintf("/carts/%d/products/%d", cart.ID, product.ID), "")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+}
+
+func TestCartItemsRejectTotalOutOfRange(t *testing.T) {
+	e, db := newCartTestServer(t)
+	cart, _ := newTestCart(t, db, 5, 1)
+	expensive := Product{Name: "Sejf", Price: NewMoney(math.MaxInt64/2, "PLN"), Currency: "PLN"}
+	require.NoError(t, db.Create(&expensive).Error)
+
+	// suma koszyka przekroczyłaby int64 - zmiana jest wycofywana zamiast zawinąć kwotę
+	rec := doRequest(e, http.MethodPost, fmt.Sprintf("/carts/%d/items", cart.ID), fmt.Sprintf(`{"product_id":%d,"quantity":2}`, expensive.ID))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = doRequest(e, http.MethodGet, fmt.Sprintf("/carts/%d", cart.ID), "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	stored := decodeCart(t, rec)
+	assert.Len(t, stored.Items, 1)
+	assert.Equal(t, NewMoney(2500, "PLN"), stored.Subtotal)
+}
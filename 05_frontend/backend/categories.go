@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Drzewo kategorii: każda kategoria może mieć rodzica (ParentID), np. Elektronika > Telefony > Akcesoria.
+// Przodków i potomków wyznacza rekurencyjne CTE. Potomkowie to same id, więc UNION odrzuca
+// powtórzenia; przodkowie niosą głębokość (każdy wiersz byłby inny), więc zamiast tego
+// pamiętają listę odwiedzonych id - obie rekurencje kończą się nawet przy cyklu w bazie.
+// Usunięcie kategorii przenosi jej podkategorie do jej rodzica, a produkty obsługuje
+// wybrana polityka (?policy=): reject odmawia, gdy kategoria ma produkty, reassign przenosi
+// je do target_id, a detach zostawia je bez kategorii (category_id = 0).
+
+var (
+	ErrCategoryNotFound = errors.New("category not found")
+	ErrCategoryCycle    = errors.New("category cannot be moved under itself or its descendant")
+	ErrCategoryNotEmpty = errors.New("category still has products")
+)
+
+const (
+	CategoryDeleteReject   = "reject"
+	CategoryDeleteReassign = "reassign"
+	CategoryDeleteDetach   = "detach"
+)
+
+// CategorySummary to pozycja listy kategorii z liczbą przypisanych produktów
+type CategorySummary struct {
+	ID           uint      `json:"id"`
+	Name         string    `json:"name"`
+	ParentID     *uint     `json:"parent_id"`
+	ProductCount int64     `json:"product_count"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// optionalID odróżnia pominięte pole JSON od jawnego null (potrzebne w PATCH)
+type optionalID struct {
+	Set   bool
+	Value *uint
+}
+
+func (o *optionalID) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	if string(data) == "null" {
+		o.Value = nil
+		return nil
+	}
+	var id uint
+	if err := json.Unmarshal(data, &id); err != nil {
+		return err
+	}
+	o.Value = &id
+	return nil
+}
+
+// CategoryCrumb to jeden element ścieżki (breadcrumb) od korzenia do kategorii
+type CategoryCrumb struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+// CategoryNode to węzeł drzewa zwracanego przez GET /categories/tree
+type CategoryNode struct {
+	ID       uint            `json:"id"`
+	Name     string          `json:"name"`
+	ParentID *uint           `json:"parent_id"`
+	Children []*CategoryNode `json:"children"`
+}
+
+const categoryAncestorsSQL = `
+	WITH RECURSIVE ancestors(id, parent_id, depth, visited) AS (
+		SELECT id, parent_id, 0, ',' || id || ',' FROM categories WHERE id = ?
+		UNION ALL
+		SELECT c.id, c.parent_id, a.depth + 1, a.visited || c.id || ','
+		FROM categories c JOIN ancestors a ON c.id = a.parent_id
+		WHERE instr(a.visited, ',' || c.id || ',') = 0
+	)`
+
+const categoryDescendantsSQL = `
+	WITH RECURSIVE descendants(id) AS (
+		SELECT ?
+		UNION
+		SELECT c.id FROM categories c JOIN descendants d ON c.parent_id = d.id
+	)
+	SELECT id FROM descendants`
+
+// CategoryPath zwraca ścieżkę od korzenia do kategorii (włącznie z nią)
+func CategoryPath(db *gorm.DB, id uint) ([]CategoryCrumb, error) {
+	path := []CategoryCrumb{}
+	err := db.Raw(categoryAncestorsSQL+`
+		SELECT categories.id, categories.name FROM ancestors JOIN categories ON categories.id = ancestors.id
+		ORDER BY ancestors.depth DESC`, id).Scan(&path).Error
+	return path, err
+}
+
+// ValidateCategoryParent sprawdza, czy kategorię id można podpiąć pod parentID:
+// rodzic musi istnieć i nie może być nią samą ani jej potomkiem. id == 0 oznacza nową kategorię.
+func ValidateCategoryParent(db *gorm.DB, id uint, parentID *uint) error {
+	if parentID == nil {
+		return nil
+	}
+	path, err := CategoryPath(db, *parentID)
+	if err != nil {
+		return err
+	}
+	if len(path) == 0 {
+		return ErrCategoryNotFound
+	}
+	for _, crumb := range path {
+		if crumb.ID == id {
+			return ErrCategoryCycle
+		}
+	}
+	return nil
+}
+
+// FilterByCategoryTree zawęża produkty do kategorii i wszystkich jej podkategorii
+func FilterByCategoryTree(categoryID uint) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if categoryID == 0 {
+			return db
+		}
+		return db.Where("products.category_id IN ("+categoryDescendantsSQL+")", categoryID)
+	}
+}
+
+// BuildCategoryTree układa płaską listę kategorii w drzewo; kategorie z nieistniejącym
+// rodzicem trafiają do korzeni, żeby nie zniknęły z widoku
+func BuildCategoryTree(categories []Category) []*CategoryNode {
+	nodes := make(map[uint]*CategoryNode, len(categories))
+	for _, cat := range categories {
+		nodes[cat.ID] = &CategoryNode{ID: cat.ID, Name: cat.Name, ParentID: cat.ParentID, Children: []*CategoryNode{}}
+	}
+	roots := []*CategoryNode{}
+	for _, cat := range categories {
+		node := nodes[cat.ID]
+		if cat.ParentID != nil {
+			if parent, ok := nodes[*cat.ParentID]; ok && parent != node {
+				parent.Children = append(parent.Children, node)
+				continue
+			}
+		}
+		roots = append(roots, node)
+	}
+	return roots
+}
+
+func categoryError(err error) error {
+	switch {
+	case errors.Is(err, ErrCategoryNotFound):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Parent category not found")
+	case errors.Is(err, ErrCategoryCycle):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Category cannot be moved under itself or its descendant")
+	case errors.Is(err, ErrCategoryNotEmpty):
+		return echo.NewHTTPError(http.StatusConflict, "Category still has products, choose policy reassign or detach")
+	default:
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not update category")
+	}
+}
+
+func getAllCategories(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	summaries := []CategorySummary{}
+	err := db.Model(&Category{}).
+		Select("categories.id, categories.name, categories.parent_id, categories.created_at, categories.updated_at, COUNT(products.id) AS product_count").
+		Joins("LEFT JOIN products ON products.category_id = categories.id AND products.deleted_at IS NULL").
+		Group("categories.id").Order("categories.name, categories.id").
+		Scan(&summaries).Error
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch categories")
+	}
+	return c.JSON(http.StatusOK, summaries)
+}
+
+func getCategoryTree(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	var categories []Category
+	if err := db.Order("name, id").Find(&categories).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch categories")
+	}
+	return c.JSON(http.StatusOK, BuildCategoryTree(categories))
+}
+
+// moveCategory zmienia rodzica kategorii; parent_id: null przenosi ją do korzeni
+func moveCategory(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	id, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	var body struct {
+		ParentID *uint `json:"parent_id"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid category data")
+	}
+	var category Category
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&category, id).Error; err != nil {
+			return err
+		}
+		if err := ValidateCategoryParent(tx, category.ID, body.ParentID); err != nil {
+			return err
+		}
+		category.ParentID = body.ParentID
+		return tx.Model(&category).Update("parent_id", body.ParentID).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "Category not found")
+	}
+	if err != nil {
+		return categoryError(err)
+	}
+	if category.Path, err = CategoryPath(db, category.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch category path")
+	}
+	return c.JSON(http.StatusOK, category)
+}
+
+// updateCategory obsługuje PUT (pełna zamiana: name wymagane, brak parent_id = korzeń)
+// i PATCH (zmieniane są tylko przesłane pola)
+func updateCategory(partial bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := c.Get("db").(*gorm.DB)
+		id, err := parseUintParam(c, "id")
+		if err != nil {
+			return err
+		}
+		var body struct {
+			Name     *string    `json:"name"`
+			ParentID optionalID `json:"parent_id"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid category data")
+		}
+		if body.Name != nil {
+			*body.Name = strings.TrimSpace(*body.Name)
+		}
+		if (body.Name == nil && !partial) || (body.Name != nil && *body.Name == "") {
+			return echo.NewHTTPError(http.StatusBadRequest, "name is required")
+		}
+
+		var category Category
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.First(&category, id).Error; err != nil {
+				return err
+			}
+			updates := map[string]interface{}{"updated_at": time.Now()}
+			if body.Name != nil {
+				updates["name"] = *body.Name
+			}
+			if body.ParentID.Set || !partial {
+				if err := ValidateCategoryParent(tx, category.ID, body.ParentID.Value); err != nil {
+					return err
+				}
+				updates["parent_id"] = body.ParentID.Value
+			}
+			return tx.Model(&category).Updates(updates).Error
+		})
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Category not found")
+		}
+		if err != nil {
+			return categoryError(err)
+		}
+		if category.Path, err = CategoryPath(db, category.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch category path")
+		}
+		return c.JSON(http.StatusOK, category)
+	}
+}
+
+// moveCategoryProducts przenosi produkty do innej kategorii (0 odpina je) i zapisuje ich rewizje.
+// Produkty z kosza też są przenoszone, żeby po przywróceniu nie wskazywały usuniętej kategorii.
+func moveCategoryProducts(tx *gorm.DB, from, to uint, actor string) error {
+	var products []Product
+	if err := tx.Unscoped().Where("category_id = ?", from).Order("id").Find(&products).Error; err != nil {
+		return err
+	}
+	for i := range products {
+		p := &products[i]
+		p.CategoryID = to
+		if err := tx.Unscoped().Model(p).Update("category_id", to).Error; err != nil {
+			return err
+		}
+		if _, err := RecordProductRevision(tx, p, RevisionUpdated, actor, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteCategory(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	id, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	policy := c.QueryParam("policy")
+	if policy == "" {
+		policy = CategoryDeleteReject
+	}
+	var targetID uint
+	switch policy {
+	case CategoryDeleteReject, CategoryDeleteDetach:
+	case CategoryDeleteReassign:
+		v, err := strconv.ParseUint(c.QueryParam("target_id"), 10, 64)
+		if err != nil || uint(v) == id {
+			return echo.NewHTTPError(http.StatusBadRequest, "Policy reassign requires a valid target_id of another category")
+		}
+		targetID = uint(v)
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid policy, expected reject, reassign or detach")
+	}
+
+	var target Category
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var category Category
+		if err := tx.First(&category, id).Error; err != nil {
+			return err
+		}
+		switch policy {
+		case CategoryDeleteReject:
+			var count int64
+			if err := tx.Unscoped().Model(&Product{}).Where("category_id = ?", category.ID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrCategoryNotEmpty
+			}
+		case CategoryDeleteReassign:
+			if err := tx.First(&target, targetID).Error; err != nil {
+				return ErrCategoryNotFound
+			}
+			if err := moveCategoryProducts(tx, category.ID, target.ID, requestActor(c)); err != nil {
+				return err
+			}
+		case CategoryDeleteDetach:
+			if err := moveCategoryProducts(tx, category.ID, 0, requestActor(c)); err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&Category{}).Where("parent_id = ?", category.ID).Update("parent_id", category.ParentID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&category).Error
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Category not found")
+	case errors.Is(err, ErrCategoryNotFound):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Target category not found")
+	case err != nil:
+		return categoryError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func newCategoryTestServer(t *testing.T) (*echo.Echo, *gorm.DB) {
+	db := newTestDB(t, schemaModels...)
+	e := echo.New()
+	e.Use(DBMiddleware(db))
+	e.Use(AdminMiddleware(testAdmins(t)))
+	e.GET("/categories/tree", getCategoryTree)
+	e.GET("/categories/:id", getCategory)
+	e.PATCH("/categories/:id", updateCategory(true))
+	e.PUT("/categories/:id/parent", moveCategory)
+	e.DELETE("/categories/:id", deleteCategory)
+	e.GET("/products", getAllProducts)
+	return e, db
+}
+
+// categoryChain tworzy kategorie, z których każda jest dzieckiem poprzedniej
+func categoryChain(t *testing.T, db *gorm.DB, names ...string) []Category {
+	t.Helper()
+	chain := make([]Category, len(names))
+	var parentID *uint
+	for i, name := range names {
+		chain[i] = Category{Name: name, ParentID: parentID}
+		require.NoError(t, db.Create(&chain[i]).Error)
+		parentID = &chain[i].ID
+	}
+	return chain
+}
+
+func moveUnder(e *echo.Echo, id uint, parentID string) *httptest.ResponseRecorder {
+	return doRequest(e, http.MethodPut, fmt.Sprintf("/categories/%d/parent", id), `{"parent_id":`+parentID+`}`)
+}
+
+// categoryProducts tworzy kategorię z produktem aktywnym i produktem w koszu
+func categoryProducts(t *testing.T, db *gorm.DB, name string) (Category, []Product) {
+	t.Helper()
+	category := Category{Name: name}
+	require.NoError(t, db.Create(&category).Error)
+	products := []Product{
+		{Name: name + " 1", Price: NewMoney(1000, "PLN"), Currency: "PLN", CategoryID: category.ID},
+		{Name: name + " 2", Price: NewMoney(2000, "PLN"), Currency: "PLN", CategoryID: category.ID},
+	}
+	for i := range products {
+		require.NoError(t, db.Create(&products[i]).Error)
+		_, err := RecordProductRevision(db, &products[i], RevisionCreated, "test", nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Delete(&products[1]).Error)
+	return category, products
+}
+
+func lastRevision(t *testing.T, db *gorm.DB, productID uint) ProductRevision {
+	t.Helper()
+	var revision ProductRevision
+	require.NoError(t, db.Where("product_id = ?", productID).Order("revision DESC").Take(&revision).Error)
+	return revision
+}
+
+func TestDeleteCategoryReassignRecordsRevisions(t *testing.T) {
+	e, db := newCategoryTestServer(t)
+	source, products := categoryProducts(t, db, "Herbaty")
+	target := Category{Name: "Napoje"}
+	require.NoError(t, db.Create(&target).Error)
+
+	rec := doRequest(e, http.MethodDelete, fmt.Sprintf("/categories/%d?policy=reassign&target_id=%d", source.ID, target.ID), "",
+		adminTokenHeader, testAdminToken)
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+
+	for _, p := range products {
+		var product Product
+		require.NoError(t, db.Unscoped().First(&product, p.ID).Error)
+		assert.Equal(t, target.ID, product.CategoryID)
+
+		revision := lastRevision(t, db, p.ID)
+		assert.Equal(t, 2, revision.Revision)
+		assert.Equal(t, RevisionUpdated, revision.Action)
+		assert.Equal(t, "magazyn", revision.Author)
+		assert.Equal(t, target.ID, revision.CategoryID)
+		if assert.Len(t, revision.Changes, 1) {
+			assert.Equal(t, "category_id", revision.Changes[0].Field)
+		}
+	}
+}
+
+func TestDeleteCategoryDetachRecordsRevisions(t *testing.T) {
+	e, db := newCategoryTestServer(t)
+	category, products := categoryProducts(t, db, "Kawy")
+
+	rec := doRequest(e, http.MethodDelete, fmt.Sprintf("/categories/%d?policy=detach", category.ID), "")
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+
+	for _, p := range products {
+		revision := lastRevision(t, db, p.ID)
+		assert.Equal(t, RevisionUpdated, revision.Action)
+		assert.Equal(t, "api", revision.Author)
+		assert.Zero(t, revision.CategoryID)
+	}
+}
+
+func TestDeleteCategoryRejectKeepsProducts(t *testing.T) {
+	e, db := newCategoryTestServer(t)
+	category, products := categoryProducts(t, db, "Przyprawy")
+
+	rec := doRequest(e, http.MethodDelete, fmt.Sprintf("/categories/%d", category.ID), "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, 1, lastRevision(t, db, products[0].ID).Revision)
+}
+
+func TestCategoryTreeAndBreadcrumbs(t *testing.T) {
+	e, db := newCategoryTestServer(t)
+	chain := categoryChain(t, db, "Elektronika", "Telefony", "Akcesoria")
+	books := Category{Name: "Książki"}
+	require.NoError(t, db.Create(&books).Error)
+
+	rec := doRequest(e, http.MethodGet, "/categories/tree", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var tree []CategoryNode
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tree))
+	require.Len(t, tree, 2)
+	assert.Equal(t, "Elektronika", tree[0].Name)
+	assert.Equal(t, "Książki", tree[1].Name)
+	assert.Empty(t, tree[1].Children)
+	require.Len(t, tree[0].Children, 1)
+	phones := tree[0].Children[0]
+	assert.Equal(t, chain[1].ID, phones.ID)
+	require.Len(t, phones.Children, 1)
+	assert.Equal(t, chain[2].ID, phones.Children[0].ID)
+
+	rec = doRequest(e, http.MethodGet, fmt.Sprintf("/categories/%d", chain[2].ID), "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var category Category
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &category))
+	assert.Equal(t, []CategoryCrumb{
+		{ID: chain[0].ID, Name: "Elektronika"},
+		{ID: chain[1].ID, Name: "Telefony"},
+		{ID: chain[2].ID, Name: "Akcesoria"},
+	}, category.Path)
+}
+
+func TestMoveCategoryRejectsCycles(t *testing.T) {
+	e, db := newCategoryTestServer(t)
+	chain := categoryChain(t, db, "Elektronika", "Telefony", "Akcesoria")
+	root, leaf := chain[0].ID, chain[2].ID
+
+	assert.Equal(t, http.StatusUnprocessableEntity, moveUnder(e, root, strconv.Itoa(int(leaf))).Code, "under a descendant")
+	assert.Equal(t, http.StatusUnprocessableEntity, moveUnder(e, root, strconv.Itoa(int(root))).Code, "under itself")
+	assert.Equal(t, http.StatusUnprocessableEntity, moveUnder(e, root, "999").Code, "missing parent")
+	rec := doRequest(e, http.MethodPatch, fmt.Sprintf("/categories/%d", chain[1].ID), fmt.Sprintf(`{"parent_id":%d}`, leaf))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	var stored Category
+	require.NoError(t, db.First(&stored, root).Error)
+	assert.Nil(t, stored.ParentID)
+
+	// liść przeniesiony do korzeni, a dawny korzeń pod niego - teraz już bez cyklu
+	rec = moveUnder(e, leaf, "null")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = moveUnder(e, root, strconv.Itoa(int(leaf)))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var moved Category
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &moved))
+	assert.Equal(t, []CategoryCrumb{{ID: leaf, Name: "Akcesoria"}, {ID: root, Name: "Elektronika"}}, moved.Path)
+}
+
+func TestCategoryQueriesStopOnCycleInDatabase(t *testing.T) {
+	e, db := newCategoryTestServer(t)
+	chain := categoryChain(t, db, "A", "B", "C")
+	// cykl zapisany z pominięciem walidacji (np. ręczną zmianą w bazie)
+	require.NoError(t, db.Model(&chain[0]).Update("parent_id", chain[2].ID).Error)
+	product := Product{Name: "Kubek", Price: NewMoney(1000, "PLN"), Currency: "PLN", CategoryID: chain[1].ID}
+	require.NoError(t, db.Create(&product).Error)
+
+	path, err := CategoryPath(db, chain[2].ID)
+	require.NoError(t, err)
+	assert.Len(t, path, 3, "every category appears once")
+	assert.ErrorIs(t, ValidateCategoryParent(db, chain[1].ID, &chain[0].ID), ErrCategoryCycle)
+
+	rec := doRequest(e, http.MethodGet, fmt.Sprintf("/products?category_id=%d&include_descendants=true", chain[0].ID), "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Len(t, decodeProducts(t, rec.Body.Bytes()), 1)
+}
+
+func TestProductsIncludeDescendants(t *testing.T) {
+	e, db := newCategoryTestServer(t)
+	chain := categoryChain(t, db, "Elektronika", "Telefony", "Akcesoria")
+	books := Category{Name: "Książki"}
+	require.NoError(t, db.Create(&books).Error)
+	for i, categoryID := range []uint{chain[0].ID, chain[1].ID, chain[2].ID, books.ID} {
+		product := Product{Name: fmt.Sprintf("Produkt %d", i), Price: NewMoney(1000, "PLN"), Currency: "PLN", CategoryID: categoryID}
+		require.NoError(t, db.Create(&product).Error)
+	}
+
+	list := func(query string) []Product {
+		rec := doRequest(e, http.MethodGet, "/products?"+query, "")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		return decodeProducts(t, rec.Body.Bytes())
+	}
+	assert.Len(t, list(fmt.Sprintf("category_id=%d", chain[0].ID)), 1)
+	assert.Len(t, list(fmt.Sprintf("category_id=%d&include_descendants=true", chain[0].ID)), 3)
+	assert.Len(t, list(fmt.Sprintf("category_id=%d&include_descendants=true", chain[1].ID)), 2)
+	assert.Len(t, list(fmt.Sprintf("category_id=%d&include_descendants=true", books.ID)), 1)
+
+	rec := doRequest(e, http.MethodGet, fmt.Sprintf("/products?category_id=%d&include_descendants=nie", chain[0].ID), "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
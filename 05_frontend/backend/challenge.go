@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Silne uwierzytelnienie klienta (SCA, 3-D Secure). Gdy bramka przy autoryzacji zwraca
+// ChallengeURL, płatność dostaje status requires_action, a /payments odpowiada 202 z redirect_url.
+// Klient przechodzi stronę banku i wraca przez /payments/:id/return; środki są pobierane
+// dopiero po udanym uwierzytelnieniu. Nieukończone w THREE_DS_TIMEOUT płatności wygasają
+// tak jak BLIK (expireAwaitingPayment, także okresowo w StartAwaitingPaymentSweeper),
+// a autoryzacja jest anulowana.
+
+var threeDSTimeout = envDuration("THREE_DS_TIMEOUT", 10*time.Minute)
+
+// ChallengeSimulator pozwala lokalnie przejść stronę 3-D Secure fałszywej bramki
+type ChallengeSimulator interface {
+	ResolveChallenge(reference string, success bool) error
+}
+
+func (g *FakeGateway) ResolveChallenge(reference string, success bool) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	auth, err := g.authorization(reference)
+	if err != nil {
+		return err
+	}
+	if auth.State != fakeChallenge {
+		return ErrInvalidGatewayState
+	}
+	auth.State = fakeVoided
+	if success {
+		auth.State = fakeAuthorized
+	}
+	return g.db.Save(auth).Error
+}
+
+// startChallenge zamyka koszyk na czas uwierzytelnienia i odsyła klienta na stronę banku
+func startChallenge(c echo.Context, gateway PaymentGateway, record *Payment, cart *Cart, order *Order, totals *CartTotals, auth *Authorization) error {
+	db := c.Get("db").(*gorm.DB)
+	if order == nil {
+		var err error
+		if order, err = CheckoutCart(db, cart, totals, "payments"); err != nil {
+			if voidErr := gateway.Void(context.Background(), auth.Reference); voidErr != nil {
+				log.Printf("payments: could not void authorization %s: %v", auth.Reference, voidErr)
+			}
+			failPayment(db, record, PaymentVoided, err)
+			if errors.Is(err, ErrCartLocked) {
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, "Cart can no longer be modified")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not create order")
+		}
+	}
+	expiresAt := time.Now().Add(threeDSTimeout)
+	record.Status = PaymentRequiresAction
+	record.OrderID = &order.ID
+	record.GatewayReference = auth.Reference
+	record.RedirectURL = auth.ChallengeURL
+	record.ExpiresAt = &expiresAt
+	if err := db.Model(record).Updates(map[string]interface{}{
+		"status": record.Status, "order_id": order.ID, "gateway_reference": auth.Reference,
+		"redirect_url": auth.ChallengeURL, "expires_at": expiresAt,
+	}).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not record payment")
+	}
+	return c.JSON(http.StatusAccepted, record)
+}
+
+// completeChallenge kończy płatność po uwierzytelnieniu: pobiera środki albo, jeśli ocena
+// ryzyka skierowała płatność do przeglądu, zostawia autoryzację do decyzji obsługi.
+// Statusy zmieniają się tylko z requires_action, więc płatność wygaszona w międzyczasie
+// nie zostanie pobrana (ErrPaymentChanged).
+func completeChallenge(ctx context.Context, db *gorm.DB, gateway PaymentGateway, record *Payment, success bool) error {
+	if !success {
+		return updatePaymentStatus(db, record, PaymentFailed, "customer authentication failed")
+	}
+	var reviews int64
+	if err := db.Model(&FraudAssessment{}).Where("payment_id = ? AND review_status = ?", record.ID, ReviewPending).
+		Count(&reviews).Error; err != nil {
+		return err
+	}
+	if reviews > 0 {
+		return updatePaymentStatus(db, record, PaymentInReview, "")
+	}
+	if err := updatePaymentStatus(db, record, PaymentAuthorized, ""); err != nil {
+		return err
+	}
+	cart, err := loadCart(db, record.CartID)
+	if err != nil {
+		return err
+	}
+	order, err := paymentOrder(db, record)
+	if err != nil {
+		return err
+	}
+	_, err = captureAuthorizedPayment(ctx, db, gateway, record, cart, order, nil, "payments")
+	return err
+}
+
+var challengePage = template.Must(template.New("challenge").Parse(`<!doctype html>
+<html lang="pl">
+<head><meta charset="utf-8"><title>3-D Secure</title></head>
+<body>
+<h1>Potwierdzenie płatności kartą</h1>
+<p>Karta {{.CardMasked}}, kwota <strong>{{.Amount}}</strong></p>
+<form method="post">
+<button name="result" value="success">Potwierdź</button>
+<button name="result" value="failure">Odrzuć</button>
+</form>
+</body>
+</html>
+`))
+
+// loadChallengePayment znajduje płatność czekającą na 3-D Secure po referencji autoryzacji
+func loadChallengePayment(c echo.Context) (*Payment, error) {
+	db := c.Get("db").(*gorm.DB)
+	var record Payment
+	if err := db.Where("gateway_reference = ? AND method = ?", c.Param("ref"), PaymentMethodCard).Take(&record).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Payment not found")
+	}
+	expireAwaitingPayment(db, c.Get("gateways").(Gateways), &record)
+	if record.Status != PaymentRequiresAction {
+		return nil, echo.NewHTTPError(http.StatusUnprocessableEntity, "Payment does not require authentication")
+	}
+	return &record, nil
+}
+
+func showChallenge(c echo.Context) error {
+	record, err := loadChallengePayment(c)
+	if err != nil {
+		return err
+	}
+	var page strings.Builder
+	if err := challengePage.Execute(&page, record); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not render page")
+	}
+	return c.HTML(http.StatusOK, page.String())
+}
+
+// submitChallenge symuluje decyzję klienta na stronie banku i odsyła go z powrotem do sklepu
+func submitChallenge(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	record, err := loadChallengePayment(c)
+	if err != nil {
+		return err
+	}
+	gateway, err := c.Get("gateways").(Gateways).Lookup(record.Gateway)
+	if err != nil {
+		return gatewayError(err)
+	}
+	simulator, ok := gateway.(ChallengeSimulator)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Payment gateway cannot simulate 3-D Secure")
+	}
+	success := c.FormValue("result") == "success"
+	if err := simulator.ResolveChallenge(record.GatewayReference, success); err != nil {
+		return gatewayError(err)
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), paymentGatewayTimeout)
+	defer cancel()
+	if err := completeChallenge(ctx, db, gateway, record, success); err != nil {
+		// błąd jest już zapisany w płatności, klient zobaczy go po powrocie do sklepu
+		log.Printf("payments: payment %d could not be completed after 3-D Secure: %v", record.ID, err)
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/payments/%d/return", record.ID))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func newChallengeTestServer(t *testing.T) (*echo.Echo, *gorm.DB, *FakeGateway) {
+	e, db, gateway := newPaymentTestServer(t)
+	e.POST("/simulator/3ds/:ref", submitChallenge)
+	return e, db, gateway
+}
+
+// startChallengePayment płaci kartą wymagającą 3-D Secure i zwraca płatność w requires_action
+func startChallengePayment(t *testing.T, e *echo.Echo, db *gorm.DB, cart *Cart) Payment {
+	t.Helper()
+	totals, err := ComputeTotals(db, cart)
+	require.NoError(t, err)
+	rec := doRequest(e, http.MethodPost, "/payments", fmt.Sprintf(`{"cart_id":%d,"card_number":%q,"exp_month":12,"exp_year":2030,"cvc":"123","amount":%s}`,
+		cart.ID, FakeCard3DSRequired, totals.Total.Decimal()))
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var payment Payment
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &payment))
+	require.Equal(t, PaymentRequiresAction, payment.Status)
+	return payment
+}
+
+func submitChallengeResult(e *echo.Echo, reference, result string) int {
+	return doRequest(e, http.MethodPost, "/simulator/3ds/"+reference, url.Values{"result": {result}}.Encode(),
+		echo.HeaderContentType, echo.MIMEApplicationForm).Code
+}
+
+func TestChallengeSuccessCapturesPayment(t *testing.T) {
+	e, db, _ := newChallengeTestServer(t)
+	cart, _ := newTestCart(t, db, 5, 1)
+	payment := startChallengePayment(t, e, db, cart)
+
+	require.Equal(t, http.StatusSeeOther, submitChallengeResult(e, payment.GatewayReference, "success"))
+	require.NoError(t, db.First(&payment, payment.ID).Error)
+	assert.Equal(t, PaymentCaptured, payment.Status)
+
+	// strona banku nie przyjmie drugiej decyzji
+	assert.Equal(t, http.StatusUnprocessableEntity, submitChallengeResult(e, payment.GatewayReference, "failure"))
+	require.NoError(t, db.First(&payment, payment.ID).Error)
+	assert.Equal(t, PaymentCaptured, payment.Status)
+}
+
+func TestChallengeDoesNotCaptureExpiredPayment(t *testing.T) {
+	e, db, gateway := newChallengeTestServer(t)
+	cart, _ := newTestCart(t, db, 5, 1)
+	payment := startChallengePayment(t, e, db, cart)
+	var stale Payment
+	require.NoError(t, db.First(&stale, payment.ID).Error)
+	// sweeper wygasił płatność, zanim klient wrócił ze strony banku
+	require.NoError(t, db.Model(&Payment{}).Where("id = ?", payment.ID).Update("status", PaymentFailed).Error)
+	require.NoError(t, gateway.ResolveChallenge(stale.GatewayReference, true))
+
+	err := completeChallenge(context.Background(), db, gateway, &stale, true)
+	assert.ErrorIs(t, err, ErrPaymentChanged)
+	require.NoError(t, db.First(&payment, payment.ID).Error)
+	assert.Equal(t, PaymentFailed, payment.Status)
+	// autoryzacja nie została pobrana
+	assert.NoError(t, gateway.Void(context.Background(), stale.GatewayReference))
+}
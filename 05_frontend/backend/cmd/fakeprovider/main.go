@@ -0,0 +1,279 @@
+// Lokalny zastępca operatora płatności z przekierowaniem (w stylu PayU/Przelewy24).
+// Przyjmuje zamówienia od HostedGateway, pokazuje stronę płatności z przyciskami
+// "Zapłać" i "Odrzuć", po decyzji wysyła podpisany webhook do sklepu i odsyła klienta
+// na continue_url.
+//
+//	go run ./cmd/fakeprovider -addr :1324
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"ecommerce/internal/webhooksig"
+)
+
+const (
+	orderNew       = "new"
+	orderCompleted = "completed"
+	orderFailed    = "failed"
+	orderCanceled  = "canceled"
+)
+
+type order struct {
+	ID          string
+	ExtOrderID  string
+	Description string
+	Amount      int64
+	Currency    string
+	NotifyURL   string
+	ContinueURL string
+	Status      string
+	Refunded    int64
+}
+
+type provider struct {
+	mu     sync.Mutex
+	orders map[string]*order
+	key    string
+	secret string
+	public string
+}
+
+func main() {
+	addr := flag.String("addr", ":1324", "listen address")
+	key := flag.String("key", envOr("HOSTED_PROVIDER_KEY", "local-provider-key"), "API key expected from the shop")
+	secret := flag.String("secret", envOr("PAYMENT_WEBHOOK_SECRET", "whsec_local_development"), "webhook signing secret")
+	public := flag.String("public", "http://localhost:1324", "public URL of this server, used in redirect_uri")
+	flag.Parse()
+
+	p := &provider{orders: map[string]*order{}, key: *key, secret: *secret, public: *public}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/orders", p.auth(p.createOrder))
+	mux.HandleFunc("POST /api/orders/{id}/cancel", p.auth(p.cancelOrder))
+	mux.HandleFunc("POST /api/orders/{id}/refunds", p.auth(p.refundOrder))
+	mux.HandleFunc("GET /pay/{id}", p.payPage)
+	mux.HandleFunc("POST /pay/{id}", p.pay)
+
+	log.Printf("fake payment provider listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+func (p *provider) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hmac.Equal([]byte(r.Header.Get("Authorization")), []byte("Bearer "+p.key)) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid API key"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (p *provider) createOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TotalAmount int64  `json:"total_amount"`
+		Currency    string `json:"currency"`
+		ExtOrderID  string `json:"ext_order_id"`
+		Description string `json:"description"`
+		NotifyURL   string `json:"notify_url"`
+		ContinueURL string `json:"continue_url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TotalAmount <= 0 || req.NotifyURL == "" || req.ContinueURL == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid order"})
+		return
+	}
+	o := &order{
+		ID:          "ord_" + randomHex(8),
+		ExtOrderID:  req.ExtOrderID,
+		Description: req.Description,
+		Amount:      req.TotalAmount,
+		Currency:    req.Currency,
+		NotifyURL:   req.NotifyURL,
+		ContinueURL: req.ContinueURL,
+		Status:      orderNew,
+	}
+	p.mu.Lock()
+	p.orders[o.ID] = o
+	p.mu.Unlock()
+	log.Printf("order %s (%s) created: %d %s", o.ID, o.ExtOrderID, o.Amount, o.Currency)
+	writeJSON(w, http.StatusCreated, map[string]string{"order_id": o.ID, "redirect_uri": p.public + "/pay/" + o.ID})
+}
+
+func (p *provider) cancelOrder(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	o, ok := p.orders[r.PathValue("id")]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "order not found"})
+		return
+	}
+	if o.Status != orderNew && o.Status != orderCanceled {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "order is " + o.Status})
+		return
+	}
+	o.Status = orderCanceled
+	writeJSON(w, http.StatusOK, map[string]string{"status": o.Status})
+}
+
+func (p *provider) refundOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Amount int64 `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Amount <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid refund"})
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	o, ok := p.orders[r.PathValue("id")]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "order not found"})
+		return
+	}
+	if o.Status != orderCompleted || o.Refunded+req.Amount > o.Amount {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "order cannot be refunded"})
+		return
+	}
+	o.Refunded += req.Amount
+	writeJSON(w, http.StatusCreated, map[string]string{"refund_id": "rfnd_" + randomHex(8)})
+}
+
+var payPage = template.Must(template.New("pay").Parse(`<!doctype html>
+<html lang="pl">
+<head><meta charset="utf-8"><title>Płatność {{.ID}}</title></head>
+<body>
+<h1>Lokalny operator płatności</h1>
+<p>{{.Description}}</p>
+<p>Kwota: <strong>{{.Total}} {{.Currency}}</strong></p>
+{{if eq .Status "new"}}
+<form method="post">
+<button name="result" value="success">Zapłać</button>
+<button name="result" value="failure">Odrzuć</button>
+</form>
+{{else}}
+<p>Zamówienie ma status: {{.Status}}</p>
+<p><a href="{{.ContinueURL}}">Wróć do sklepu</a></p>
+{{end}}
+</body>
+</html>
+`))
+
+func (p *provider) payPage(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	o, ok := p.orders[r.PathValue("id")]
+	var view order
+	if ok {
+		view = *o
+	}
+	p.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	payPage.Execute(w, struct {
+		order
+		Total string
+	}{view, fmt.Sprintf("%d.%02d", view.Amount/100, view.Amount%100)})
+}
+
+// pay zapisuje decyzję klienta, powiadamia sklep i odsyła klienta na continue_url
+func (p *provider) pay(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	o, ok := p.orders[r.PathValue("id")]
+	if !ok {
+		p.mu.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	if o.Status != orderNew {
+		p.mu.Unlock()
+		http.Redirect(w, r, o.ContinueURL, http.StatusSeeOther)
+		return
+	}
+	o.Status = orderFailed
+	eventType := "payment.failed"
+	if r.FormValue("result") == "success" {
+		o.Status = orderCompleted
+		eventType = "payment.succeeded"
+	}
+	view := *o
+	p.mu.Unlock()
+
+	if err := p.notify(view, eventType); err != nil {
+		log.Printf("order %s: webhook not delivered: %v", view.ID, err)
+	}
+	http.Redirect(w, r, view.ContinueURL, http.StatusSeeOther)
+}
+
+// notify wysyła webhook kilka razy, tak jak prawdziwy operator ponawia powiadomienia
+func (p *provider) notify(o order, eventType string) error {
+	data := map[string]interface{}{"gateway_reference": o.ID}
+	if eventType == "payment.failed" {
+		data["reason"] = "rejected by customer"
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"id":      "evt_" + randomHex(8),
+		"type":    eventType,
+		"created": time.Now().Unix(),
+		"data":    data,
+	})
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err = p.deliver(o.NotifyURL, body)
+		if err == nil || attempt == 3 {
+			return err
+		}
+		log.Printf("order %s: webhook attempt %d failed: %v", o.ID, attempt, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func (p *provider) deliver(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhooksig.Header, webhooksig.Sign(p.secret, time.Now(), body))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("shop responded %s", res.Status)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,97 @@
+// Narzędzie symulujące bramkę płatności: podpisuje zdarzenie webhooka tak jak
+// receivePaymentWebhook tego oczekuje i opcjonalnie wysyła je do serwera.
+//
+//	go run ./cmd/webhook-signer -type payment.succeeded -payment 12 -url http://localhost:1323/webhooks/payments
+//	echo '{"id":"evt_1","type":"payment.failed","data":{"payment_id":12}}' | go run ./cmd/webhook-signer
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"ecommerce/internal/webhooksig"
+)
+
+func main() {
+	secret := flag.String("secret", envOr("PAYMENT_WEBHOOK_SECRET", "whsec_local_development"), "webhook signing secret")
+	data := flag.String("data", "", "event JSON; read from stdin when empty and -type is not set")
+	eventType := flag.String("type", "", "build an event of this type instead of reading JSON")
+	eventID := flag.String("id", "", "event id for a built event (random when empty)")
+	paymentID := flag.Uint("payment", 0, "payment id for a built event")
+	reference := flag.String("reference", "", "gateway reference for a built event")
+	reason := flag.String("reason", "", "failure reason for a built event")
+	skew := flag.Duration("skew", 0, "shift the signature timestamp, e.g. -10m to test tolerance")
+	url := flag.String("url", "", "POST the signed event to this URL")
+	flag.Parse()
+
+	body, err := eventBody(*data, *eventType, *eventID, *paymentID, *reference, *reason)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	signature := webhooksig.Sign(*secret, time.Now().Add(*skew), body)
+
+	if *url == "" {
+		fmt.Printf("%s: %s\n%s\n", webhooksig.Header, signature, body)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, *url, bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhooksig.Header, signature)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer res.Body.Close()
+	resBody, _ := io.ReadAll(res.Body)
+	fmt.Printf("%s\n%s\n", res.Status, resBody)
+	if res.StatusCode >= 300 {
+		os.Exit(1)
+	}
+}
+
+func eventBody(data, eventType, id string, paymentID uint, reference, reason string) ([]byte, error) {
+	if eventType == "" {
+		if data != "" {
+			return []byte(data), nil
+		}
+		return io.ReadAll(os.Stdin)
+	}
+	if id == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		id = "evt_" + hex.EncodeToString(b)
+	}
+	return json.Marshal(map[string]interface{}{
+		"id":      id,
+		"type":    eventType,
+		"created": time.Now().Unix(),
+		"data": map[string]interface{}{
+			"payment_id":        paymentID,
+			"gateway_reference": reference,
+			"reason":            reason,
+		},
+	})
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Konfiguracja z zmiennych środowiskowych z wartościami domyślnymi
+
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	if v := os.Getenv(name); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+// isLocalURL mówi, czy adres wskazuje na tę samą maszynę - jawne wartości deweloperskie
+// (sekrety, klucze) są dozwolone tylko wtedy
+func isLocalURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	switch u.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
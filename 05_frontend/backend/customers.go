@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Klienci sklepu. Konto zakłada się przez POST /customers, które jednorazowo zwraca token
+// dostępu; kolejne żądania przedstawiają go w nagłówku "Authorization: Bearer <token>".
+// W bazie przechowywany jest tylko skrót tokenu.
+
+type Customer struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Email     string    `gorm:"uniqueIndex" json:"email"`
+	Name      string    `json:"name"`
+	TokenHash string    `gorm:"uniqueIndex" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func hashCustomerToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CustomerMiddleware rozpoznaje klienta po tokenie; żądania bez tokenu są anonimowe,
+// a z nieprawidłowym tokenem odrzucane
+func CustomerMiddleware(db *gorm.DB) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			header := c.Request().Header.Get(echo.HeaderAuthorization)
+			if header == "" {
+				return next(c)
+			}
+			token, ok := strings.CutPrefix(header, "Bearer ")
+			var customer Customer
+			if !ok || db.Where("token_hash = ?", hashCustomerToken(token)).Take(&customer).Error != nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid customer token")
+			}
+			c.Set("customer", &customer)
+			return next(c)
+		}
+	}
+}
+
+// currentCustomer zwraca zalogowanego klienta albo nil dla żądań anonimowych
+func currentCustomer(c echo.Context) *Customer {
+	customer, _ := c.Get("customer").(*Customer)
+	return customer
+}
+
+func requireCustomer(c echo.Context) (*Customer, error) {
+	customer := currentCustomer(c)
+	if customer == nil {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Customer token required")
+	}
+	return customer, nil
+}
+
+func createCustomer(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	var body struct {
+		Email string `json:"email"`
+		Name  string `json:"name"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid customer data")
+	}
+	email := strings.ToLower(strings.TrimSpace(body.Email))
+	if _, err := mail.ParseAddress(email); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "A valid email is required")
+	}
+	token := "cus_" + randomHex(24)
+	customer := &Customer{Email: email, Name: strings.TrimSpace(body.Name), TokenHash: hashCustomerToken(token)}
+	if err := db.Create(customer).Error; err != nil {
+		return echo.NewHTTPError(http.StatusConflict, "Customer with this email already exists")
+	}
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"customer": customer,
+		"token":    token,
+	})
+}
+
+func getCurrentCustomer(c echo.Context) error {
+	customer, err := requireCustomer(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, customer)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Prosta szyna zdarzeń w obrębie procesu. Zdarzenia publikowane są po zatwierdzeniu
+// transakcji, a subskrybenci wywoływani synchronicznie w kolejności rejestracji.
+
+type OrderEvent struct {
+	OrderID uint      `json:"order_id"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Actor   string    `json:"actor"`
+	Reason  string    `json:"reason,omitempty"`
+	At      time.Time `json:"at"`
+	// autoryzacje unieważnione przy anulowaniu, do zwolnienia w bramce po zatwierdzeniu transakcji
+	Voided []Payment `json:"-"`
+}
+
+type OrderEventHandler func(OrderEvent)
+
+type EventBus struct {
+	mu       sync.RWMutex
+	handlers []OrderEventHandler
+}
+
+var orderEvents = &EventBus{}
+
+func (b *EventBus) Subscribe(h OrderEventHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, h)
+}
+
+func (b *EventBus) Publish(ev OrderEvent) {
+	b.mu.RLock()
+	handlers := append([]OrderEventHandler(nil), b.handlers...)
+	b.mu.RUnlock()
+	for _, h := range handlers {
+		b.dispatch(h, ev)
+	}
+}
+
+// błąd jednego subskrybenta nie może przerwać obsługi żądania ani pozostałych subskrybentów
+func (b *EventBus) dispatch(h OrderEventHandler, ev OrderEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("order event handler panicked on %+v: %v", ev, r)
+		}
+	}()
+	h(ev)
+}
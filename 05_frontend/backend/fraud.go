@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Ocena ryzyka płatności kartą przed wywołaniem bramki (ochrona przed testowaniem kart).
+// Każda próba jest zapisywana jako FraudAssessment razem z sygnałami, które złożyły się
+// na wynik, więc liczniki prędkości liczą też próby odrzucone przed bramką.
+// Wynik poniżej FRAUD_REVIEW_SCORE przepuszcza płatność, od FRAUD_BLOCK_SCORE ją blokuje,
+// a pomiędzy: karta jest autoryzowana, ale pobranie czeka na decyzję obsługi (/fraud/reviews).
+// Płatność nierozpatrzona w FRAUD_REVIEW_TIMEOUT jest anulowana przez StartAwaitingPaymentSweeper.
+
+const (
+	FraudAllow  = "allow"
+	FraudReview = "review"
+	FraudBlock  = "block"
+)
+
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+	// nikt nie rozpatrzył płatności w FRAUD_REVIEW_TIMEOUT
+	ReviewExpired = "expired"
+)
+
+var (
+	fraudWindow              = envDuration("FRAUD_WINDOW", 10*time.Minute)
+	fraudIPLimit             = envInt("FRAUD_IP_LIMIT", 10)
+	fraudCardLimit           = envInt("FRAUD_CARD_LIMIT", 3)
+	fraudCardDeclineLimit    = envInt("FRAUD_CARD_DECLINE_LIMIT", 2)
+	fraudCartCardsLimit      = envInt("FRAUD_CART_CARDS_LIMIT", 2)
+	fraudAmountMismatchLimit = envInt("FRAUD_AMOUNT_MISMATCH_LIMIT", 2)
+	fraudReviewScore         = envInt("FRAUD_REVIEW_SCORE", 50)
+	fraudBlockScore          = envInt("FRAUD_BLOCK_SCORE", 80)
+	fraudReviewTimeout       = envDuration("FRAUD_REVIEW_TIMEOUT", 24*time.Hour)
+	fraudFingerprintKey      = envString("FRAUD_FINGERPRINT_KEY", devFingerprintKey)
+)
+
+// devFingerprintKey to jawny klucz deweloperski; odciski kart pod nim da się odwrócić,
+// przeliczając wszystkie numery z danego zakresu BIN
+const devFingerprintKey = "local-fingerprint-key"
+
+// checkFingerprintKey wymaga własnego FRAUD_FINGERPRINT_KEY, gdy sklep nie działa lokalnie
+func checkFingerprintKey() error {
+	if fraudFingerprintKey != devFingerprintKey || isLocalURL(publicURL) {
+		return nil
+	}
+	return errors.New("FRAUD_FINGERPRINT_KEY must be set when PUBLIC_URL is not local")
+}
+
+type FraudAssessment struct {
+	ID              uint          `gorm:"primaryKey" json:"id"`
+	PaymentID       *uint         `gorm:"index" json:"payment_id,omitempty"`
+	CartID          uint          `gorm:"index" json:"cart_id"`
+	IP              string        `gorm:"index" json:"ip"`
+	CardFingerprint string        `gorm:"index" json:"-"`
+	Amount          Money         `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	AmountMismatch  bool          `json:"amount_mismatch"`
+	Score           int           `json:"score"`
+	Decision        string        `gorm:"index" json:"decision"`
+	Signals         []FraudSignal `gorm:"foreignKey:AssessmentID" json:"signals"`
+	ReviewStatus    string        `gorm:"index" json:"review_status,omitempty"`
+	ReviewedBy      string        `json:"reviewed_by,omitempty"`
+	ReviewNote      string        `json:"review_note,omitempty"`
+	ReviewedAt      *time.Time    `json:"reviewed_at,omitempty"`
+	CreatedAt       time.Time     `gorm:"index" json:"created_at"`
+}
+
+// FraudSignal to jedna reguła, która zadziałała, z uzasadnieniem do audytu
+type FraudSignal struct {
+	ID           uint   `gorm:"primaryKey" json:"id"`
+	AssessmentID uint   `gorm:"index" json:"assessment_id"`
+	Rule         string `json:"rule"`
+	Score        int    `json:"score"`
+	Detail       string `json:"detail"`
+}
+
+type FraudInput struct {
+	IP              string
+	CartID          uint
+	CardFingerprint string
+	Amount          Money
+	Expected        Money
+}
+
+// cardFingerprint identyfikuje kartę między próbami bez przechowywania numeru;
+// każda tokenizacja tej samej karty daje nowy token, więc tokeny do liczników się nie nadają
+func cardFingerprint(number string) string {
+	mac := hmac.New(sha256.New, []byte(fraudFingerprintKey))
+	mac.Write([]byte(number))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// savedCardFingerprint identyfikuje w licznikach zapisaną kartę, której numeru już nie znamy
+func savedCardFingerprint(methodID uint) string {
+	return cardFingerprint(fmt.Sprintf("saved:%d", methodID))
+}
+
+// AssessPayment liczy wynik ryzyka z wcześniejszych prób w oknie FRAUD_WINDOW i zapisuje ocenę
+func AssessPayment(db *gorm.DB, in FraudInput) (*FraudAssessment, error) {
+	since := time.Now().Add(-fraudWindow)
+	recent := db.Model(&FraudAssessment{}).Where("created_at > ?", since).Session(&gorm.Session{})
+	a := &FraudAssessment{
+		CartID:          in.CartID,
+		IP:              in.IP,
+		CardFingerprint: in.CardFingerprint,
+		Amount:          in.Amount,
+		AmountMismatch:  in.Amount.Currency != in.Expected.Currency || in.Amount.Amount != in.Expected.Amount,
+		Signals:         []FraudSignal{},
+	}
+	signal := func(rule string, score int, format string, args ...interface{}) {
+		a.Signals = append(a.Signals, FraudSignal{Rule: rule, Score: score, Detail: fmt.Sprintf(format, args...)})
+		a.Score += score
+	}
+
+	var byIP, byCard, mismatches, declines, cards int64
+	if err := recent.Where("ip = ?", in.IP).Count(&byIP).Error; err != nil {
+		return nil, err
+	}
+	if byIP >= int64(fraudIPLimit) {
+		signal("ip_velocity", 40, "%d attempts from %s in the last %s", byIP, in.IP, fraudWindow)
+	}
+	if err := recent.Where("card_fingerprint = ?", in.CardFingerprint).Count(&byCard).Error; err != nil {
+		return nil, err
+	}
+	if byCard >= int64(fraudCardLimit) {
+		signal("card_velocity", 40, "%d attempts with this card in the last %s", byCard, fraudWindow)
+	}
+	if err := db.Model(&Payment{}).Where("card_fingerprint = ? AND status = ? AND created_at > ?", in.CardFingerprint, PaymentFailed, since).
+		Count(&declines).Error; err != nil {
+		return nil, err
+	}
+	if declines >= int64(fraudCardDeclineLimit) {
+		signal("card_declines", 30, "%d failed payments with this card in the last %s", declines, fraudWindow)
+	}
+	if err := recent.Where("cart_id = ? AND card_fingerprint <> ?", in.CartID, in.CardFingerprint).
+		Distinct("card_fingerprint").Count(&cards).Error; err != nil {
+		return nil, err
+	}
+	if cards+1 > int64(fraudCartCardsLimit) {
+		signal("distinct_cards", 50, "%d different cards used for cart %d", cards+1, in.CartID)
+	}
+	if a.AmountMismatch {
+		signal("amount_mismatch", 20, "amount %s does not match cart total %s", in.Amount, in.Expected)
+	}
+	if err := recent.Where("ip = ? AND amount_mismatch = ?", in.IP, true).Count(&mismatches).Error; err != nil {
+		return nil, err
+	}
+	if mismatches >= int64(fraudAmountMismatchLimit) {
+		signal("repeated_amount_mismatch", 40, "%d attempts with a wrong amount from %s in the last %s", mismatches, in.IP, fraudWindow)
+	}
+
+	switch {
+	case a.Score >= fraudBlockScore:
+		a.Decision = FraudBlock
+	case a.Score >= fraudReviewScore:
+		a.Decision = FraudReview
+		a.ReviewStatus = ReviewPending
+	default:
+		a.Decision = FraudAllow
+	}
+	if err := db.Create(a).Error; err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reasons skleja uzasadnienia sygnałów w jeden opis
+func (a *FraudAssessment) Reasons() string {
+	reasons := make([]string, len(a.Signals))
+	for i, s := range a.Signals {
+		reasons[i] = s.Detail
+	}
+	return strings.Join(reasons, "; ")
+}
+
+func linkAssessment(db *gorm.DB, a *FraudAssessment, paymentID uint) {
+	a.PaymentID = &paymentID
+	if err := db.Model(a).Update("payment_id", paymentID).Error; err != nil {
+		log.Printf("fraud: could not link assessment %d to payment %d: %v", a.ID, paymentID, err)
+	}
+}
+
+func getFraudAssessments(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	query := db.Preload("Signals").Order("id DESC").Limit(200)
+	if decision := c.QueryParam("decision"); decision != "" {
+		query = query.Where("decision = ?", decision)
+	}
+	if cartID := c.QueryParam("cart_id"); cartID != "" {
+		query = query.Where("cart_id = ?", cartID)
+	}
+	if paymentID := c.QueryParam("payment_id"); paymentID != "" {
+		query = query.Where("payment_id = ?", paymentID)
+	}
+	assessments := []FraudAssessment{}
+	if err := query.Find(&assessments).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch fraud assessments")
+	}
+	return c.JSON(http.StatusOK, assessments)
+}
+
+// getFraudReviews zwraca kolejkę płatności czekających na decyzję, od najstarszej
+func getFraudReviews(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	assessments := []FraudAssessment{}
+	if err := db.Preload("Signals").Where("review_status = ? AND payment_id IS NOT NULL", ReviewPending).
+		Order("id").Find(&assessments).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch fraud reviews")
+	}
+	return c.JSON(http.StatusOK, assessments)
+}
+
+// reviewPayment zatwierdza (pobiera środki) lub odrzuca (anuluje autoryzację) płatność z kolejki
+func reviewPayment(approve bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := c.Get("db").(*gorm.DB)
+		gateways := c.Get("gateways").(Gateways)
+		var body struct {
+			Note string `json:"note"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid review data")
+		}
+		var assessment FraudAssessment
+		if err := db.First(&assessment, c.Param("id")).Error; err != nil || assessment.PaymentID == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "Fraud review not found")
+		}
+		var record Payment
+		if err := db.First(&record, *assessment.PaymentID).Error; err != nil {
+			return echo.NewHTTPError(http.StatusNotFound, "Payment not found")
+		}
+
+		if record.Status != PaymentInReview {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, "Payment is not awaiting review")
+		}
+		// bez bramki nie da się ani pobrać, ani anulować autoryzacji - decyzja nie jest zapisywana
+		gateway, err := gateways.Lookup(record.Gateway)
+		if err != nil {
+			return gatewayError(err)
+		}
+
+		// decyzja jest zapisywana warunkowo, więc dwie osoby nie rozpatrzą tej samej płatności
+		now := time.Now()
+		decide := func(tx *gorm.DB, status string) error {
+			res := tx.Model(&FraudAssessment{}).Where("id = ? AND review_status = ?", assessment.ID, ReviewPending).
+				Updates(map[string]interface{}{"review_status": status, "reviewed_by": requestActor(c), "review_note": body.Note, "reviewed_at": now})
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				return ErrPaymentChanged
+			}
+			return nil
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request().Context(), paymentGatewayTimeout)
+		defer cancel()
+		if !approve {
+			// odrzucenie anuluje nieopłacone zamówienie w tej samej transakcji, tak jak ExpireFraudReviews
+			var event *OrderEvent
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := decide(tx, ReviewRejected); err != nil {
+					return err
+				}
+				if err := updatePaymentStatus(tx, &record, PaymentVoided, "rejected in fraud review"); err != nil {
+					return err
+				}
+				if record.OrderID == nil {
+					return nil
+				}
+				var order Order
+				if err := tx.First(&order, *record.OrderID).Error; err != nil {
+					return err
+				}
+				if order.Status != OrderPending {
+					return nil
+				}
+				ev, err := transitionOrder(tx, &order, OrderCancelled, requestActor(c), "rejected in fraud review")
+				if err != nil {
+					return err
+				}
+				event = &ev
+				return nil
+			})
+			switch {
+			case errors.Is(err, ErrPaymentChanged), errors.Is(err, ErrOrderChanged):
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, "Payment is not awaiting review")
+			case err != nil:
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not record review")
+			}
+			if err := gateway.Void(ctx, record.GatewayReference); err != nil {
+				log.Printf("fraud: could not void authorization %s: %v", record.GatewayReference, err)
+			}
+			if event != nil {
+				orderEvents.Publish(*event)
+			}
+			return c.JSON(http.StatusOK, record)
+		}
+
+		if err := decide(db, ReviewApproved); errors.Is(err, ErrPaymentChanged) {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, "Payment is not awaiting review")
+		} else if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not record review")
+		}
+
+		cart, err := loadCart(db, record.CartID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not load cart")
+		}
+		order, err := paymentOrder(db, &record)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not load order")
+		}
+		if _, err := captureAuthorizedPayment(ctx, db, gateway, &record, cart, order, nil, requestActor(c)); err != nil {
+			return captureError(err)
+		}
+		return c.JSON(http.StatusOK, record)
+	}
+}
+
+// ExpireFraudReviews anuluje płatności, których nikt nie rozpatrzył w FRAUD_REVIEW_TIMEOUT:
+// autoryzacja jest anulowana w bramce, a nieopłacone zamówienie anulowane, co zwalnia
+// rezerwacje i otwiera koszyk do ponownej płatności
+func ExpireFraudReviews(db *gorm.DB, gateways Gateways) (int, error) {
+	var overdue []FraudAssessment
+	if err := db.Where("review_status = ? AND payment_id IS NOT NULL AND created_at <= ?", ReviewPending, time.Now().Add(-fraudReviewTimeout)).
+		Find(&overdue).Error; err != nil {
+		return 0, err
+	}
+	expired := 0
+	for _, assessment := range overdue {
+		var record Payment
+		var event *OrderEvent
+		voided := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// płatność po 3-D Secure trafia do przeglądu dopiero po uwierzytelnieniu klienta
+			if err := tx.First(&record, *assessment.PaymentID).Error; err != nil || record.Status != PaymentInReview {
+				return err
+			}
+			// warunkowo, tak jak decyzja obsługi w reviewPayment - rozstrzyga tylko pierwsza
+			res := tx.Model(&FraudAssessment{}).Where("id = ? AND review_status = ?", assessment.ID, ReviewPending).
+				Updates(map[string]interface{}{"review_status": ReviewExpired, "reviewed_by": "fraud", "reviewed_at": time.Now()})
+			if res.Error != nil || res.RowsAffected == 0 {
+				return res.Error
+			}
+			if err := updatePaymentStatus(tx, &record, PaymentVoided, "fraud review timed out"); err != nil {
+				return err
+			}
+			voided = true
+			if record.OrderID == nil {
+				return nil
+			}
+			var order Order
+			if err := tx.First(&order, *record.OrderID).Error; err != nil {
+				return err
+			}
+			if order.Status != OrderPending {
+				return nil
+			}
+			ev, err := transitionOrder(tx, &order, OrderCancelled, "fraud", "fraud review timed out")
+			if err != nil {
+				return err
+			}
+			event = &ev
+			return nil
+		})
+		if err != nil {
+			return expired, fmt.Errorf("payment %d: %w", *assessment.PaymentID, err)
+		}
+		if !voided {
+			continue
+		}
+		gateway, err := gateways.Lookup(record.Gateway)
+		if err == nil {
+			err = gateway.Void(context.Background(), record.GatewayReference)
+		}
+		if err != nil {
+			log.Printf("fraud: could not void authorization %s: %v", record.GatewayReference, err)
+		}
+		if event != nil {
+			orderEvents.Publish(*event)
+		}
+		expired++
+	}
+	return expired, nil
+}
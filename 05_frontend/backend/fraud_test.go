@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// paymentInReview zapisuje autoryzowaną płatność za koszyk po checkoucie, czekającą na przegląd od reviewedSince
+func paymentInReview(t *testing.T, db *gorm.DB, gateway *FakeGateway, cart *Cart, reviewedSince time.Time) (*Payment, *FraudAssessment) {
+	t.Helper()
+	record, totals := authorizedCardPayment(t, db, gateway, cart)
+	order, err := CheckoutCart(db, cart, totals, "test")
+	require.NoError(t, err)
+	require.NoError(t, db.Model(record).Updates(map[string]interface{}{"status": PaymentInReview, "order_id": order.ID}).Error)
+	assessment := &FraudAssessment{PaymentID: &record.ID, CartID: cart.ID, Amount: totals.Total, Score: 60,
+		Decision: FraudReview, ReviewStatus: ReviewPending, CreatedAt: reviewedSince}
+	require.NoError(t, db.Create(assessment).Error)
+	return record, assessment
+}
+
+func TestExpireFraudReviewsVoidsUnreviewedPayments(t *testing.T) {
+	e, db, gateway := newPaymentTestServer(t)
+	e.POST("/fraud/reviews/:id/approve", reviewPayment(true), AdminOnly)
+	overdueCart, product := newTestCart(t, db, 5, 2)
+	overdue, overdueReview := paymentInReview(t, db, gateway, overdueCart, time.Now().Add(-fraudReviewTimeout-time.Minute))
+	currentCart, _ := newTestCart(t, db, 5, 1)
+	current, _ := paymentInReview(t, db, gateway, currentCart, time.Now())
+
+	available, err := AvailableStock(db, *product)
+	require.NoError(t, err)
+	require.Equal(t, 3, *available)
+
+	n, err := ExpireFraudReviews(db, Gateways{gateway})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	require.NoError(t, db.First(overdue, overdue.ID).Error)
+	assert.Equal(t, PaymentVoided, overdue.Status)
+	assert.Equal(t, "fraud review timed out", overdue.ErrorReason)
+	assert.ErrorIs(t, gateway.Capture(context.Background(), overdue.GatewayReference, overdue.Amount), ErrInvalidGatewayState)
+	require.NoError(t, db.First(overdueReview, overdueReview.ID).Error)
+	assert.Equal(t, ReviewExpired, overdueReview.ReviewStatus)
+
+	// zamówienie anulowane, rezerwacje zwolnione, a koszyk znów można opłacić
+	var order Order
+	require.NoError(t, db.First(&order, *overdue.OrderID).Error)
+	assert.Equal(t, OrderCancelled, order.Status)
+	require.NoError(t, db.First(overdueCart, overdueCart.ID).Error)
+	assert.Equal(t, CartOpen, overdueCart.Status)
+	available, err = AvailableStock(db, *product)
+	require.NoError(t, err)
+	assert.Equal(t, 5, *available)
+
+	// spóźniona decyzja obsługi niczego już nie pobiera
+	rec := doRequest(e, http.MethodPost, fmt.Sprintf("/fraud/reviews/%d/approve", overdueReview.ID), `{}`,
+		adminTokenHeader, testAdminToken)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	require.NoError(t, db.First(current, current.ID).Error)
+	assert.Equal(t, PaymentInReview, current.Status)
+
+	n, err = ExpireFraudReviews(db, Gateways{gateway})
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestDevFingerprintKeyOnlyForLocalShop(t *testing.T) {
+	key, shopURL := fraudFingerprintKey, publicURL
+	t.Cleanup(func() { fraudFingerprintKey, publicURL = key, shopURL })
+
+	fraudFingerprintKey = devFingerprintKey
+	publicURL = "http://localhost:1323"
+	assert.NoError(t, checkFingerprintKey())
+
+	publicURL = "https://sklep.example.com"
+	assert.Error(t, checkFingerprintKey())
+	fraudFingerprintKey = "klucz-produkcyjny"
+	assert.NoError(t, checkFingerprintKey())
+}
+
+func TestFraudAssessmentHidesCardFingerprint(t *testing.T) {
+	assessment := FraudAssessment{CardFingerprint: cardFingerprint("4242424242424242"), Decision: FraudReview}
+	data, err := json.Marshal(assessment)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), assessment.CardFingerprint)
+	assert.NotContains(t, string(data), "card_fingerprint")
+}
+
+func TestRejectedReviewCancelsOrderAndReleasesStock(t *testing.T) {
+	e, db, gateway := newPaymentTestServer(t)
+	e.POST("/fraud/reviews/:id/reject", reviewPayment(false), AdminOnly)
+	cart, product := newTestCart(t, db, 5, 2)
+	record, review := paymentInReview(t, db, gateway, cart, time.Now())
+	target := fmt.Sprintf("/fraud/reviews/%d/reject", review.ID)
+
+	rec := doRequest(e, http.MethodPost, target, `{}`)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	require.NoError(t, db.First(review, review.ID).Error)
+	assert.Equal(t, ReviewPending, review.ReviewStatus)
+
+	rec = doRequest(e, http.MethodPost, target, `{"note":"karta z listy skradzionych"}`, adminTokenHeader, testAdminToken)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, db.First(record, record.ID).Error)
+	assert.Equal(t, PaymentVoided, record.Status)
+	assert.ErrorIs(t, gateway.Capture(context.Background(), record.GatewayReference, record.Amount), ErrInvalidGatewayState)
+	require.NoError(t, db.First(review, review.ID).Error)
+	assert.Equal(t, ReviewRejected, review.ReviewStatus)
+	assert.Equal(t, "magazyn", review.ReviewedBy)
+
+	var order Order
+	require.NoError(t, db.First(&order, *record.OrderID).Error)
+	assert.Equal(t, OrderCancelled, order.Status)
+	require.NoError(t, db.First(cart, cart.ID).Error)
+	assert.Equal(t, CartOpen, cart.Status)
+	available, err := AvailableStock(db, *product)
+	require.NoError(t, err)
+	assert.Equal(t, 5, *available)
+
+	rec = doRequest(e, http.MethodPost, target, `{}`, adminTokenHeader, testAdminToken)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+}
+
+func TestFraudEndpointsRequireAdmin(t *testing.T) {
+	e, db, gateway := newPaymentTestServer(t)
+	e.GET("/fraud/assessments", getFraudAssessments, AdminOnly)
+	e.POST("/fraud/reviews/:id/approve", reviewPayment(true), AdminOnly)
+	cart, _ := newTestCart(t, db, 5, 1)
+	record, review := paymentInReview(t, db, gateway, cart, time.Now())
+
+	assert.Equal(t, http.StatusForbidden, doRequest(e, http.MethodGet, "/fraud/assessments", "").Code)
+	rec := doRequest(e, http.MethodPost, fmt.Sprintf("/fraud/reviews/%d/approve", review.ID), `{}`, "X-Actor", "magazyn")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	require.NoError(t, db.First(record, record.ID).Error)
+	assert.Equal(t, PaymentInReview, record.Status)
+
+	rec = doRequest(e, http.MethodGet, "/fraud/assessments", "", adminTokenHeader, testAdminToken)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var assessments []FraudAssessment
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &assessments))
+	assert.Len(t, assessments, 1)
+}
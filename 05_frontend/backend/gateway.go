@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// Bramka płatności: tokenizacja zamienia dane karty na token, autoryzacja blokuje środki, capture je pobiera, void zwalnia
+// nieobciążoną autoryzację, refund zwraca (część) pobranej kwoty.
+// Implementację wybiera zmienna PAYMENT_GATEWAY przy starcie serwera.
+
+var (
+	ErrPaymentDeclined      = errors.New("payment declined")
+	ErrInsufficientFunds    = errors.New("insufficient funds")
+	ErrGatewayTimeout       = errors.New("payment gateway timeout")
+	ErrUnknownAuthorization = errors.New("unknown authorization")
+	ErrUnknownCardToken     = errors.New("unknown card token")
+	ErrInvalidGatewayState  = errors.New("operation not allowed in current authorization state")
+	ErrGatewayNotConfigured = errors.New("payment gateway not configured")
+)
+
+var (
+	paymentGatewayName    = envString("PAYMENT_GATEWAY", "fake")
+	paymentGatewayTimeout = envDuration("PAYMENT_GATEWAY_TIMEOUT", 10*time.Second)
+	fakeGatewayDBPath     = envString("FAKE_GATEWAY_DB", "fakegateway.db")
+)
+
+type AuthorizeRequest struct {
+	CardToken string
+	Amount    Money
+	// Reference pozwala powiązać operację w bramce z koszykiem/zamówieniem
+	Reference string
+}
+
+type Authorization struct {
+	Reference string
+	Amount    Money
+	// ChallengeURL jest ustawiony, gdy bank wymaga uwierzytelnienia klienta (3-D Secure);
+	// autoryzację można pobrać dopiero po przejściu tej strony przez klienta
+	ChallengeURL string
+}
+
+type PaymentGateway interface {
+	Name() string
+	Tokenize(ctx context.Context, card CardDetails) (string, error)
+	Authorize(ctx context.Context, req AuthorizeRequest) (*Authorization, error)
+	Capture(ctx context.Context, reference string, amount Money) error
+	Void(ctx context.Context, reference string) error
+	Refund(ctx context.Context, reference string, amount Money) (string, error)
+}
+
+var paymentGateways = map[string]func() (PaymentGateway, error){
+	"fake": func() (PaymentGateway, error) {
+		g, err := OpenFakeGateway(fakeGatewayDBPath)
+		if err != nil {
+			return nil, err
+		}
+		return g, nil
+	},
+	"hosted": func() (PaymentGateway, error) { return NewHostedGateway(hostedProviderURL, hostedProviderKey), nil },
+}
+
+// Gateways to bramki skonfigurowane w procesie; pierwsza jest domyślna.
+// Operacje na istniejącej płatności (zwrot, anulowanie) trafiają do bramki, która ją obsłużyła.
+type Gateways []PaymentGateway
+
+func (gs Gateways) Default() PaymentGateway {
+	return gs[0]
+}
+
+// ByName zwraca bramkę o podanej nazwie; false oznacza, że płatność obsłużyła bramka,
+// której ten proces nie ma skonfigurowanej (np. po zmianie PAYMENT_GATEWAY)
+func (gs Gateways) ByName(name string) (PaymentGateway, bool) {
+	for _, g := range gs {
+		if g.Name() == name {
+			return g, true
+		}
+	}
+	return nil, false
+}
+
+// Lookup działa jak ByName, ale brak bramki zwraca jako ErrGatewayNotConfigured
+func (gs Gateways) Lookup(name string) (PaymentGateway, error) {
+	if g, ok := gs.ByName(name); ok {
+		return g, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrGatewayNotConfigured, name)
+}
+
+// NewPaymentGateway tworzy bramkę o podanej nazwie
+func NewPaymentGateway(name string) (PaymentGateway, error) {
+	factory, ok := paymentGateways[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown payment gateway %q", name)
+	}
+	return factory()
+}
+
+// Magiczne numery kart sterujące zachowaniem fałszywej bramki; każdy inny numer jest akceptowany
+const (
+	FakeCardDeclined          = "4000000000000002"
+	FakeCardInsufficientFunds = "4000000000009995"
+	FakeCardTimeout           = "4000000000000119"
+	FakeCard3DSRequired       = "4000000000003220"
+)
+
+const (
+	fakeAuthorized = "authorized"
+	fakeCaptured   = "captured"
+	fakeVoided     = "voided"
+	fakeAwaiting   = "awaiting"
+	fakeChallenge  = "challenge"
+)
+
+// FakeGatewayToken i FakeGatewayAuthorization to stan fałszywej bramki zapisany w bazie,
+// żeby zapisane karty i zwroty działały także po restarcie serwera
+type FakeGatewayToken struct {
+	Token string `gorm:"primaryKey"`
+	// numer jest zapamiętywany tylko dla magicznych kart sterujących bramką
+	Number    string
+	CreatedAt time.Time
+}
+
+type FakeGatewayAuthorization struct {
+	Reference string `gorm:"primaryKey"`
+	Amount    Money  `gorm:"embedded;embeddedPrefix:amount_"`
+	State     string
+	Refunded  int64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// FakeGateway odpowiada deterministycznie, dzięki czemu testy i frontend mogą wywołać
+// każdą ścieżkę błędu. Tokeny i autoryzacje trzyma we własnej bazie (FAKE_GATEWAY_DB).
+type FakeGateway struct {
+	mu sync.Mutex
+	db *gorm.DB
+}
+
+// NewFakeGateway używa db z tabelami FakeGatewayToken i FakeGatewayAuthorization
+func NewFakeGateway(db *gorm.DB) *FakeGateway {
+	return &FakeGateway{db: db}
+}
+
+// OpenFakeGateway otwiera bazę stanu bramki i zakłada jej tabele. To osobny plik, bo bramka
+// udaje zewnętrzny system, którego stan nie jest wycofywany razem z transakcjami sklepu.
+func OpenFakeGateway(path string) (*FakeGateway, error) {
+	db, err := gorm.Open(sqlite.Open(path+"?_pragma=busy_timeout(5000)"), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(&FakeGatewayToken{}, &FakeGatewayAuthorization{}); err != nil {
+		return nil, err
+	}
+	return NewFakeGateway(db), nil
+}
+
+func (g *FakeGateway) Name() string { return "fake" }
+
+func (g *FakeGateway) Tokenize(ctx context.Context, card CardDetails) (string, error) {
+	token := FakeGatewayToken{Token: "tok_" + randomHex(12)}
+	switch card.Number {
+	case FakeCardDeclined, FakeCardInsufficientFunds, FakeCardTimeout, FakeCard3DSRequired:
+		token.Number = card.Number
+	}
+	if err := g.db.Create(&token).Error; err != nil {
+		return "", err
+	}
+	return token.Token, nil
+}
+
+// authorization wczytuje autoryzację; wywołujący trzyma g.mu aż do zapisania zmian
+func (g *FakeGateway) authorization(reference string) (*FakeGatewayAuthorization, error) {
+	var auth FakeGatewayAuthorization
+	err := g.db.Where("reference = ?", reference).Take(&auth).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUnknownAuthorization
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &auth, nil
+}
+
+func (g *FakeGateway) Authorize(ctx context.Context, req AuthorizeRequest) (*Authorization, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ErrGatewayTimeout
+	}
+	var token FakeGatewayToken
+	err := g.db.Where("token = ?", req.CardToken).Take(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUnknownCardToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch token.Number {
+	case FakeCardDeclined:
+		return nil, ErrPaymentDeclined
+	case FakeCardInsufficientFunds:
+		return nil, ErrInsufficientFunds
+	case FakeCardTimeout:
+		return nil, ErrGatewayTimeout
+	}
+
+	auth := FakeGatewayAuthorization{Reference: "fake_auth_" + randomHex(12), Amount: req.Amount, State: fakeAuthorized}
+	if token.Number == FakeCard3DSRequired {
+		auth.State = fakeChallenge
+	}
+	if err := g.db.Create(&auth).Error; err != nil {
+		return nil, err
+	}
+	if auth.State == fakeChallenge {
+		return &Authorization{Reference: auth.Reference, Amount: req.Amount, ChallengeURL: publicURL + "/simulator/3ds/" + auth.Reference}, nil
+	}
+	return &Authorization{Reference: auth.Reference, Amount: req.Amount}, nil
+}
+
+func (g *FakeGateway) Capture(ctx context.Context, reference string, amount Money) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	auth, err := g.authorization(reference)
+	if err != nil {
+		return err
+	}
+	if auth.State != fakeAuthorized || amount.Currency != auth.Amount.Currency || amount.Amount > auth.Amount.Amount {
+		return ErrInvalidGatewayState
+	}
+	auth.Amount = amount
+	auth.State = fakeCaptured
+	return g.db.Save(auth).Error
+}
+
+func (g *FakeGateway) Void(ctx context.Context, reference string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	auth, err := g.authorization(reference)
+	if err != nil {
+		return err
+	}
+	if auth.State != fakeAuthorized && auth.State != fakeAwaiting && auth.State != fakeChallenge {
+		return ErrInvalidGatewayState
+	}
+	auth.State = fakeVoided
+	return g.db.Save(auth).Error
+}
+
+func (g *FakeGateway) Refund(ctx context.Context, reference string, amount Money) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	auth, err := g.authorization(reference)
+	if err != nil {
+		return "", err
+	}
+	if auth.State != fakeCaptured || amount.Currency != auth.Amount.Currency ||
+		amount.Amount <= 0 || auth.Refunded+amount.Amount > auth.Amount.Amount {
+		return "", ErrInvalidGatewayState
+	}
+	auth.Refunded += amount.Amount
+	if err := g.db.Save(auth).Error; err != nil {
+		return "", err
+	}
+	return "fake_refund_" + randomHex(12), nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeGatewayStateSurvivesRestart(t *testing.T) {
+	db := newTestDB(t, &FakeGatewayToken{}, &FakeGatewayAuthorization{})
+	ctx := context.Background()
+	amount := NewMoney(5000, "PLN")
+
+	before := NewFakeGateway(db)
+	saved, err := before.Tokenize(ctx, CardDetails{Number: "4242424242424242", ExpMonth: 12, ExpYear: 2030, CVC: "123"})
+	require.NoError(t, err)
+	declined, err := before.Tokenize(ctx, CardDetails{Number: FakeCardDeclined, ExpMonth: 12, ExpYear: 2030, CVC: "123"})
+	require.NoError(t, err)
+	auth, err := before.Authorize(ctx, AuthorizeRequest{CardToken: saved, Amount: amount})
+	require.NoError(t, err)
+	require.NoError(t, before.Capture(ctx, auth.Reference, amount))
+
+	var token FakeGatewayToken
+	require.NoError(t, db.Where("token = ?", saved).Take(&token).Error)
+	assert.Empty(t, token.Number, "zwykłe numery kart nie są zapisywane")
+
+	// nowa instancja widzi tokeny i autoryzacje sprzed restartu
+	after := NewFakeGateway(db)
+	_, err = after.Refund(ctx, auth.Reference, NewMoney(2000, "PLN"))
+	require.NoError(t, err)
+	_, err = after.Refund(ctx, auth.Reference, NewMoney(3001, "PLN"))
+	assert.ErrorIs(t, err, ErrInvalidGatewayState)
+	_, err = after.Authorize(ctx, AuthorizeRequest{CardToken: saved, Amount: amount})
+	assert.NoError(t, err)
+	_, err = after.Authorize(ctx, AuthorizeRequest{CardToken: declined, Amount: amount})
+	assert.ErrorIs(t, err, ErrPaymentDeclined)
+
+	require.NoError(t, after.DeleteToken(ctx, saved))
+	_, err = after.Authorize(ctx, AuthorizeRequest{CardToken: saved, Amount: amount})
+	assert.ErrorIs(t, err, ErrUnknownCardToken)
+	_, err = after.Refund(ctx, "fake_auth_missing", amount)
+	assert.ErrorIs(t, err, ErrUnknownAuthorization)
+}
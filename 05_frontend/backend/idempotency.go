@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Klucze idempotencji (nagłówek Idempotency-Key): pierwsza odpowiedź dla klucza
+// jest zapisywana i odtwarzana przy powtórzeniach, np. po podwójnym kliknięciu
+// lub ponowieniu żądania po zerwanym połączeniu. Klucze są osobne dla każdego klienta
+// (token z CustomerMiddleware), żądania anonimowe dzielą jedną przestrzeń kluczy.
+
+const (
+	HeaderIdempotencyKey     = "Idempotency-Key"
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	idempotencyProcessing    = "processing"
+	idempotencyCompleted     = "completed"
+	idempotencyAnonymous     = "anonymous"
+)
+
+var idempotencyKeyTTL = envDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour)
+
+type IdempotencyKey struct {
+	ID                  uint   `gorm:"primaryKey"`
+	Scope               string `gorm:"uniqueIndex:idx_idempotency_scope_key;default:anonymous"`
+	Key                 string `gorm:"uniqueIndex:idx_idempotency_scope_key"`
+	RequestHash         string
+	Status              string
+	ResponseStatus      int
+	ResponseBody        []byte
+	ResponseContentType string
+	ExpiresAt           time.Time `gorm:"index"`
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+}
+
+// Idempotency zapisuje odpowiedź dla klucza; klucz użyty z innym żądaniem
+// (inna metoda, ścieżka, query string lub treść) albo wciąż przetwarzany kończy się 409.
+// Odpowiedzi 5xx i panika handlera zwalniają klucz, więc takie żądanie można ponowić.
+// Musi działać po CustomerMiddleware, bo zakres klucza zależy od klienta.
+func Idempotency(db *gorm.DB) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(HeaderIdempotencyKey)
+			if key == "" {
+				return next(c)
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				return echo.NewHTTPError(http.StatusBadRequest, "Idempotency-Key is too long")
+			}
+
+			body, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Could not read request body")
+			}
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+			hash := requestFingerprint(c.Request().Method, c.Request().URL.Path, c.Request().URL.RawQuery, body)
+			scope := idempotencyScope(c)
+
+			record, err := claimIdempotencyKey(db, scope, key, hash)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not store idempotency key")
+			}
+			if record != nil {
+				switch {
+				case record.RequestHash != hash:
+					return echo.NewHTTPError(http.StatusConflict, "Idempotency-Key was already used with a different request")
+				case record.Status != idempotencyCompleted:
+					return echo.NewHTTPError(http.StatusConflict, "A request with this Idempotency-Key is still in progress")
+				}
+				c.Response().Header().Set(HeaderIdempotentReplayed, "true")
+				return c.Blob(record.ResponseStatus, record.ResponseContentType, record.ResponseBody)
+			}
+
+			owned := func() *gorm.DB {
+				return db.Model(&IdempotencyKey{}).Where("scope = ? AND key = ?", scope, key)
+			}
+			// bez tego klucz zostałby "processing" do wygaśnięcia, a każde ponowienie dostawałoby 409
+			defer func() {
+				if r := recover(); r != nil {
+					if err := owned().Delete(&IdempotencyKey{}).Error; err != nil {
+						log.Printf("idempotency: could not release key %q after panic: %v", key, err)
+					}
+					panic(r)
+				}
+			}()
+
+			buf := new(bytes.Buffer)
+			c.Response().Writer = &captureResponseWriter{ResponseWriter: c.Response().Writer, body: buf}
+			if err := next(c); err != nil {
+				c.Error(err)
+			}
+
+			res := c.Response()
+			if res.Status >= http.StatusInternalServerError {
+				err = owned().Delete(&IdempotencyKey{}).Error
+			} else {
+				err = owned().Updates(map[string]interface{}{
+					"status":                idempotencyCompleted,
+					"response_status":       res.Status,
+					"response_body":         buf.Bytes(),
+					"response_content_type": res.Header().Get(echo.HeaderContentType),
+				}).Error
+			}
+			if err != nil {
+				log.Printf("idempotency: could not save response for key %q: %v", key, err)
+			}
+			return nil
+		}
+	}
+}
+
+// claimIdempotencyKey rezerwuje klucz dla bieżącego żądania; zwraca istniejący
+// rekord, jeśli klucz był już użyty i nie wygasł (nil oznacza, że klucz jest nasz).
+func claimIdempotencyKey(db *gorm.DB, scope, key, hash string) (*IdempotencyKey, error) {
+	var existing *IdempotencyKey
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now().UTC()
+		// wygasłe klucze sprzątamy przy okazji, po indeksie na expires_at
+		if err := tx.Where("expires_at <= ?", now).Delete(&IdempotencyKey{}).Error; err != nil {
+			return err
+		}
+		var record IdempotencyKey
+		err := tx.Where("scope = ? AND key = ?", scope, key).Take(&record).Error
+		if err == nil {
+			existing = &record
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		return tx.Create(&IdempotencyKey{
+			Scope:       scope,
+			Key:         key,
+			RequestHash: hash,
+			Status:      idempotencyProcessing,
+			ExpiresAt:   now.Add(idempotencyKeyTTL),
+		}).Error
+	})
+	return existing, err
+}
+
+// idempotencyScope oddziela klucze klientów, żeby jeden nie mógł odtworzyć ani zablokować
+// odpowiedzi drugiego tym samym kluczem
+func idempotencyScope(c echo.Context) string {
+	if customer := currentCustomer(c); customer != nil {
+		return fmt.Sprintf("customer:%d", customer.ID)
+	}
+	return idempotencyAnonymous
+}
+
+// MigrateIdempotencyKeys usuwa dawny unikalny indeks na samym kluczu; klucze są teraz
+// unikalne w obrębie zakresu (scope, key)
+func MigrateIdempotencyKeys(db *gorm.DB) error {
+	if !db.Migrator().HasIndex(&IdempotencyKey{}, "idx_idempotency_keys_key") {
+		return nil
+	}
+	return db.Migrator().DropIndex(&IdempotencyKey{}, "idx_idempotency_keys_key")
+}
+
+func requestFingerprint(method, path, rawQuery string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "?" + rawQuery + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// captureResponseWriter kopiuje treść odpowiedzi, żeby można ją było zapisać
+type captureResponseWriter struct {
+	http.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w *captureResponseWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
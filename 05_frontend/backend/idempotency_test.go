@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// newIdempotencyServer zwraca serwer z handlerami liczącymi wywołania:
+// /echo odpowiada treścią żądania, /panic i /fail zawodzą przy pierwszym wywołaniu
+func newIdempotencyServer(t *testing.T) (*echo.Echo, *gorm.DB, *int) {
+	db := newTestDB(t, &IdempotencyKey{}, &Customer{})
+	e := echo.New()
+	e.Use(middleware.Recover())
+	e.Use(CustomerMiddleware(db))
+	calls := 0
+	idempotent := Idempotency(db)
+	e.POST("/echo", func(c echo.Context) error {
+		calls++
+		body, _ := io.ReadAll(c.Request().Body)
+		return c.JSON(http.StatusCreated, map[string]interface{}{"call": calls, "body": string(body)})
+	}, idempotent)
+	e.POST("/panic", func(c echo.Context) error {
+		calls++
+		if calls == 1 {
+			panic("handler failed")
+		}
+		return c.JSON(http.StatusCreated, map[string]int{"call": calls})
+	}, idempotent)
+	e.POST("/fail", func(c echo.Context) error {
+		calls++
+		if calls == 1 {
+			return echo.NewHTTPError(http.StatusInternalServerError, "temporary failure")
+		}
+		return c.JSON(http.StatusCreated, map[string]int{"call": calls})
+	}, idempotent)
+	return e, db, &calls
+}
+
+func TestIdempotencyReplaysResponse(t *testing.T) {
+	e, _, calls := newIdempotencyServer(t)
+
+	first := doRequest(e, http.MethodPost, "/echo", `{"cart_id":1}`, HeaderIdempotencyKey, "key-1")
+	require.Equal(t, http.StatusCreated, first.Code)
+	assert.Empty(t, first.Header().Get(HeaderIdempotentReplayed))
+
+	second := doRequest(e, http.MethodPost, "/echo", `{"cart_id":1}`, HeaderIdempotencyKey, "key-1")
+	assert.Equal(t, http.StatusCreated, second.Code)
+	assert.Equal(t, "true", second.Header().Get(HeaderIdempotentReplayed))
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, 1, *calls)
+
+	// bez klucza każde żądanie trafia do handlera
+	doRequest(e, http.MethodPost, "/echo", `{"cart_id":1}`)
+	assert.Equal(t, 2, *calls)
+}
+
+func TestIdempotencyRejectsDifferentRequest(t *testing.T) {
+	e, _, calls := newIdempotencyServer(t)
+
+	require.Equal(t, http.StatusCreated, doRequest(e, http.MethodPost, "/echo?dry_run=false", `{"cart_id":1}`, HeaderIdempotencyKey, "key-1").Code)
+
+	rec := doRequest(e, http.MethodPost, "/echo?dry_run=false", `{"cart_id":2}`, HeaderIdempotencyKey, "key-1")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), "different request")
+
+	rec = doRequest(e, http.MethodPost, "/echo?dry_run=true", `{"cart_id":1}`, HeaderIdempotencyKey, "key-1")
+	assert.Equal(t, http.StatusConflict, rec.Code, "query string is part of the request fingerprint")
+	assert.Equal(t, 1, *calls)
+}
+
+func TestIdempotencyRejectsKeyInProgress(t *testing.T) {
+	e, db, calls := newIdempotencyServer(t)
+	body := `{"cart_id":1}`
+	existing, err := claimIdempotencyKey(db, idempotencyAnonymous, "key-1", requestFingerprint(http.MethodPost, "/echo", "", []byte(body)))
+	require.NoError(t, err)
+	require.Nil(t, existing)
+
+	rec := doRequest(e, http.MethodPost, "/echo", body, HeaderIdempotencyKey, "key-1")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), "still in progress")
+	assert.Equal(t, 0, *calls)
+}
+
+func TestIdempotencyReleasesKeyAfterPanic(t *testing.T) {
+	e, db, calls := newIdempotencyServer(t)
+
+	rec := doRequest(e, http.MethodPost, "/panic", `{}`, HeaderIdempotencyKey, "key-1")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	var count int64
+	db.Model(&IdempotencyKey{}).Count(&count)
+	assert.Zero(t, count)
+
+	rec = doRequest(e, http.MethodPost, "/panic", `{}`, HeaderIdempotencyKey, "key-1")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, 2, *calls)
+}
+
+func TestIdempotencyDoesNotStoreServerErrors(t *testing.T) {
+	e, _, calls := newIdempotencyServer(t)
+
+	assert.Equal(t, http.StatusInternalServerError, doRequest(e, http.MethodPost, "/fail", `{}`, HeaderIdempotencyKey, "key-1").Code)
+	rec := doRequest(e, http.MethodPost, "/fail", `{}`, HeaderIdempotencyKey, "key-1")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Empty(t, rec.Header().Get(HeaderIdempotentReplayed))
+	assert.Equal(t, 2, *calls)
+}
+
+func TestIdempotencyKeysAreScopedPerCustomer(t *testing.T) {
+	e, db, calls := newIdempotencyServer(t)
+	for i, token := range []string{"token-a", "token-b"} {
+		require.NoError(t, db.Create(&Customer{Email: fmt.Sprintf("c%d@example.com", i), TokenHash: hashCustomerToken(token)}).Error)
+	}
+
+	body := `{"cart_id":1}`
+	a := doRequest(e, http.MethodPost, "/echo", body, HeaderIdempotencyKey, "shared", echo.HeaderAuthorization, "Bearer token-a")
+	b := doRequest(e, http.MethodPost, "/echo", body, HeaderIdempotencyKey, "shared", echo.HeaderAuthorization, "Bearer token-b")
+	anon := doRequest(e, http.MethodPost, "/echo", body, HeaderIdempotencyKey, "shared")
+	for _, rec := range []int{a.Code, b.Code, anon.Code} {
+		assert.Equal(t, http.StatusCreated, rec)
+	}
+	assert.Empty(t, b.Header().Get(HeaderIdempotentReplayed))
+	assert.Empty(t, anon.Header().Get(HeaderIdempotentReplayed))
+	assert.Equal(t, 3, *calls)
+
+	again := doRequest(e, http.MethodPost, "/echo", body, HeaderIdempotencyKey, "shared", echo.HeaderAuthorization, "Bearer token-a")
+	assert.Equal(t, "true", again.Header().Get(HeaderIdempotentReplayed))
+	assert.Equal(t, a.Body.String(), again.Body.String())
+}
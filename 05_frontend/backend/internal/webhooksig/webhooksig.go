@@ -0,0 +1,75 @@
+// Package webhooksig podpisuje i weryfikuje webhooki bramki płatności.
+// Podpis w nagłówku Webhook-Signature ma postać "t=<unix>,v1=<hex>",
+// gdzie v1 = HMAC-SHA256(secret, "<t>.<body>"). Nagłówek może zawierać kilka
+// wartości v1 (np. podczas wymiany sekretu) - wystarczy zgodność jednej z nich.
+// Z pakietu korzysta serwer oraz narzędzia cmd/webhook-signer i cmd/fakeprovider.
+package webhooksig
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const Header = "Webhook-Signature"
+
+var (
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrStale            = errors.New("webhook timestamp outside tolerance")
+)
+
+// Sign zwraca wartość nagłówka Webhook-Signature dla treści i chwili t
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + mac(secret, ts, body)
+}
+
+func mac(secret, ts string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts + "."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify sprawdza podpis i czy znacznik czasu mieści się w tolerancji względem now
+func Verify(secret, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	var ts string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			signatures = append(signatures, v)
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidSignature
+	}
+	// najpierw podpis: bez znajomości sekretu nie da się wywołać innego błędu niż ErrInvalidSignature
+	if !validSignature(mac(secret, ts, body), signatures) {
+		return ErrInvalidSignature
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > tolerance || d < -tolerance {
+		return ErrStale
+	}
+	return nil
+}
+
+func validSignature(expected string, signatures []string) bool {
+	for _, sig := range signatures {
+		if hmac.Equal([]byte(sig), []byte(expected)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package webhooksig
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSecret = "whsec_test"
+
+var testNow = time.Date(2026, time.October, 16, 12, 0, 0, 0, time.UTC)
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	body := []byte(`{"id":"evt_1","type":"payment.succeeded"}`)
+	header := Sign(testSecret, testNow, body)
+	assert.NoError(t, Verify(testSecret, header, body, testNow, 5*time.Minute))
+}
+
+func TestVerifyTolerance(t *testing.T) {
+	body := []byte(`{}`)
+	cases := []struct {
+		signedAt time.Time
+		want     error
+	}{
+		{testNow.Add(-5 * time.Minute), nil},
+		{testNow.Add(5 * time.Minute), nil}, // niewielka różnica zegarów u nadawcy
+		{testNow.Add(-5*time.Minute - time.Second), ErrStale},
+		{testNow.Add(5*time.Minute + time.Second), ErrStale},
+	}
+	for _, tc := range cases {
+		header := Sign(testSecret, tc.signedAt, body)
+		assert.Equal(t, tc.want, Verify(testSecret, header, body, testNow, 5*time.Minute), "signed at %v", tc.signedAt.Sub(testNow))
+	}
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	body := []byte(`{"id":"evt_1","data":{"payment_id":1}}`)
+	header := Sign(testSecret, testNow, body)
+
+	tampered := []byte(`{"id":"evt_1","data":{"payment_id":2}}`)
+	assert.ErrorIs(t, Verify(testSecret, header, tampered, testNow, time.Minute), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("whsec_other", header, body, testNow, time.Minute), ErrInvalidSignature)
+	// podmiana znacznika czasu unieważnia podpis, bo t jest częścią podpisywanej treści
+	forged := "t=" + strconv.FormatInt(testNow.Add(time.Second).Unix(), 10) + header[len("t=")+len(strconv.FormatInt(testNow.Unix(), 10)):]
+	assert.ErrorIs(t, Verify(testSecret, forged, body, testNow, time.Minute), ErrInvalidSignature)
+}
+
+func TestVerifyChecksSignatureBeforeTimestamp(t *testing.T) {
+	body := []byte(`{}`)
+	stale := testNow.Add(-time.Hour)
+	// nieaktualny znacznik z błędnym podpisem to wciąż błędny podpis, a nie ErrStale
+	assert.ErrorIs(t, Verify(testSecret, Sign("whsec_other", stale, body), body, testNow, time.Minute), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify(testSecret, Sign(testSecret, stale, body), body, testNow, time.Minute), ErrStale)
+}
+
+func TestVerifyMalformedHeader(t *testing.T) {
+	body := []byte(`{}`)
+	for _, header := range []string{"", "v1=abc", "t=abc,v1=abc", "t=" + strconv.FormatInt(testNow.Unix(), 10)} {
+		assert.ErrorIs(t, Verify(testSecret, header, body, testNow, time.Minute), ErrInvalidSignature, header)
+	}
+}
+
+func TestVerifyAcceptsAnyOfSeveralSignatures(t *testing.T) {
+	body := []byte(`{}`)
+	// podczas wymiany sekretu nadawca podpisuje starym i nowym kluczem
+	header := Sign("whsec_old", testNow, body) + ",v1=" + mac(testSecret, strconv.FormatInt(testNow.Unix(), 10), body)
+	assert.NoError(t, Verify(testSecret, header, body, testNow, time.Minute))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Stany magazynowe i rezerwacje.
+// Product.Stock == nil oznacza produkt bez śledzenia stanu (dostępny bez limitu).
+// Dostępna ilość = stock - suma aktywnych, niewygasłych rezerwacji.
+// Czasy zapisujemy w strefie serwera (time.Now()), tak jak terminy płatności - sweepery porównują je między tabelami.
+
+const (
+	ReservationActive    = "active"
+	ReservationReleased  = "released"
+	ReservationCommitted = "committed"
+	ReservationExpired   = "expired"
+)
+
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+var reservationTTL = envDuration("RESERVATION_TTL", 15*time.Minute)
+
+type Reservation struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CartID    uint      `gorm:"uniqueIndex:idx_active_reservation,where:status = 'active'" json:"cart_id"`
+	ProductID uint      `gorm:"uniqueIndex:idx_active_reservation,where:status = 'active'" json:"product_id"`
+	Quantity  int       `json:"quantity"`
+	Status    string    `gorm:"index" json:"status"`
+	ExpiresAt time.Time `gorm:"index" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Warunek dostępności dla produktu p z pominięciem rezerwacji bieżącego koszyka;
+// produkty w koszu są niedostępne. Parametry: now, cartID, qty.
+const stockAvailableCondition = `(p.deleted_at IS NULL AND (p.stock IS NULL OR p.stock - (
+	SELECT COALESCE(SUM(r.quantity), 0) FROM reservations r
+	WHERE r.product_id = p.id AND r.status = 'active' AND r.expires_at > ? AND r.cart_id <> ?
+) >= ?))`
+
+// ReserveStock ustawia rezerwację koszyka na produkt na qty sztuk i odnawia jej ważność.
+// Sprawdzenie dostępności i zapis są jednym warunkowym zapytaniem wewnątrz transakcji,
+// więc równoległe żądania nie mogą zarezerwować więcej niż jest na stanie.
+func ReserveStock(db *gorm.DB, cartID, productID uint, qty int) error {
+	return reserveStockUntil(db, cartID, productID, qty, time.Now().Add(reservationTTL))
+}
+
+// HoldReservations rezerwuje towar całego koszyka do until, np. na czas oczekiwania na przelew.
+// quantities: productID -> ilość.
+func HoldReservations(db *gorm.DB, cartID uint, quantities map[uint]int, until time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for productID, qty := range quantities {
+			if err := reserveStockUntil(tx, cartID, productID, qty, until); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func reserveStockUntil(db *gorm.DB, cartID, productID uint, qty int, expiresAt time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		var existing Reservation
+		err := tx.Where("cart_id = ? AND product_id = ? AND status = ?", cartID, productID, ReservationActive).
+			Take(&existing).Error
+
+		var res *gorm.DB
+		switch {
+		case err == nil:
+			res = tx.Exec(`UPDATE reservations SET quantity = ?, expires_at = ?, updated_at = ?
+				WHERE id = ? AND EXISTS (SELECT 1 FROM products p WHERE p.id = ? AND `+stockAvailableCondition+`)`,
+				qty, expiresAt, now, existing.ID, productID, now, cartID, qty)
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			res = tx.Exec(`INSERT INTO reservations (cart_id, product_id, quantity, status, expires_at, created_at, updated_at)
+				SELECT ?, p.id, ?, ?, ?, ?, ? FROM products p WHERE p.id = ? AND `+stockAvailableCondition,
+				cartID, qty, ReservationActive, expiresAt, now, now, productID, now, cartID, qty)
+		default:
+			return err
+		}
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInsufficientStock
+		}
+		return nil
+	})
+}
+
+func ReleaseReservation(db *gorm.DB, cartID, productID uint) error {
+	return db.Model(&Reservation{}).
+		Where("cart_id = ? AND product_id = ? AND status = ?", cartID, productID, ReservationActive).
+		Updates(map[string]interface{}{"status": ReservationReleased, "updated_at": time.Now()}).Error
+}
+
+// CommitReservations zamienia rezerwacje koszyka na trwałe zmniejszenie stanu.
+// quantities: productID -> ilość. Wygasłe rezerwacje są odnawiane, o ile towar nadal jest dostępny.
+func CommitReservations(db *gorm.DB, cartID uint, quantities map[uint]int) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		for productID, qty := range quantities {
+			if err := ReserveStock(tx, cartID, productID, qty); err != nil {
+				return err
+			}
+			if err := tx.Exec("UPDATE products SET stock = stock - ? WHERE id = ? AND stock IS NOT NULL",
+				qty, productID).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&Reservation{}).
+				Where("cart_id = ? AND product_id = ? AND status = ?", cartID, productID, ReservationActive).
+				Updates(map[string]interface{}{"status": ReservationCommitted, "updated_at": now}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AvailableStock zwraca nil dla produktów bez śledzenia stanu
+func AvailableStock(db *gorm.DB, p Product) (*int, error) {
+	if p.Stock == nil {
+		return nil, nil
+	}
+	var reserved int
+	err := db.Model(&Reservation{}).
+		Select("COALESCE(SUM(quantity), 0)").
+		Where("product_id = ? AND status = ? AND expires_at > ?", p.ID, ReservationActive, time.Now()).
+		Scan(&reserved).Error
+	if err != nil {
+		return nil, err
+	}
+	available := *p.Stock - reserved
+	return &available, nil
+}
+
+func ExpireReservations(db *gorm.DB) (int64, error) {
+	now := time.Now()
+	res := db.Model(&Reservation{}).
+		Where("status = ? AND expires_at <= ?", ReservationActive, now).
+		Updates(map[string]interface{}{"status": ReservationExpired, "updated_at": now})
+	return res.RowsAffected, res.Error
+}
+
+// StartReservationSweeper okresowo oznacza wygasłe rezerwacje; dostępność liczy się
+// i tak tylko z niewygasłych, więc sprzątanie służy jedynie porządkowi w danych.
+func StartReservationSweeper(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if n, err := ExpireReservations(db); err != nil {
+				log.Printf("reservation sweeper: %v", err)
+			} else if n > 0 {
+				log.Printf("reservation sweeper: expired %d reservations", n)
+			}
+		}
+	}()
+}
+
+// RestockProducts przywraca sprzedane sztuki na stan (np. po anulowaniu lub zwrocie)
+func RestockProducts(db *gorm.DB, quantities map[uint]int) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for productID, qty := range quantities {
+			if err := tx.Exec("UPDATE products SET stock = stock + ? WHERE id = ? AND stock IS NOT NULL",
+				qty, productID).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
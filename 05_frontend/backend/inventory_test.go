@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReserveStockRejectsTrashedProduct(t *testing.T) {
+	db := newTestDB(t, schemaModels...)
+	stock := 5
+	product := Product{Name: "Kubek", Price: NewMoney(2500, "PLN"), Currency: "PLN", Stock: &stock}
+	require.NoError(t, db.Create(&product).Error)
+	require.NoError(t, db.Delete(&product).Error)
+
+	assert.ErrorIs(t, ReserveStock(db, 1, product.ID, 1), ErrInsufficientStock)
+	var count int64
+	require.NoError(t, db.Model(&Reservation{}).Count(&count).Error)
+	assert.Zero(t, count)
+}
+
+func TestHeldReservationsExpireWithPaymentDeadline(t *testing.T) {
+	db := newTestDB(t, schemaModels...)
+	stock := 2
+	product := Product{Name: "Kubek", Price: NewMoney(2500, "PLN"), Currency: "PLN", Stock: &stock}
+	require.NoError(t, db.Create(&product).Error)
+
+	// termin płatności liczony jest w strefie serwera, rezerwacja musi wygasnąć dokładnie z nim
+	due := time.Now().Add(-time.Second)
+	require.NoError(t, HoldReservations(db, 1, map[uint]int{product.ID: 2}, due))
+	n, err := ExpireReservations(db)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	available, err := AvailableStock(db, product)
+	require.NoError(t, err)
+	assert.Equal(t, 2, *available)
+}
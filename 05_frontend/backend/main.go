@@ -1,9 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -13,53 +19,210 @@ import (
 )
 
 type Product struct {
-	ID          uint      `gorm:"primaryKey" json:"id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	Price       float64   `json:"price"`
-	CategoryID  uint      `json:"category_id"`
-	Category    Category  `gorm:"foreignKey:CategoryID" json:"category"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID          uint           `gorm:"primaryKey" json:"id"`
+	SKU         *string        `gorm:"uniqueIndex" json:"sku,omitempty"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Price       Money          `gorm:"embedded;embeddedPrefix:price_" json:"price"`
+	Currency    string         `gorm:"-" json:"currency"`
+	Stock       *int           `json:"stock"`
+	Available   *int           `gorm:"-" json:"available,omitempty"`
+	CategoryID  uint           `json:"category_id"`
+	Category    Category       `gorm:"foreignKey:CategoryID" json:"category"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"deleted_at"`
+}
+
+// Waluta ceny jest wystawiana w JSON jako osobne pole obok liczbowej ceny
+func (p *Product) BeforeSave(tx *gorm.DB) error {
+	if p.Price.Currency == "" {
+		p.Price.Currency = DefaultCurrency
+	}
+	p.Currency = p.Price.Currency
+	return nil
+}
+
+func (p *Product) AfterFind(tx *gorm.DB) error {
+	p.Currency = p.Price.Currency
+	return nil
+}
+
+// UnmarshalJSON parsuje cenę w walucie z pola currency (przy edycji - w dotychczasowej walucie
+// produktu). Zmiana waluty bez nowej ceny albo niezgodna waluta w obiekcie ceny to błąd.
+func (p *Product) UnmarshalJSON(data []byte) error {
+	type plain Product
+	var aux struct {
+		*plain
+		Price    json.RawMessage `json:"price"`
+		Currency *string         `json:"currency"`
+	}
+	aux.plain = (*plain)(p)
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	currency, strict := DefaultCurrency, false
+	if p.Price.Currency != "" {
+		currency = p.Price.Currency
+	}
+	if aux.Currency != nil && *aux.Currency != "" {
+		if _, err := currencyExponent(*aux.Currency); err != nil {
+			return err
+		}
+		currency, strict = *aux.Currency, true
+	}
+	switch {
+	case len(aux.Price) > 0 && string(aux.Price) != "null":
+		price, err := decodeMoney(aux.Price, currency, strict)
+		if err != nil {
+			return err
+		}
+		p.Price = price
+	case strict && p.Price.Currency != "" && p.Price.Currency != currency:
+		return fmt.Errorf("%w: price is in %s, send the price together with the new currency", ErrCurrencyMismatch, p.Price.Currency)
+	case strict:
+		p.Price.Currency = currency
+	}
+	p.Currency = p.Price.Currency
+	return nil
 }
 
 type Category struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	Name      string    `json:"name"`
-	Products  []Product `gorm:"foreignKey:CategoryID" json:"products"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        uint            `gorm:"primaryKey" json:"id"`
+	Name      string          `json:"name"`
+	ParentID  *uint           `gorm:"index" json:"parent_id"`
+	Path      []CategoryCrumb `gorm:"-" json:"path,omitempty"`
+	Products  []Product       `gorm:"foreignKey:CategoryID" json:"products"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
 }
 
 type Cart struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	Products  []Product `gorm:"many2many:cart_products;" json:"products"`
-	CreatedAt time.Time `json:"created_at"`
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	Items      []CartItem `gorm:"foreignKey:CartID" json:"items"`
+	Subtotal   Money      `gorm:"-" json:"subtotal"`
+	Status     string     `gorm:"default:open" json:"status"`
+	CouponCode string     `json:"coupon_code,omitempty"`
+	PaidAt     *time.Time `json:"paid_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
-type PaymentRequest struct {
-    CartID     uint   `json:"cart_id"`
-    CardNumber string `json:"card_number"`
-    Amount     float64 `json:"amount"`
+type ProductPage struct {
+	Data       []Product `json:"data"`
+	Total      int64     `json:"total"`
+	Page       int       `json:"page,omitempty"`
+	PerPage    int       `json:"per_page"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// schemaModels to tabele tworzone przez AutoMigrate przy starcie serwera
+var schemaModels = []interface{}{
+	&Product{}, &Cart{}, &CartItem{}, &Category{}, &Reservation{}, &Coupon{}, &Order{}, &OrderItem{}, &OrderTransition{},
+	&Payment{}, &IdempotencyKey{}, &ProcessedWebhook{}, &Refund{}, &RefundItem{}, &FraudAssessment{}, &FraudSignal{},
+	&Customer{}, &SavedPaymentMethod{}, &ProductRevision{},
 }
 
 func main() {
-	db, err := gorm.Open(sqlite.Open("test.db"), &gorm.Config{})
+	reindex := flag.Bool("reindex", false, "rebuild the product search index and exit")
+	coupon := flag.String("coupon", "", "create a coupon given as CODE:PERCENT_OFF and exit")
+	flag.Parse()
+
+	// busy_timeout + BEGIN IMMEDIATE: równoległe transakcje czekają na blokadę zamiast zwracać SQLITE_BUSY
+	db, err := gorm.Open(sqlite.Open("test.db?_pragma=busy_timeout(5000)&_txlock=immediate"), &gorm.Config{})
 	if err != nil {
 		panic("failed to connect database")
 	}
-	db.AutoMigrate(&Product{}, &Cart{}, &Category{})
+	db.AutoMigrate(schemaModels...)
+	if err := MigrateProductPrices(db); err != nil {
+		panic("failed to migrate product prices: " + err.Error())
+	}
+	if err := MigrateCartProducts(db); err != nil {
+		panic("failed to migrate cart products: " + err.Error())
+	}
+	if err := MigrateIdempotencyKeys(db); err != nil {
+		panic("failed to migrate idempotency keys: " + err.Error())
+	}
+	if err := MigrateOrderCartIndex(db); err != nil {
+		panic("failed to migrate order cart index: " + err.Error())
+	}
+	if err := MigrateProductRevisions(db); err != nil {
+		panic("failed to migrate product revisions: " + err.Error())
+	}
+	if err := MigrateSavedPaymentMethods(db); err != nil {
+		panic("failed to migrate saved payment methods: " + err.Error())
+	}
+	if err := EnsureProductSearchIndex(db); err != nil {
+		panic("failed to create search index: " + err.Error())
+	}
+	if *reindex {
+		if err := RebuildProductSearchIndex(db); err != nil {
+			panic("failed to rebuild search index: " + err.Error())
+		}
+		fmt.Println("search index rebuilt")
+		return
+	}
+	if *coupon != "" {
+		code, percent, _ := strings.Cut(*coupon, ":")
+		percentOff, _ := strconv.Atoi(percent)
+		created, err := CreateCoupon(db, code, percentOff)
+		if err != nil {
+			panic("failed to create coupon: " + err.Error())
+		}
+		fmt.Printf("coupon %s created (%d%% off)\n", created.Code, created.PercentOff)
+		return
+	}
+	admins, err := parseAdminTokens(adminTokens)
+	if err != nil {
+		panic("failed to configure admin tokens: " + err.Error())
+	}
+	if len(admins) == 0 {
+		log.Println("ADMIN_TOKENS is empty - admin endpoints will refuse every request")
+	}
+	if errShippingConfig != nil {
+		panic("failed to configure shipping: " + errShippingConfig.Error())
+	}
+	if err := checkFingerprintKey(); err != nil {
+		panic("failed to configure fraud checks: " + err.Error())
+	}
+	if err := checkWebhookSecret(); err != nil {
+		panic("failed to configure payment webhooks: " + err.Error())
+	}
+	gateway, err := NewPaymentGateway(paymentGatewayName)
+	if err != nil {
+		panic("failed to configure payment gateway: " + err.Error())
+	}
+	gateways := Gateways{gateway}
+	if redirectGatewayName != gateway.Name() {
+		redirect, err := NewPaymentGateway(redirectGatewayName)
+		if err != nil {
+			panic("failed to configure redirect payment gateway: " + err.Error())
+		}
+		gateways = append(gateways, redirect)
+	}
+	gateways = append(gateways, ManualGateway{})
+	StartReservationSweeper(db, time.Minute)
+	StartBankTransferSweeper(db, time.Minute)
+	StartAwaitingPaymentSweeper(db, gateways, time.Minute)
+	StartProductTrashPurger(db, time.Hour)
+	registerOrderEventHandlers(db, gateways)
 
 	e := echo.New()
+	// adres klienta bez nagłówków X-Forwarded-For, których nie da się zweryfikować (liczniki w fraud.go)
+	e.IPExtractor = echo.ExtractIPDirect()
 
 	 // middleware CORS
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
         AllowOrigins: []string{"*"},
-        AllowMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+        AllowMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+        ExposeHeaders: []string{"X-Total-Count", "X-Next-Cursor"},
     }))
     
 	e.Use(DBMiddleware(db))
+	e.Use(GatewayMiddleware(gateways))
+	e.Use(CustomerMiddleware(db))
+	e.Use(AdminMiddleware(admins))
+	idempotent := Idempotency(db)
 
 	e.POST("/test", func(c echo.Context) error {
 		body, _ := io.ReadAll(c.Request().Body)
@@ -69,23 +232,78 @@ func main() {
 
 	// Produkty
 	e.POST("/products", createProduct)
+	e.POST("/products/import", importProducts)
+	e.GET("/products/trash", getProductTrash)
 	e.GET("/products/:id", getProduct)
 	e.GET("/products", getAllProducts)
+	e.GET("/products/search", searchProducts)
 	e.PUT("/products/:id", updateProduct)
 	e.DELETE("/products/:id", deleteProduct)
+	e.POST("/products/:id/restore", restoreProduct)
+	e.GET("/products/:id/revisions", getProductRevisions)
+	e.POST("/products/:id/revisions/:revision/revert", revertProduct)
 
 	// Koszyki
-	e.POST("/carts", createCart)
+	e.POST("/carts", createCart, idempotent)
 	e.POST("/carts/:id/products", addProductToCart)
 	e.GET("/carts/:id", getCart)
 	e.DELETE("/carts/:id/products/:productId", removeProductFromCart)
+	e.POST("/carts/:id/items", addCartItem)
+	e.PATCH("/carts/:id/items/:itemId", updateCartItem)
+	e.DELETE("/carts/:id/items/:itemId", deleteCartItem)
+	e.GET("/carts/:id/totals", getCartTotals)
+	e.PUT("/carts/:id/coupon", applyCoupon)
+	e.DELETE("/carts/:id/coupon", removeCoupon)
+	e.POST("/carts/:id/checkout", checkoutCart, idempotent)
+
+	// Zamówienia
+	e.GET("/orders", getAllOrders)
+	e.GET("/orders/:id", getOrder)
+	e.POST("/orders/:id/transitions", createOrderTransition, AdminOnly)
+	e.GET("/orders/:id/transitions", getOrderTransitions)
 
 	// Kategorie
+	e.GET("/categories", getAllCategories)
 	e.POST("/categories", createCategory)
+	e.GET("/categories/tree", getCategoryTree)
 	e.GET("/categories/:id", getCategory)
+	e.PUT("/categories/:id", updateCategory(false))
+	e.PATCH("/categories/:id", updateCategory(true))
+	e.DELETE("/categories/:id", deleteCategory)
+	e.PUT("/categories/:id/parent", moveCategory)
 
 	// Płatnosci
-	e.POST("/payments", processPayment)
+	e.POST("/payments", processPayment, idempotent)
+	e.GET("/payments/:id", getPayment)
+	e.GET("/payments/:id/return", paymentReturn)
+	e.POST("/payments/:id/received", markTransferReceived, AdminOnly)
+	e.POST("/payments/:id/refunds", createRefund, AdminOnly, idempotent)
+	e.GET("/payments/:id/refunds", getPaymentRefunds)
+	e.GET("/carts/:id/payments", getCartPayments)
+	e.POST("/webhooks/payments", receivePaymentWebhook)
+	if _, ok := gateway.(BlikSimulator); ok {
+		e.POST("/simulator/blik/:id/confirm", simulateBlik(true))
+		e.POST("/simulator/blik/:id/reject", simulateBlik(false))
+	}
+	if _, ok := gateway.(ChallengeSimulator); ok {
+		e.GET("/simulator/3ds/:ref", showChallenge)
+		e.POST("/simulator/3ds/:ref", submitChallenge)
+	}
+
+	// Klienci i zapisane karty
+	e.POST("/customers", createCustomer)
+	e.GET("/customers/me", getCurrentCustomer)
+	e.GET("/customers/me/payment-methods", getPaymentMethods)
+	e.POST("/customers/me/payment-methods", createPaymentMethod)
+	e.DELETE("/customers/me/payment-methods/:id", deletePaymentMethod)
+	e.PUT("/customers/me/payment-methods/:id/default", setDefaultPaymentMethod)
+
+	// Ocena ryzyka płatności
+	e.GET("/fraud/assessments", getFraudAssessments, AdminOnly)
+	e.GET("/fraud/reviews", getFraudReviews, AdminOnly)
+	e.POST("/fraud/reviews/:id/approve", reviewPayment(true), AdminOnly)
+	e.POST("/fraud/reviews/:id/reject", reviewPayment(false), AdminOnly)
+
 	e.Logger.Fatal(e.Start(":1323"))
 }
 
@@ -107,23 +325,96 @@ func createProduct(c echo.Context) error {
 	}
 	p.CreatedAt = time.Now()
 	p.UpdatedAt = time.Now()
-	db.Create(p)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(p).Error; err != nil {
+			return err
+		}
+		_, err := RecordProductRevision(tx, p, RevisionCreated, requestActor(c), nil)
+		return err
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not create product")
+	}
 	return c.JSON(http.StatusCreated, p)
 }
 
 func getProduct(c echo.Context) error {
 	db := c.Get("db").(*gorm.DB)
 	id := c.Param("id")
+	if v := c.QueryParam("as_of"); v != "" {
+		asOf, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "as_of must be an RFC 3339 timestamp")
+		}
+		productID, err := parseUintParam(c, "id")
+		if err != nil {
+			return err
+		}
+		// czasy w bazie są zapisywane w strefie serwera, więc porównujemy w tej samej
+		p, err := productAsOf(db, productID, asOf.In(time.Local))
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, p)
+	}
 	var p Product
-	db.Preload("Category").First(&p, id)
+	if err := db.Preload("Category").First(&p, id).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Product not found")
+	}
+	p.Available, _ = AvailableStock(db, p)
 	return c.JSON(http.StatusOK, p)
 }
 
+// getAllProducts zwraca tablicę produktów - najwyżej per_page (bez parametrów stronicowania maxPerPage).
+// Liczba wszystkich pasujących i kursor następnej strony trafiają do nagłówków X-Total-Count i X-Next-Cursor,
+// a ?envelope=true zwraca stronę jako obiekt ProductPage.
 func getAllProducts(c echo.Context) error {
 	db := c.Get("db").(*gorm.DB)
-	var products []Product
-	db.Preload("Category").Find(&products)
-	return c.JSON(http.StatusOK, products)
+	params, err := parseProductListParams(c)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	if err := db.Model(&Product{}).Scopes(params.filters()...).Count(&total).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not count products")
+	}
+
+	query := db.Preload("Category").Scopes(params.filters()...).Scopes(SortProducts(params.Sort))
+	if params.Cursor != nil {
+		// jeden rekord więcej, żeby wiedzieć czy istnieje następna strona
+		query = query.Scopes(AfterCursor(params.Sort, params.Cursor)).Limit(params.PerPage + 1)
+	} else {
+		query = query.Scopes(Paginate(params.Page, params.PerPage))
+	}
+
+	products := []Product{}
+	if err := query.Find(&products).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch products")
+	}
+
+	response := ProductPage{Data: products, Total: total, PerPage: params.PerPage}
+	hasMore := false
+	if params.Cursor != nil {
+		hasMore = len(products) > params.PerPage
+		if hasMore {
+			response.Data = products[:params.PerPage]
+		}
+	} else {
+		response.Page = params.Page
+		hasMore = int64((params.Page-1)*params.PerPage+len(products)) < total
+	}
+	if hasMore && len(response.Data) > 0 {
+		response.NextCursor = encodeCursor(params.Sort, response.Data[len(response.Data)-1])
+	}
+	if params.Envelope {
+		return c.JSON(http.StatusOK, response)
+	}
+	c.Response().Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	if response.NextCursor != "" {
+		c.Response().Header().Set("X-Next-Cursor", response.NextCursor)
+	}
+	return c.JSON(http.StatusOK, response.Data)
 }
 
 func updateProduct(c echo.Context) error {
@@ -137,14 +428,31 @@ func updateProduct(c echo.Context) error {
 		return err
 	}
 	p.UpdatedAt = time.Now()
-	db.Save(&p)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&p).Error; err != nil {
+			return err
+		}
+		_, err := RecordProductRevision(tx, &p, RevisionUpdated, requestActor(c), nil)
+		return err
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not update product")
+	}
 	return c.JSON(http.StatusOK, p)
 }
 
 func deleteProduct(c echo.Context) error {
 	db := c.Get("db").(*gorm.DB)
-	id := c.Param("id")
-	db.Delete(&Product{}, id)
+	id, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	if err := SoftDeleteProduct(db, id, requestActor(c)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Product not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not delete product")
+	}
 	return c.NoContent(http.StatusNoContent)
 }
 
@@ -153,9 +461,12 @@ func createCart(c echo.Context) error {
 	db := c.Get("db").(*gorm.DB)
 	cart := Cart{CreatedAt: time.Now(), UpdatedAt: time.Now()}
 	db.Create(&cart)
+	cart.Items = []CartItem{}
+	cart.Subtotal = NewMoney(0, DefaultCurrency)
 	return c.JSON(http.StatusCreated, cart)
 }
 
+// Dodaje jedną sztukę produktu - zachowane dla starszych klientów, nowe używają /carts/:id/items
 func addProductToCart(c echo.Context) error {
 	db := c.Get("db").(*gorm.DB)
 	cartID := c.Param("id")
@@ -165,20 +476,24 @@ func addProductToCart(c echo.Context) error {
 		return err
 	}
 
-	var cart Cart
-	var product Product
-	db.First(&cart, cartID)
-	db.First(&product, body.ProductID)
-
-	db.Model(&cart).Association("Products").Append(&product)
+	cart, err := loadCart(db, cartID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Cart not found")
+	}
+	if err := AddCartItem(db, cart.ID, body.ProductID, 1); err != nil {
+		return cartItemError(err)
+	}
+	cart, _ = loadCart(db, cart.ID)
 	return c.JSON(http.StatusOK, cart)
 }
 
 func getCart(c echo.Context) error {
 	db := c.Get("db").(*gorm.DB)
 	id := c.Param("id")
-	var cart Cart
-	db.Preload("Products").First(&cart, id)
+	cart, err := loadCart(db, id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Cart not found")
+	}
 	return c.JSON(http.StatusOK, cart)
 }
 
@@ -189,9 +504,13 @@ func createCategory(c echo.Context) error {
 	if err := c.Bind(cat); err != nil {
 		return err
 	}
+	if err := ValidateCategoryParent(db, 0, cat.ParentID); err != nil {
+		return categoryError(err)
+	}
 	cat.CreatedAt = time.Now()
 	cat.UpdatedAt = time.Now()
 	db.Create(cat)
+	cat.Path, _ = CategoryPath(db, cat.ID)
 	return c.JSON(http.StatusCreated, cat)
 }
 
@@ -202,40 +521,33 @@ func getCategory(c echo.Context) error {
 	if err := db.Preload("Products").First(&category, id).Error; err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, "Category not found")
 	}
+	path, err := CategoryPath(db, category.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch category path")
+	}
+	category.Path = path
 	return c.JSON(http.StatusOK, category)
 }
 
-// Funkcja obsługującą płatności
-func processPayment(c echo.Context) error {
-    payment := new(PaymentRequest)
-    
-    if err := c.Bind(payment); err != nil {
-        return echo.NewHTTPError(http.StatusBadRequest, "Invalid payment data")
-    }
-
-    return c.JSON(http.StatusOK, map[string]interface{}{
-        "status": "success",
-        "transaction_id": time.Now().UnixNano(),
-        "cart_id": payment.CartID,
-    })
-}
-
 // Nowa funkcja obsługująca usuwanie produktu
 func removeProductFromCart(c echo.Context) error {
     db := c.Get("db").(*gorm.DB)
     cartID := c.Param("id")
     productID := c.Param("productId")
     
-    var cart Cart
-    if err := db.Preload("Products").First(&cart, cartID).Error; err != nil {
+    cart, err := loadCart(db, cartID)
+    if err != nil {
         return echo.NewHTTPError(http.StatusNotFound, "Koszyk nie istnieje")
     }
     
-    var product Product
-    if err := db.First(&product, productID).Error; err != nil {
+    var item CartItem
+    if err := db.Where("cart_id = ? AND product_id = ?", cart.ID, productID).Take(&item).Error; err != nil {
         return echo.NewHTTPError(http.StatusNotFound, "Produkt nie istnieje")
     }
     
-    db.Model(&cart).Association("Products").Delete(&product)
+    if err := RemoveCartItem(db, cart.ID, item.ID); err != nil {
+        return cartItemError(err)
+    }
+    cart, _ = loadCart(db, cart.ID)
     return c.JSON(http.StatusOK, cart)
-}
\ No newline at end of file
+}
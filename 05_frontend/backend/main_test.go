@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestDB otwiera pustą bazę SQLite w katalogu tymczasowym testu i migruje podane modele
+func newTestDB(t *testing.T, models ...interface{}) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	require.NoError(t, db.AutoMigrate(models...))
+	return db
+}
+
+// testAdminToken to token operatora "magazyn" na serwerach testowych
+const testAdminToken = "magazyn-test-token"
+
+// testAdmins to konfiguracja ADMIN_TOKENS dla testów, jak w main
+func testAdmins(t *testing.T) map[string]string {
+	t.Helper()
+	admins, err := parseAdminTokens("magazyn:" + testAdminToken)
+	require.NoError(t, err)
+	return admins
+}
+
+// doRequest wysyła żądanie JSON do e; headers to pary nazwa, wartość
+func doRequest(e *echo.Echo, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, bytes.NewReader([]byte(body)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// newPaymentTestServer podpina trasy płatności i obsługę zdarzeń zamówień do testowej bazy
+func newPaymentTestServer(t *testing.T) (*echo.Echo, *gorm.DB, *FakeGateway) {
+	db := newTestDB(t, schemaModels...)
+	previous := orderEvents
+	orderEvents = &EventBus{}
+	t.Cleanup(func() { orderEvents = previous })
+
+	gateway := newTestFakeGateway(t)
+	registerOrderEventHandlers(db, Gateways{gateway})
+	e := echo.New()
+	e.Use(DBMiddleware(db))
+	e.Use(GatewayMiddleware(Gateways{gateway}))
+	e.Use(AdminMiddleware(testAdmins(t)))
+	e.POST("/payments", processPayment)
+	e.POST("/payments/:id/refunds", createRefund, AdminOnly)
+	return e, db, gateway
+}
+
+// newTestCart tworzy koszyk z qty sztukami nowego produktu o podanym stanie
+func newTestCart(t *testing.T, db *gorm.DB, stock, qty int) (*Cart, *Product) {
+	t.Helper()
+	product := &Product{Name: "Kubek", Price: NewMoney(2500, "PLN"), Currency: "PLN", Stock: &stock}
+	require.NoError(t, db.Create(product).Error)
+	cart := &Cart{}
+	require.NoError(t, db.Create(cart).Error)
+	require.NoError(t, AddCartItem(db, cart.ID, product.ID, qty))
+	cart, err := loadCart(db, cart.ID)
+	require.NoError(t, err)
+	return cart, product
+}
+
+// newTestFakeGateway tworzy fałszywą bramkę z własną bazą, tak jak przy starcie serwera
+func newTestFakeGateway(t *testing.T) *FakeGateway {
+	return NewFakeGateway(newTestDB(t, &FakeGatewayToken{}, &FakeGatewayAuthorization{}))
+}
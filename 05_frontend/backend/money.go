@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Money przechowuje kwotę w jednostkach podrzędnych (grosze, centy) razem z kodem ISO 4217.
+// W JSON kwota jest liczbą dziesiętną (19.99), tak jak dotychczasowe pole float64,
+// ale wczytanie akceptuje też napis ("19.99") oraz obiekt {"amount": 1999, "currency": "PLN"}.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency" gorm:"size:3"`
+}
+
+var DefaultCurrency = envString("SHOP_CURRENCY", "PLN")
+
+// Liczba miejsc po przecinku dla obsługiwanych walut (ISO 4217 minor unit)
+var currencyExponents = map[string]int{
+	"PLN": 2,
+	"EUR": 2,
+	"USD": 2,
+	"GBP": 2,
+	"CHF": 2,
+	"CZK": 2,
+	"HUF": 2,
+	"SEK": 2,
+	"JPY": 0,
+	"KWD": 3,
+}
+
+var (
+	ErrUnknownCurrency  = errors.New("unknown currency")
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	ErrInvalidAmount    = errors.New("invalid amount")
+)
+
+func currencyExponent(currency string) (int, error) {
+	exp, ok := currencyExponents[currency]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownCurrency, currency)
+	}
+	return exp, nil
+}
+
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// Zapis dziesiętny akceptowany od klientów: cyfry z opcjonalną kropką, bez wykładnika i ułamków zwykłych
+var decimalPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// ParseMoney zamienia zapis dziesiętny ("19.99") na kwotę bez użycia float64.
+// Więcej miejsc po przecinku niż ma waluta to błąd, a nie zaokrąglenie.
+func ParseMoney(s, currency string) (Money, error) {
+	exp, err := currencyExponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	s = strings.TrimSpace(s)
+	if !decimalPattern.MatchString(s) {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	if _, frac, ok := strings.Cut(s, "."); ok && len(frac) > exp {
+		return Money{}, fmt.Errorf("%w: %q has more than %d decimal places for %s", ErrInvalidAmount, s, exp, currency)
+	}
+	r, _ := new(big.Rat).SetString(s)
+	return ratToMoney(r, exp, currency)
+}
+
+// MoneyFromFloat służy wyłącznie do konwersji starych danych zapisanych jako float64;
+// szum binarny (19.990000000000002) jest zaokrąglany bankowo (half to even)
+func MoneyFromFloat(f float64, currency string) (Money, error) {
+	exp, err := currencyExponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(f, 'f', -1, 64))
+	if !ok {
+		return Money{}, fmt.Errorf("%w: %v", ErrInvalidAmount, f)
+	}
+	return ratToMoney(r, exp, currency)
+}
+
+func ratToMoney(r *big.Rat, exp int, currency string) (Money, error) {
+	r.Mul(r, new(big.Rat).SetInt(pow10(exp)))
+	minor, err := roundHalfEven(r)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: minor, Currency: currency}, nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+func roundHalfEven(r *big.Rat) (int64, error) {
+	num, den := r.Num(), r.Denom()
+	q, m := new(big.Int).QuoRem(num, den, new(big.Int))
+	// porównujemy 2*|reszta| z mianownikiem, żeby wiedzieć czy jesteśmy powyżej/poniżej połowy
+	twice := new(big.Int).Abs(m)
+	twice.Lsh(twice, 1)
+	switch cmp := twice.Cmp(den); {
+	case cmp > 0, cmp == 0 && q.Bit(0) == 1:
+		if num.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	if !q.IsInt64() {
+		return 0, errAmountOutOfRange
+	}
+	return q.Int64(), nil
+}
+
+func (m Money) sameCurrency(o Money) error {
+	if m.Currency != o.Currency {
+		return fmt.Errorf("%w: %s vs %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+	}
+	return nil
+}
+
+var errAmountOutOfRange = fmt.Errorf("%w: out of range", ErrInvalidAmount)
+
+func (m Money) Add(o Money) (Money, error) {
+	if err := m.sameCurrency(o); err != nil {
+		return Money{}, err
+	}
+	sum := m.Amount + o.Amount
+	// przepełnienie int64 zmienia znak sumy względem składnika
+	if (o.Amount > 0 && sum < m.Amount) || (o.Amount < 0 && sum > m.Amount) {
+		return Money{}, errAmountOutOfRange
+	}
+	return Money{Amount: sum, Currency: m.Currency}, nil
+}
+
+func (m Money) Sub(o Money) (Money, error) {
+	if err := m.sameCurrency(o); err != nil {
+		return Money{}, err
+	}
+	diff := m.Amount - o.Amount
+	if (o.Amount > 0 && diff > m.Amount) || (o.Amount < 0 && diff < m.Amount) {
+		return Money{}, errAmountOutOfRange
+	}
+	return Money{Amount: diff, Currency: m.Currency}, nil
+}
+
+func (m Money) Mul(qty int64) (Money, error) {
+	product := new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(qty))
+	if !product.IsInt64() {
+		return Money{}, errAmountOutOfRange
+	}
+	return Money{Amount: product.Int64(), Currency: m.Currency}, nil
+}
+
+// MulRatio mnoży kwotę przez num/den z zaokrągleniem bankowym - do rabatów procentowych i podatków
+func (m Money) MulRatio(num, den int64) (Money, error) {
+	if den == 0 {
+		return Money{}, fmt.Errorf("%w: zero denominator", ErrInvalidAmount)
+	}
+	// iloczyn liczony na big.Int - Amount*num nie mieści się w int64 już przy dużych kwotach
+	product := new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(num))
+	amount, err := roundHalfEven(new(big.Rat).SetFrac(product, big.NewInt(den)))
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: amount, Currency: m.Currency}, nil
+}
+
+func (m Money) Cmp(o Money) (int, error) {
+	if err := m.sameCurrency(o); err != nil {
+		return 0, err
+	}
+	switch {
+	case m.Amount < o.Amount:
+		return -1, nil
+	case m.Amount > o.Amount:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// Decimal zwraca kwotę w jednostkach głównych, np. "19.99"
+func (m Money) Decimal() string {
+	exp, ok := currencyExponents[m.Currency]
+	if !ok {
+		exp = 2
+	}
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	s := strconv.FormatInt(amount, 10)
+	if exp == 0 {
+		return sign + s
+	}
+	if len(s) <= exp {
+		s = strings.Repeat("0", exp-len(s)+1) + s
+	}
+	return sign + s[:len(s)-exp] + "." + s[len(s)-exp:]
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.Decimal()), nil
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		return nil
+	}
+	parsed, err := decodeMoney(data, DefaultCurrency, false)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// decodeMoney wczytuje kwotę w dowolnym z formatów JSON. Liczba i napis są parsowane w walucie
+// currency; obiekt może podać własną walutę, chyba że strict - wtedy musi być zgodna z currency.
+func decodeMoney(data []byte, currency string, strict bool) (Money, error) {
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) > 0 && data[0] == '{':
+		var obj struct {
+			Amount   int64  `json:"amount"`
+			Currency string `json:"currency"`
+		}
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return Money{}, err
+		}
+		switch {
+		case obj.Currency == "":
+			obj.Currency = currency
+		case strict && obj.Currency != currency:
+			return Money{}, fmt.Errorf("%w: %s vs %s", ErrCurrencyMismatch, obj.Currency, currency)
+		}
+		if _, err := currencyExponent(obj.Currency); err != nil {
+			return Money{}, err
+		}
+		return Money{Amount: obj.Amount, Currency: obj.Currency}, nil
+	case len(data) > 0 && data[0] == '"':
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return Money{}, err
+		}
+		data = []byte(s)
+	}
+	// liczba z JSON jest parsowana z tekstu, bez przechodzenia przez float64
+	return ParseMoney(string(data), currency)
+}
+
+// MigrateProductPrices przenosi stare ceny z kolumny products.price (REAL)
+// do price_amount/price_currency i usuwa starą kolumnę.
+func MigrateProductPrices(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&Product{}, "price") {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		var rows []struct {
+			ID    uint
+			Price float64
+		}
+		if err := tx.Raw("SELECT id, price FROM products WHERE price IS NOT NULL").Scan(&rows).Error; err != nil {
+			return err
+		}
+		for _, row := range rows {
+			price, err := MoneyFromFloat(row.Price, DefaultCurrency)
+			if err != nil {
+				return fmt.Errorf("product %d: %w", row.ID, err)
+			}
+			if err := tx.Exec("UPDATE products SET price_amount = ?, price_currency = ? WHERE id = ?",
+				price.Amount, price.Currency, row.ID).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Migrator().DropColumn(&Product{}, "price")
+	})
+}
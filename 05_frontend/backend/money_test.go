@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMoney(t *testing.T) {
+	valid := []struct {
+		in       string
+		currency string
+		amount   int64
+	}{
+		{"19.99", "PLN", 1999},
+		{" 7 ", "PLN", 700},
+		{"0.5", "EUR", 50},
+		{"-3.10", "PLN", -310},
+		{"1500", "JPY", 1500},
+		{"1.234", "KWD", 1234},
+	}
+	for _, tc := range valid {
+		m, err := ParseMoney(tc.in, tc.currency)
+		if assert.NoError(t, err, tc.in) {
+			assert.Equal(t, Money{Amount: tc.amount, Currency: tc.currency}, m, tc.in)
+		}
+	}
+
+	invalid := []struct {
+		in       string
+		currency string
+	}{
+		{"1/3", "PLN"},
+		{"1e30", "PLN"},
+		{"1E2", "PLN"},
+		{"19.999", "PLN"},
+		{"10.5", "JPY"},
+		{"1,5", "PLN"},
+		{".5", "PLN"},
+		{"5.", "PLN"},
+		{"+5", "PLN"},
+		{"abc", "PLN"},
+		{"", "PLN"},
+		{"99999999999999999999", "PLN"},
+	}
+	for _, tc := range invalid {
+		_, err := ParseMoney(tc.in, tc.currency)
+		assert.ErrorIs(t, err, ErrInvalidAmount, tc.in)
+	}
+
+	_, err := ParseMoney("1.00", "XYZ")
+	assert.ErrorIs(t, err, ErrUnknownCurrency)
+}
+
+func TestMoneyFromFloatRoundsHalfEven(t *testing.T) {
+	cases := map[float64]int64{
+		0.125:     12,
+		0.135:     14,
+		-0.125:    -12,
+		19.99:     1999,
+		0.1 + 0.2: 30,
+	}
+	for in, want := range cases {
+		m, err := MoneyFromFloat(in, "PLN")
+		if assert.NoError(t, err) {
+			assert.Equal(t, want, m.Amount, "%v", in)
+		}
+	}
+}
+
+func TestMulRatio(t *testing.T) {
+	cases := []struct {
+		amount, num, den, want int64
+	}{
+		{250, 1, 100, 2},   // 2.5 -> 2
+		{350, 1, 100, 4},   // 3.5 -> 4
+		{-250, 1, 100, -2}, // -2.5 -> -2
+		{12300, 23, 123, 2300},
+		{1999, 10, 100, 200}, // 199.9 -> 200
+	}
+	for _, tc := range cases {
+		got, err := NewMoney(tc.amount, "PLN").MulRatio(tc.num, tc.den)
+		require.NoError(t, err)
+		assert.Equal(t, NewMoney(tc.want, "PLN"), got, "%d*%d/%d", tc.amount, tc.num, tc.den)
+	}
+
+	// 9e17 * 23 nie mieści się w int64, wynik po podzieleniu już tak
+	got, err := NewMoney(900_000_000_000_000_000, "PLN").MulRatio(23, 123)
+	require.NoError(t, err)
+	assert.Equal(t, int64(168_292_682_926_829_268), got.Amount)
+
+	_, err = NewMoney(math.MaxInt64, "PLN").MulRatio(2, 1)
+	assert.ErrorIs(t, err, ErrInvalidAmount)
+	_, err = NewMoney(100, "PLN").MulRatio(1, 0)
+	assert.ErrorIs(t, err, ErrInvalidAmount)
+}
+
+func TestMoneyArithmeticOverflow(t *testing.T) {
+	nearMax := NewMoney(math.MaxInt64-1, "PLN")
+	_, err := nearMax.Add(NewMoney(2, "PLN"))
+	assert.ErrorIs(t, err, ErrInvalidAmount)
+	_, err = NewMoney(math.MinInt64+1, "PLN").Sub(NewMoney(2, "PLN"))
+	assert.ErrorIs(t, err, ErrInvalidAmount)
+	_, err = nearMax.Mul(2)
+	assert.ErrorIs(t, err, ErrInvalidAmount)
+	_, err = NewMoney(math.MinInt64, "PLN").Mul(-1)
+	assert.ErrorIs(t, err, ErrInvalidAmount)
+
+	sum, err := nearMax.Add(NewMoney(1, "PLN"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(math.MaxInt64), sum.Amount)
+	line, err := NewMoney(1999, "PLN").Mul(3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5997), line.Amount)
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var m Money
+	require.NoError(t, json.Unmarshal([]byte(`19.99`), &m))
+	assert.Equal(t, NewMoney(1999, DefaultCurrency), m)
+	require.NoError(t, json.Unmarshal([]byte(`"5"`), &m))
+	assert.Equal(t, NewMoney(500, DefaultCurrency), m)
+	require.NoError(t, json.Unmarshal([]byte(`{"amount":1500,"currency":"JPY"}`), &m))
+	assert.Equal(t, NewMoney(1500, "JPY"), m)
+	assert.Error(t, json.Unmarshal([]byte(`1e3`), &m))
+	assert.Error(t, json.Unmarshal([]byte(`{"amount":1,"currency":"XYZ"}`), &m))
+
+	raw, err := json.Marshal(NewMoney(-5, "PLN"))
+	require.NoError(t, err)
+	assert.Equal(t, `-0.05`, string(raw))
+}
+
+func TestProductUnmarshalHonoursCurrency(t *testing.T) {
+	var p Product
+	require.NoError(t, json.Unmarshal([]byte(`{"name":"Herbata","price":12.5,"currency":"EUR"}`), &p))
+	assert.Equal(t, NewMoney(1250, "EUR"), p.Price)
+	assert.Equal(t, "EUR", p.Currency)
+
+	p = Product{}
+	require.NoError(t, json.Unmarshal([]byte(`{"price":1500,"currency":"JPY"}`), &p))
+	assert.Equal(t, NewMoney(1500, "JPY"), p.Price)
+
+	p = Product{}
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"price":10.5,"currency":"JPY"}`), &p), ErrInvalidAmount)
+	p = Product{}
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"price":1,"currency":"XYZ"}`), &p), ErrUnknownCurrency)
+	p = Product{}
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"price":{"amount":100,"currency":"USD"},"currency":"EUR"}`), &p), ErrCurrencyMismatch)
+
+	// edycja: cena bez waluty zostaje w walucie produktu, sama zmiana waluty jest odrzucana
+	p = Product{Price: NewMoney(1000, "EUR"), Currency: "EUR"}
+	require.NoError(t, json.Unmarshal([]byte(`{"price":"11.00"}`), &p))
+	assert.Equal(t, NewMoney(1100, "EUR"), p.Price)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"currency":"USD"}`), &p), ErrCurrencyMismatch)
+	require.NoError(t, json.Unmarshal([]byte(`{"price":12,"currency":"USD"}`), &p))
+	assert.Equal(t, NewMoney(1200, "USD"), p.Price)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Płatności poza bramką.
+// Za pobraniem: koszyk jest zamykany od razu, towar schodzi ze stanu, zamówienie przechodzi
+// w confirmed, a płatność (outstanding) jest rozliczana, gdy zamówienie zostanie doręczone.
+// Przelew tradycyjny: zamówienie czeka (pending) na wpłatę z wygenerowanym tytułem, którą
+// obsługa potwierdza przez POST /payments/:id/received. Towar jest zarezerwowany do terminu
+// wpłaty, a nieopłacone w ciągu BANK_TRANSFER_DAYS dni zamówienia są anulowane (co zwalnia
+// rezerwacje). Dopóki przelew jest oczekiwany, koszyka nie da się opłacić w inny sposób.
+
+var (
+	bankTransferDays      = envInt("BANK_TRANSFER_DAYS", 7)
+	bankTransferAccount   = envString("BANK_TRANSFER_ACCOUNT", "PL61 1090 1014 0000 0712 1981 2874")
+	bankTransferRecipient = envString("BANK_TRANSFER_RECIPIENT", "Sklep internetowy")
+)
+
+// TransferInstructions to dane do przelewu pokazywane klientowi
+type TransferInstructions struct {
+	Recipient     string     `json:"recipient"`
+	AccountNumber string     `json:"account_number"`
+	Title         string     `json:"title"`
+	Amount        Money      `json:"amount"`
+	DueAt         *time.Time `json:"due_at,omitempty"`
+}
+
+func (p *Payment) AfterFind(tx *gorm.DB) error {
+	p.fillTransferInstructions()
+	return nil
+}
+
+func (p *Payment) fillTransferInstructions() {
+	if p.Method != PaymentMethodBankTransfer || p.GatewayReference == "" {
+		return
+	}
+	p.Transfer = &TransferInstructions{
+		Recipient:     bankTransferRecipient,
+		AccountNumber: bankTransferAccount,
+		Title:         p.GatewayReference,
+		Amount:        p.Amount,
+		DueAt:         p.ExpiresAt,
+	}
+}
+
+// ManualGateway obsługuje płatności przyjmowane poza bramką. Zwroty takich płatności
+// robi obsługa sklepu (przelewem), więc tutaj są tylko odnotowywane.
+type ManualGateway struct{}
+
+func (ManualGateway) Name() string { return "manual" }
+
+func (ManualGateway) Tokenize(ctx context.Context, card CardDetails) (string, error) {
+	return "", ErrUnsupportedOperation
+}
+
+func (ManualGateway) Authorize(ctx context.Context, req AuthorizeRequest) (*Authorization, error) {
+	return nil, ErrUnsupportedOperation
+}
+
+func (ManualGateway) Capture(ctx context.Context, reference string, amount Money) error {
+	return ErrUnsupportedOperation
+}
+
+func (ManualGateway) Void(ctx context.Context, reference string) error {
+	return nil
+}
+
+func (ManualGateway) Refund(ctx context.Context, reference string, amount Money) (string, error) {
+	return "manual_refund_" + randomHex(8), nil
+}
+
+// startCashOnDelivery zamyka koszyk i przekazuje zamówienie do realizacji bez zapłaty
+func startCashOnDelivery(c echo.Context, cart *Cart, order *Order, totals *CartTotals, amount Money) error {
+	db := c.Get("db").(*gorm.DB)
+	record := &Payment{
+		CartID:   cart.ID,
+		Status:   PaymentOutstanding,
+		Amount:   amount,
+		Currency: amount.Currency,
+		Method:   PaymentMethodCashOnDelivery,
+		Gateway:  ManualGateway{}.Name(),
+	}
+	var event OrderEvent
+	err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&Cart{}).Where("id = ? AND status IN ?", cart.ID, []string{CartOpen, CartCheckedOut}).
+			Update("status", CartConfirmed)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrCartLocked
+		}
+		if err := CommitReservations(tx, cart.ID, cart.Quantities()); err != nil {
+			return err
+		}
+		var err error
+		if order == nil {
+			if order, err = CreateOrderFromCart(tx, cart, totals, "payments"); err != nil {
+				return err
+			}
+		}
+		if event, err = transitionOrder(tx, order, OrderConfirmed, "payments", "cash on delivery"); err != nil {
+			return err
+		}
+		record.OrderID = &order.ID
+		return tx.Create(record).Error
+	})
+	switch {
+	case errors.Is(err, ErrCartLocked):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Cart is already paid")
+	case errors.Is(err, ErrInsufficientStock):
+		return echo.NewHTTPError(http.StatusConflict, "Insufficient stock")
+	case errors.Is(err, ErrIllegalTransition), errors.Is(err, ErrOrderChanged):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Order can no longer be paid")
+	case err != nil:
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not confirm order")
+	}
+	orderEvents.Publish(event)
+	return c.JSON(http.StatusCreated, record)
+}
+
+// startBankTransfer tworzy zamówienie oczekujące na przelew i zwraca dane do przelewu
+func startBankTransfer(c echo.Context, cart *Cart, order *Order, totals *CartTotals, amount Money) error {
+	db := c.Get("db").(*gorm.DB)
+	// zwykła rezerwacja wygasłaby na długo przed zaksięgowaniem przelewu
+	dueAt := time.Now().AddDate(0, 0, bankTransferDays)
+	if err := HoldReservations(db, cart.ID, cart.Quantities(), dueAt); err != nil {
+		if errors.Is(err, ErrInsufficientStock) {
+			return echo.NewHTTPError(http.StatusConflict, "Insufficient stock")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not reserve stock")
+	}
+	record, err := beginAwaitingPayment(db, cart, order, totals, amount, PaymentMethodBankTransfer, ManualGateway{}.Name())
+	if err != nil {
+		if err := HoldReservations(db, cart.ID, cart.Quantities(), time.Now().Add(reservationTTL)); err != nil {
+			log.Printf("payments: could not shorten reservations of cart %d: %v", cart.ID, err)
+		}
+		return err
+	}
+	record.Status = PaymentAwaitingTransfer
+	record.GatewayReference = fmt.Sprintf("ZAM %d/%s", *record.OrderID, strings.ToUpper(randomHex(3)))
+	record.ExpiresAt = &dueAt
+	if err := db.Model(record).Updates(map[string]interface{}{
+		"status": record.Status, "gateway_reference": record.GatewayReference, "expires_at": dueAt,
+	}).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not record payment")
+	}
+	record.fillTransferInstructions()
+	return c.JSON(http.StatusAccepted, record)
+}
+
+// markTransferReceived to potwierdzenie wpłaty przez obsługę po sprawdzeniu wyciągu
+func markTransferReceived(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	paymentID, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	var record Payment
+	var paidEvent *OrderEvent
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("method = ?", PaymentMethodBankTransfer).First(&record, paymentID).Error; err != nil {
+			return err
+		}
+		if record.Status != PaymentAwaitingTransfer {
+			return ErrInvalidGatewayState
+		}
+		_, paidEvent, err = settlePendingPayment(tx, &record, requestActor(c))
+		return err
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Bank transfer payment not found")
+	case errors.Is(err, ErrInvalidGatewayState), errors.Is(err, ErrPaymentChanged):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Payment is not awaiting a transfer")
+	case err != nil:
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not update payment")
+	}
+	if paidEvent != nil {
+		orderEvents.Publish(*paidEvent)
+	}
+	return c.JSON(http.StatusOK, record)
+}
+
+// collectCashOnDelivery rozlicza płatność za pobraniem po doręczeniu zamówienia
+func collectCashOnDelivery(db *gorm.DB, orderID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		res := tx.Model(&Payment{}).
+			Where("order_id = ? AND method = ? AND status = ?", orderID, PaymentMethodCashOnDelivery, PaymentOutstanding).
+			Updates(map[string]interface{}{"status": PaymentCaptured, "captured_at": now})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		return tx.Model(&Order{}).Where("id = ?", orderID).Update("paid_at", now).Error
+	})
+}
+
+// CancelUnpaidTransfers anuluje zamówienia, za które przelew nie dotarł w terminie.
+// Jeśli zamówienie opłacono w inny sposób, wygasa tylko sama płatność.
+func CancelUnpaidTransfers(db *gorm.DB) (int, error) {
+	var expired []Payment
+	if err := db.Where("status = ? AND expires_at <= ?", PaymentAwaitingTransfer, time.Now()).Find(&expired).Error; err != nil {
+		return 0, err
+	}
+	cancelled := 0
+	for _, record := range expired {
+		var event *OrderEvent
+		err := db.Transaction(func(tx *gorm.DB) error {
+			res := tx.Model(&Payment{}).Where("id = ? AND status = ?", record.ID, PaymentAwaitingTransfer).
+				Updates(map[string]interface{}{"status": PaymentFailed, "error_reason": "bank transfer not received in time"})
+			if res.Error != nil || res.RowsAffected == 0 || record.OrderID == nil {
+				return res.Error
+			}
+			var order Order
+			if err := tx.First(&order, *record.OrderID).Error; err != nil {
+				return err
+			}
+			if order.Status != OrderPending {
+				return nil
+			}
+			ev, err := transitionOrder(tx, &order, OrderCancelled, "payments", "bank transfer not received in time")
+			if err != nil {
+				return err
+			}
+			event = &ev
+			return nil
+		})
+		if err != nil {
+			return cancelled, fmt.Errorf("payment %d: %w", record.ID, err)
+		}
+		if event != nil {
+			orderEvents.Publish(*event)
+			cancelled++
+		}
+	}
+	return cancelled, nil
+}
+
+// StartBankTransferSweeper okresowo anuluje zamówienia z nieopłaconym przelewem
+func StartBankTransferSweeper(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if n, err := CancelUnpaidTransfers(db); err != nil {
+				log.Printf("bank transfer sweeper: %v", err)
+			} else if n > 0 {
+				log.Printf("bank transfer sweeper: cancelled %d unpaid orders", n)
+			}
+		}
+	}()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBankTransferHoldsStockUntilDueDate(t *testing.T) {
+	e, db, _ := newPaymentTestServer(t)
+	cart, product := newTestCart(t, db, 3, 2)
+	totals, err := ComputeTotals(db, cart)
+	require.NoError(t, err)
+
+	rec := doRequest(e, http.MethodPost, "/payments",
+		fmt.Sprintf(`{"cart_id":%d,"method":"bank_transfer","amount":%s}`, cart.ID, totals.Total.Decimal()))
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var payment Payment
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &payment))
+	assert.Equal(t, PaymentAwaitingTransfer, payment.Status)
+
+	var reservation Reservation
+	require.NoError(t, db.Where("cart_id = ? AND product_id = ?", cart.ID, product.ID).Take(&reservation).Error)
+	assert.Equal(t, ReservationActive, reservation.Status)
+	assert.WithinDuration(t, *payment.ExpiresAt, reservation.ExpiresAt, time.Second)
+	assert.True(t, reservation.ExpiresAt.After(time.Now().Add(reservationTTL)))
+}
+
+func TestAwaitedBankTransferBlocksOtherPayments(t *testing.T) {
+	e, db, _ := newPaymentTestServer(t)
+	cart, _ := newTestCart(t, db, 3, 1)
+	totals, err := ComputeTotals(db, cart)
+	require.NoError(t, err)
+
+	rec := doRequest(e, http.MethodPost, "/payments",
+		fmt.Sprintf(`{"cart_id":%d,"method":"bank_transfer","amount":%s}`, cart.ID, totals.Total.Decimal()))
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var transfer Payment
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &transfer))
+
+	for _, method := range []string{"cash_on_delivery", "bank_transfer"} {
+		rec = doRequest(e, http.MethodPost, "/payments",
+			fmt.Sprintf(`{"cart_id":%d,"method":%q,"amount":%s}`, cart.ID, method, totals.Total.Decimal()))
+		assert.Equal(t, http.StatusConflict, rec.Code, method)
+	}
+
+	// po anulowaniu zamówienia przelew jest unieważniony, a koszyk można opłacić inaczej
+	_, err = TransitionOrder(db, *transfer.OrderID, OrderCancelled, "test", "")
+	require.NoError(t, err)
+	require.NoError(t, db.First(&transfer, transfer.ID).Error)
+	assert.Equal(t, PaymentVoided, transfer.Status)
+	assert.NoError(t, ensureNoAwaitingPayment(db, Gateways{}, cart.ID))
+}
+
+func TestMarkTransferReceivedRequiresAdmin(t *testing.T) {
+	e, db, _ := newPaymentTestServer(t)
+	e.POST("/payments/:id/received", markTransferReceived, AdminOnly)
+	cart, product := newTestCart(t, db, 3, 1)
+	totals, err := ComputeTotals(db, cart)
+	require.NoError(t, err)
+	rec := doRequest(e, http.MethodPost, "/payments",
+		fmt.Sprintf(`{"cart_id":%d,"method":"bank_transfer","amount":%s}`, cart.ID, totals.Total.Decimal()))
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var transfer Payment
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &transfer))
+	target := fmt.Sprintf("/payments/%d/received", transfer.ID)
+
+	// klient nie może sam "zaksięgować" swojego przelewu
+	rec = doRequest(e, http.MethodPost, target, "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doRequest(e, http.MethodPost, target, "", adminTokenHeader, "zgadniety-token-123")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	require.NoError(t, db.First(&transfer, transfer.ID).Error)
+	assert.Equal(t, PaymentAwaitingTransfer, transfer.Status)
+
+	rec = doRequest(e, http.MethodPost, target, "", adminTokenHeader, testAdminToken)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, db.First(&transfer, transfer.ID).Error)
+	assert.Equal(t, PaymentCaptured, transfer.Status)
+	var order Order
+	require.NoError(t, db.First(&order, *transfer.OrderID).Error)
+	assert.Equal(t, OrderPaid, order.Status)
+	var paid OrderTransition
+	require.NoError(t, db.Where(&OrderTransition{OrderID: order.ID, To: OrderPaid}).Take(&paid).Error)
+	assert.Equal(t, "magazyn", paid.Actor)
+	assert.Equal(t, 2, productStock(t, db, product.ID))
+}
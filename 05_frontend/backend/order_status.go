@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Cykl życia zamówienia:
+// pending -> paid -> packed -> shipped -> delivered
+// z odgałęzieniami cancelled (przed wysyłką) i refunded (po opłaceniu).
+// Za pobraniem zamiast paid jest confirmed, a płatność rozlicza się przy doręczeniu.
+// paid i refunded ustawiają wyłącznie settlePayment i completeRefund, nie POST /orders/:id/transitions.
+var orderTransitions = map[string][]string{
+	OrderPending:   {OrderPaid, OrderConfirmed, OrderCancelled},
+	OrderConfirmed: {OrderPacked, OrderCancelled},
+	OrderPaid:      {OrderPacked, OrderCancelled, OrderRefunded},
+	OrderPacked:    {OrderShipped, OrderCancelled, OrderRefunded},
+	OrderShipped:   {OrderDelivered},
+	OrderDelivered: {OrderRefunded},
+	OrderCancelled: {},
+	OrderRefunded:  {},
+}
+
+var (
+	ErrUnknownOrderStatus = errors.New("unknown order status")
+	ErrIllegalTransition  = errors.New("illegal order status transition")
+	ErrOrderChanged       = errors.New("order status changed concurrently")
+	ErrReservedTransition = errors.New("order status is set by payments and refunds")
+	ErrOrderCaptured      = errors.New("order has a captured payment, refund it instead of cancelling")
+)
+
+type OrderTransition struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	OrderID   uint      `gorm:"index" json:"order_id"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Actor     string    `json:"actor"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func CanTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionOrder zmienia status w ramach transakcji tx i zapisuje historię.
+// Zwrócone zdarzenie należy opublikować dopiero po zatwierdzeniu transakcji.
+func transitionOrder(tx *gorm.DB, order *Order, to, actor, reason string) (OrderEvent, error) {
+	if _, ok := orderTransitions[to]; !ok {
+		return OrderEvent{}, fmt.Errorf("%w: %q", ErrUnknownOrderStatus, to)
+	}
+	from := order.Status
+	if !CanTransition(from, to) {
+		return OrderEvent{}, fmt.Errorf("%w: cannot move order from %s to %s", ErrIllegalTransition, from, to)
+	}
+
+	now := time.Now()
+	res := tx.Model(&Order{}).Where("id = ? AND status = ?", order.ID, from).
+		Updates(map[string]interface{}{"status": to, "updated_at": now})
+	if res.Error != nil {
+		return OrderEvent{}, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return OrderEvent{}, ErrOrderChanged
+	}
+	if err := recordTransition(tx, order.ID, from, to, actor, reason); err != nil {
+		return OrderEvent{}, err
+	}
+	var voided []Payment
+	if to == OrderCancelled {
+		var err error
+		if voided, err = cancelOrder(tx, order.ID, from); err != nil {
+			return OrderEvent{}, err
+		}
+	}
+	order.Status = to
+	order.UpdatedAt = now
+	return OrderEvent{OrderID: order.ID, From: from, To: to, Actor: actor, Reason: reason, At: now, Voided: voided}, nil
+}
+
+func recordTransition(tx *gorm.DB, orderID uint, from, to, actor, reason string) error {
+	return tx.Create(&OrderTransition{OrderID: orderID, From: from, To: to, Actor: actor, Reason: reason}).Error
+}
+
+// TransitionOrder wykonuje przejście we własnej transakcji i publikuje zdarzenie
+func TransitionOrder(db *gorm.DB, orderID uint, to, actor, reason string) (*Order, error) {
+	return transitionOrderChecked(db, orderID, to, actor, reason, nil)
+}
+
+// ManualTransitionOrder to przejście zlecone przez obsługę. Anulowanie zwraca towar na stan,
+// ale nie oddaje pieniędzy, więc zamówienia z pobraną płatnością trzeba zwrócić, a nie anulować.
+func ManualTransitionOrder(db *gorm.DB, orderID uint, to, actor, reason string) (*Order, error) {
+	if to == OrderPaid || to == OrderRefunded {
+		return nil, fmt.Errorf("%w: %s", ErrReservedTransition, to)
+	}
+	return transitionOrderChecked(db, orderID, to, actor, reason, func(tx *gorm.DB, order *Order) error {
+		if to != OrderCancelled {
+			return nil
+		}
+		var captured int64
+		if err := tx.Model(&Payment{}).Where("order_id = ? AND status IN ?", order.ID,
+			[]string{PaymentCaptured, PaymentPartiallyRefunded}).Count(&captured).Error; err != nil {
+			return err
+		}
+		if captured > 0 {
+			return ErrOrderCaptured
+		}
+		return nil
+	})
+}
+
+// transitionOrderChecked sprawdza check w tej samej transakcji co przejście,
+// żeby płatność rozliczona w międzyczasie nie ominęła warunku
+func transitionOrderChecked(db *gorm.DB, orderID uint, to, actor, reason string, check func(tx *gorm.DB, order *Order) error) (*Order, error) {
+	var order Order
+	var ev OrderEvent
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&order, orderID).Error; err != nil {
+			return err
+		}
+		if check != nil {
+			if err := check(tx, &order); err != nil {
+				return err
+			}
+		}
+		var err error
+		ev, err = transitionOrder(tx, &order, to, actor, reason)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	orderEvents.Publish(ev)
+	return &order, nil
+}
+
+func createOrderTransition(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	orderID, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	var body struct {
+		To     string `json:"to"`
+		Reason string `json:"reason"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	_, err = ManualTransitionOrder(db, orderID, body.To, requestActor(c), body.Reason)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Order not found")
+	case errors.Is(err, ErrUnknownOrderStatus):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrReservedTransition):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, ErrIllegalTransition), errors.Is(err, ErrOrderChanged), errors.Is(err, ErrOrderCaptured),
+		errors.Is(err, ErrPaymentChanged):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case err != nil:
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not change order status")
+	}
+	return getOrder(c)
+}
+
+func getOrderTransitions(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	var order Order
+	if err := db.First(&order, c.Param("id")).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Order not found")
+	}
+	transitions := []OrderTransition{}
+	if err := db.Where("order_id = ?", order.ID).Order("id").Find(&transitions).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not load order history")
+	}
+	return c.JSON(http.StatusOK, transitions)
+}
+
+// registerOrderEventHandlers podpina reakcje innych części systemu na zmiany statusu
+func registerOrderEventHandlers(db *gorm.DB, gateways Gateways) {
+	orderEvents.Subscribe(func(ev OrderEvent) {
+		log.Printf("order %d: %s -> %s by %s", ev.OrderID, ev.From, ev.To, ev.Actor)
+	})
+	orderEvents.Subscribe(func(ev OrderEvent) {
+		// bramka nie uczestniczy w transakcji anulowania, więc autoryzacje zwalnia się po jej zatwierdzeniu
+		for _, record := range ev.Voided {
+			gateway, err := gateways.Lookup(record.Gateway)
+			if err == nil {
+				err = gateway.Void(context.Background(), record.GatewayReference)
+			}
+			if err != nil {
+				log.Printf("order %d: could not void authorization %s: %v", ev.OrderID, record.GatewayReference, err)
+			}
+		}
+	})
+	orderEvents.Subscribe(func(ev OrderEvent) {
+		if ev.To != OrderDelivered {
+			return
+		}
+		if err := collectCashOnDelivery(db, ev.OrderID); err != nil {
+			log.Printf("order %d: could not record cash on delivery: %v", ev.OrderID, err)
+		}
+	})
+}
+
+// cancelOrder wykonuje skutki anulowania w transakcji przejścia, żeby nie rozjechały się ze statusem:
+// zwalnia towar, unieważnia nierozliczone płatności i otwiera koszyk nieopłaconego zamówienia.
+// Zwraca płatności, których autoryzacje trzeba jeszcze zwolnić w bramce.
+func cancelOrder(tx *gorm.DB, orderID uint, from string) ([]Payment, error) {
+	var order Order
+	if err := tx.Preload("Items").First(&order, orderID).Error; err != nil {
+		return nil, err
+	}
+	if err := releaseCancelledOrderStock(tx, &order, from); err != nil {
+		return nil, err
+	}
+
+	// płatności poza bramką i te, które czekają na klienta, bank lub decyzję obsługi
+	var open []Payment
+	if err := tx.Where("order_id = ? AND status IN ?", order.ID, []string{PaymentOutstanding, PaymentAwaitingTransfer,
+		PaymentInReview, PaymentRequiresAction, PaymentAwaitingConfirmation}).Order("id").Find(&open).Error; err != nil {
+		return nil, err
+	}
+	var held []Payment
+	for i := range open {
+		offline := open[i].Status == PaymentOutstanding || open[i].Status == PaymentAwaitingTransfer
+		if err := updatePaymentStatus(tx, &open[i], PaymentVoided, "order cancelled"); err != nil {
+			return nil, err
+		}
+		if !offline {
+			held = append(held, open[i])
+		}
+	}
+
+	// klient może poprawić koszyk nieopłaconego zamówienia i złożyć nowe, a anulowane zostaje w historii
+	if from == OrderPending {
+		if err := tx.Model(&Cart{}).Where("id = ? AND status = ?", order.CartID, CartCheckedOut).
+			Update("status", CartOpen).Error; err != nil {
+			return nil, err
+		}
+	}
+	return held, nil
+}
+
+// Anulowanie przed płatnością zwalnia rezerwacje, po płatności przywraca stan magazynowy
+func releaseCancelledOrderStock(tx *gorm.DB, order *Order, from string) error {
+	if from == OrderPending {
+		return tx.Model(&Reservation{}).
+			Where("cart_id = ? AND status = ?", order.CartID, ReservationActive).
+			Updates(map[string]interface{}{"status": ReservationReleased, "updated_at": time.Now()}).Error
+	}
+	// pozycje już zwrócone wróciły na stan razem ze zwrotem
+	refunded, err := refundedQuantities(tx, order.ID)
+	if err != nil {
+		return err
+	}
+	quantities := make(map[uint]int, len(order.Items))
+	for _, item := range order.Items {
+		quantities[item.ProductID] += item.Quantity - refunded[item.ID]
+	}
+	return RestockProducts(tx, quantities)
+}
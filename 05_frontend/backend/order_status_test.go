@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func newOrderStatusTestServer(t *testing.T) (*echo.Echo, *gorm.DB, *FakeGateway) {
+	e, db, gateway := newPaymentTestServer(t)
+	e.POST("/orders/:id/transitions", createOrderTransition, AdminOnly)
+	e.GET("/orders/:id/transitions", getOrderTransitions)
+	e.GET("/orders/:id", getOrder)
+	return e, db, gateway
+}
+
+func postTransition(e *echo.Echo, orderID uint, to string) int {
+	return doRequest(e, http.MethodPost, fmt.Sprintf("/orders/%d/transitions", orderID), fmt.Sprintf(`{"to":%q}`, to),
+		adminTokenHeader, testAdminToken).Code
+}
+
+func checkedOutOrder(t *testing.T, db *gorm.DB) (*Order, *Product) {
+	t.Helper()
+	cart, product := newTestCart(t, db, 5, 2)
+	totals, err := ComputeTotals(db, cart)
+	require.NoError(t, err)
+	order, err := CheckoutCart(db, cart, totals, "test")
+	require.NoError(t, err)
+	return order, product
+}
+
+func TestOrderTransitionsFollowStateMachine(t *testing.T) {
+	e, db, gateway := newOrderStatusTestServer(t)
+	_, order, _ := capturedPayment(t, db, gateway, 5, 2)
+
+	assert.Equal(t, http.StatusConflict, postTransition(e, order.ID, OrderDelivered))
+	assert.Equal(t, http.StatusBadRequest, postTransition(e, order.ID, "lost"))
+	for _, to := range []string{OrderPacked, OrderShipped, OrderDelivered} {
+		require.Equal(t, http.StatusOK, postTransition(e, order.ID, to), to)
+	}
+
+	var transitions []OrderTransition
+	require.NoError(t, db.Where("order_id = ?", order.ID).Order("id").Find(&transitions).Error)
+	require.Len(t, transitions, 5)
+	assert.Equal(t, OrderPaid, transitions[1].To)
+	assert.Equal(t, OrderPaid, transitions[2].From)
+	assert.Equal(t, OrderPacked, transitions[2].To)
+	assert.Equal(t, "magazyn", transitions[4].Actor)
+}
+
+func TestOrderTransitionsRejectPaidAndRefunded(t *testing.T) {
+	e, db, gateway := newOrderStatusTestServer(t)
+	pending, _ := checkedOutOrder(t, db)
+	_, paid, _ := capturedPayment(t, db, gateway, 5, 1)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, postTransition(e, pending.ID, OrderPaid))
+	assert.Equal(t, http.StatusUnprocessableEntity, postTransition(e, paid.ID, OrderRefunded))
+
+	require.NoError(t, db.First(pending, pending.ID).Error)
+	assert.Equal(t, OrderPending, pending.Status)
+	var cart Cart
+	require.NoError(t, db.First(&cart, pending.CartID).Error)
+	assert.Equal(t, CartCheckedOut, cart.Status)
+}
+
+func TestCancelCapturedOrderIsRefused(t *testing.T) {
+	e, db, gateway := newOrderStatusTestServer(t)
+	payment, order, product := capturedPayment(t, db, gateway, 5, 2)
+
+	assert.Equal(t, http.StatusConflict, postTransition(e, order.ID, OrderCancelled))
+	assert.Equal(t, 3, productStock(t, db, product.ID), "stock is not returned without a refund")
+
+	// po pełnym zwrocie zamówienie jest refunded, a towar wraca na stan przez zwrot
+	require.Equal(t, http.StatusCreated, postRefund(e, payment.ID, `{}`))
+	require.NoError(t, db.First(order, order.ID).Error)
+	assert.Equal(t, OrderRefunded, order.Status)
+	assert.Equal(t, 5, productStock(t, db, product.ID))
+}
+
+func TestCancelUnpaidOrderReopensCart(t *testing.T) {
+	e, db, _ := newOrderStatusTestServer(t)
+	order, product := checkedOutOrder(t, db)
+
+	require.Equal(t, http.StatusOK, postTransition(e, order.ID, OrderCancelled))
+	var cart Cart
+	require.NoError(t, db.First(&cart, order.CartID).Error)
+	assert.Equal(t, CartOpen, cart.Status)
+	available, err := AvailableStock(db, *product)
+	require.NoError(t, err)
+	assert.Equal(t, 5, *available)
+}
+
+func TestOrderTransitionsRequireAdmin(t *testing.T) {
+	e, db, _ := newOrderStatusTestServer(t)
+	order, _ := checkedOutOrder(t, db)
+	target := fmt.Sprintf("/orders/%d/transitions", order.ID)
+	body := fmt.Sprintf(`{"to":%q}`, OrderCancelled)
+
+	// podany przez klienta actor niczego nie odblokowuje
+	rec := doRequest(e, http.MethodPost, target, body, "X-Actor", "magazyn")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doRequest(e, http.MethodPost, target, body, adminTokenHeader, "zgadniety-token-123")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	require.NoError(t, db.First(order, order.ID).Error)
+	assert.Equal(t, OrderPending, order.Status)
+
+	rec = doRequest(e, http.MethodPost, target, body, adminTokenHeader, testAdminToken, "X-Actor", "ktos-inny")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = doRequest(e, http.MethodGet, target, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var transitions []OrderTransition
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &transitions))
+	require.Len(t, transitions, 2)
+	assert.Equal(t, "magazyn", transitions[1].Actor)
+}
+
+func TestCancelOrderVoidsHeldPayments(t *testing.T) {
+	e, db, gateway := newOrderStatusTestServer(t)
+	cart, product := newTestCart(t, db, 5, 2)
+	review, totals := authorizedCardPayment(t, db, gateway, cart)
+	order, err := CheckoutCart(db, cart, totals, "test")
+	require.NoError(t, err)
+	require.NoError(t, db.Model(review).Updates(map[string]interface{}{"status": PaymentInReview, "order_id": order.ID}).Error)
+	transfer := &Payment{CartID: cart.ID, OrderID: &order.ID, Status: PaymentAwaitingTransfer, Amount: totals.Total,
+		Currency: totals.Currency, Method: PaymentMethodBankTransfer, Gateway: ManualGateway{}.Name()}
+	require.NoError(t, db.Create(transfer).Error)
+
+	require.Equal(t, http.StatusOK, postTransition(e, order.ID, OrderCancelled))
+
+	for _, p := range []*Payment{review, transfer} {
+		require.NoError(t, db.First(p, p.ID).Error)
+		assert.Equal(t, PaymentVoided, p.Status)
+		assert.Equal(t, "order cancelled", p.ErrorReason)
+	}
+	// autoryzacja zwolniona w bramce - nie da się już jej pobrać
+	assert.ErrorIs(t, gateway.Capture(context.Background(), review.GatewayReference, review.Amount), ErrInvalidGatewayState)
+	available, err := AvailableStock(db, *product)
+	require.NoError(t, err)
+	assert.Equal(t, 5, *available)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Zamówienia powstają z koszyka i przechowują kopię danych z chwili zakupu
+// (nazwa, cena, ilość), więc późniejsze zmiany produktów ich nie dotyczą.
+
+const (
+	OrderPending = "pending"
+	OrderPaid    = "paid"
+	// za pobraniem: zamówienie idzie do realizacji przed zapłatą
+	OrderConfirmed = "confirmed"
+	OrderPacked    = "packed"
+	OrderShipped   = "shipped"
+	OrderDelivered = "delivered"
+	OrderCancelled = "cancelled"
+	OrderRefunded  = "refunded"
+)
+
+const (
+	CartCheckedOut = "checked_out"
+	CartConfirmed  = "confirmed"
+)
+
+var ErrOrderImmutable = errors.New("order items cannot be modified")
+
+type Order struct {
+	ID            uint              `gorm:"primaryKey" json:"id"`
+	CartID        uint              `gorm:"uniqueIndex:idx_orders_active_cart,where:status <> 'cancelled'" json:"cart_id"`
+	Status        string            `gorm:"index" json:"status"`
+	Items         []OrderItem       `gorm:"foreignKey:OrderID" json:"items"`
+	Transitions   []OrderTransition `gorm:"foreignKey:OrderID" json:"transitions,omitempty"`
+	Subtotal      Money             `gorm:"embedded;embeddedPrefix:subtotal_" json:"subtotal"`
+	Discount      Money             `gorm:"embedded;embeddedPrefix:discount_" json:"discount"`
+	CouponCode    string            `json:"coupon_code,omitempty"`
+	Shipping      Money             `gorm:"embedded;embeddedPrefix:shipping_" json:"shipping"`
+	Tax           Money             `gorm:"embedded;embeddedPrefix:tax_" json:"tax"`
+	Total         Money             `gorm:"embedded;embeddedPrefix:total_" json:"total"`
+	Currency      string            `json:"currency"`
+	TransactionID string            `json:"transaction_id,omitempty"`
+	PaidAt        *time.Time        `json:"paid_at,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
+
+type OrderItem struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	OrderID   uint      `gorm:"index" json:"order_id"`
+	ProductID uint      `json:"product_id"`
+	Name      string    `json:"name"`
+	UnitPrice Money     `gorm:"embedded;embeddedPrefix:unit_price_" json:"unit_price"`
+	Quantity  int       `json:"quantity"`
+	LineTotal Money     `gorm:"embedded;embeddedPrefix:line_total_" json:"line_total"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (OrderItem) BeforeUpdate(tx *gorm.DB) error {
+	return ErrOrderImmutable
+}
+
+func (OrderItem) BeforeDelete(tx *gorm.DB) error {
+	return ErrOrderImmutable
+}
+
+type OrderPage struct {
+	Data    []Order `json:"data"`
+	Total   int64   `json:"total"`
+	Page    int     `json:"page"`
+	PerPage int     `json:"per_page"`
+}
+
+// CreateOrderFromCart zapisuje zamówienie z kopią pozycji i sum koszyka
+func CreateOrderFromCart(tx *gorm.DB, cart *Cart, totals *CartTotals, actor string) (*Order, error) {
+	order := Order{
+		CartID:     cart.ID,
+		Status:     OrderPending,
+		Subtotal:   totals.Subtotal,
+		Discount:   totals.Discount,
+		CouponCode: totals.CouponCode,
+		Shipping:   totals.Shipping,
+		Tax:        totals.Tax,
+		Total:      totals.Total,
+		Currency:   totals.Currency,
+	}
+	for _, item := range cart.Items {
+		order.Items = append(order.Items, OrderItem{
+			ProductID: item.ProductID,
+			Name:      item.Product.Name,
+			UnitPrice: item.UnitPrice,
+			Quantity:  item.Quantity,
+			LineTotal: item.LineTotal,
+		})
+	}
+	if err := tx.Create(&order).Error; err != nil {
+		return nil, err
+	}
+	if err := recordTransition(tx, order.ID, "", OrderPending, actor, ""); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func FilterOrderStatus(status string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if status == "" {
+			return db
+		}
+		return db.Where("orders.status = ?", status)
+	}
+}
+
+// findOrderByCart zwraca bieżące zamówienie koszyka; anulowane zamówienia zostają w historii,
+// a koszyk wraca do edycji i może dostać kolejne zamówienie
+func findOrderByCart(db *gorm.DB, cartID uint) (*Order, error) {
+	var order Order
+	if err := db.Preload("Items").Where("cart_id = ? AND status <> ?", cartID, OrderCancelled).Take(&order).Error; err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// paymentOrder zwraca zamówienie, dla którego rozpoczęto płatność - także anulowane,
+// żeby spóźnione potwierdzenie nie opłaciło koszyka otwartego ponownie po anulowaniu
+func paymentOrder(db *gorm.DB, record *Payment) (*Order, error) {
+	if record.OrderID == nil {
+		return findOrderByCart(db, record.CartID)
+	}
+	var order Order
+	if err := db.Preload("Items").First(&order, *record.OrderID).Error; err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// MigrateOrderCartIndex usuwa dawny unikalny indeks orders.cart_id, który blokował
+// ponowne złożenie zamówienia z koszyka po anulowaniu poprzedniego
+func MigrateOrderCartIndex(db *gorm.DB) error {
+	if !db.Migrator().HasIndex(&Order{}, "idx_orders_cart_id") {
+		return nil
+	}
+	return db.Migrator().DropIndex(&Order{}, "idx_orders_cart_id")
+}
+
+// CheckoutCart zamyka otwarty koszyk i tworzy dla niego zamówienie oczekujące na płatność
+func CheckoutCart(db *gorm.DB, cart *Cart, totals *CartTotals, actor string) (*Order, error) {
+	var order *Order
+	err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&Cart{}).Where("id = ? AND status = ?", cart.ID, CartOpen).Update("status", CartCheckedOut)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrCartLocked
+		}
+		var err error
+		order, err = CreateOrderFromCart(tx, cart, totals, actor)
+		return err
+	})
+	return order, err
+}
+
+// Zamyka koszyk i tworzy zamówienie oczekujące na płatność
+func checkoutCart(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	cartID, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	cart, err := loadCart(db, cartID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Cart not found")
+	}
+	if cart.Status != "" && cart.Status != CartOpen {
+		if order, err := findOrderByCart(db, cart.ID); err == nil {
+			return c.JSON(http.StatusOK, order)
+		}
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Cart is already paid")
+	}
+	if len(cart.Items) == 0 {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Cart is empty")
+	}
+	totals, err := ComputeTotals(db, cart)
+	if err != nil {
+		return totalsError(err)
+	}
+
+	order, err := CheckoutCart(db, cart, totals, requestActor(c))
+	if errors.Is(err, ErrCartLocked) {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Cart is already checked out")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not create order")
+	}
+	return c.JSON(http.StatusCreated, order)
+}
+
+func getOrder(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	var order Order
+	err := db.Preload("Items").Preload("Transitions", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		First(&order, c.Param("id")).Error
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Order not found")
+	}
+	return c.JSON(http.StatusOK, order)
+}
+
+func getAllOrders(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+
+	page, perPage := 1, defaultPerPage
+	if v := c.QueryParam("page"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid page")
+		}
+		page = p
+	}
+	if v := c.QueryParam("per_page"); v != "" {
+		pp, err := strconv.Atoi(v)
+		if err != nil || pp < 1 || pp > maxPerPage {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid per_page")
+		}
+		perPage = pp
+	}
+
+	status := c.QueryParam("status")
+	var total int64
+	if err := db.Model(&Order{}).Scopes(FilterOrderStatus(status)).Count(&total).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not count orders")
+	}
+	orders := []Order{}
+	if err := db.Preload("Items").Scopes(FilterOrderStatus(status), Paginate(page, perPage)).
+		Order("id DESC").Find(&orders).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch orders")
+	}
+	return c.JSON(http.StatusOK, OrderPage{Data: orders, Total: total, Page: page, PerPage: perPage})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func newOrderTestServer(t *testing.T) (*echo.Echo, *gorm.DB) {
+	db := newTestDB(t, schemaModels...)
+	e := echo.New()
+	e.Use(DBMiddleware(db))
+	e.POST("/carts/:id/checkout", checkoutCart)
+	e.POST("/carts/:id/items", addCartItem)
+	e.GET("/orders", getAllOrders)
+	e.GET("/orders/:id", getOrder)
+	return e, db
+}
+
+func decodeOrder(t *testing.T, body []byte) Order {
+	t.Helper()
+	var order Order
+	require.NoError(t, json.Unmarshal(body, &order))
+	return order
+}
+
+func TestCheckoutSnapshotsCart(t *testing.T) {
+	e, db := newOrderTestServer(t)
+	cart, product := newTestCart(t, db, 10, 2)
+
+	rec := doRequest(e, http.MethodPost, fmt.Sprintf("/carts/%d/checkout", cart.ID), "")
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	order := decodeOrder(t, rec.Body.Bytes())
+	assert.Equal(t, OrderPending, order.Status)
+	assert.Equal(t, cart.ID, order.CartID)
+	assert.Equal(t, NewMoney(5000, "PLN"), order.Subtotal)
+	assert.Equal(t, NewMoney(6500, "PLN"), order.Total)
+	require.Len(t, order.Items, 1)
+	assert.Equal(t, "Kubek", order.Items[0].Name)
+	assert.Equal(t, 2, order.Items[0].Quantity)
+
+	// późniejsza zmiana produktu nie zmienia zamówienia
+	require.NoError(t, db.Model(product).Updates(map[string]interface{}{"name": "Kubek XL", "price_amount": 9900}).Error)
+	rec = doRequest(e, http.MethodGet, fmt.Sprintf("/orders/%d", order.ID), "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	stored := decodeOrder(t, rec.Body.Bytes())
+	assert.Equal(t, "Kubek", stored.Items[0].Name)
+	assert.Equal(t, NewMoney(2500, "PLN"), stored.Items[0].UnitPrice)
+	require.Len(t, stored.Transitions, 1)
+	assert.Equal(t, OrderPending, stored.Transitions[0].To)
+
+	// powtórny checkout zwraca to samo zamówienie, a koszyk jest zamknięty
+	rec = doRequest(e, http.MethodPost, fmt.Sprintf("/carts/%d/checkout", cart.ID), "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, order.ID, decodeOrder(t, rec.Body.Bytes()).ID)
+	rec = doRequest(e, http.MethodPost, fmt.Sprintf("/carts/%d/items", cart.ID), fmt.Sprintf(`{"product_id":%d}`, product.ID))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+}
+
+func TestOrderItemsAreImmutable(t *testing.T) {
+	_, db := newOrderTestServer(t)
+	cart, _ := newTestCart(t, db, 10, 1)
+	totals, err := ComputeTotals(db, cart)
+	require.NoError(t, err)
+	order, err := CheckoutCart(db, cart, totals, "test")
+	require.NoError(t, err)
+
+	item := order.Items[0]
+	assert.ErrorIs(t, db.Model(&item).Update("quantity", 5).Error, ErrOrderImmutable)
+	assert.ErrorIs(t, db.Delete(&item).Error, ErrOrderImmutable)
+}
+
+func TestCheckoutRejectsEmptyCart(t *testing.T) {
+	e, db := newOrderTestServer(t)
+	cart := Cart{}
+	require.NoError(t, db.Create(&cart).Error)
+
+	rec := doRequest(e, http.MethodPost, fmt.Sprintf("/carts/%d/checkout", cart.ID), "")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	rec = doRequest(e, http.MethodPost, "/carts/999999/checkout", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestListOrdersFiltersByStatus(t *testing.T) {
+	e, db := newOrderTestServer(t)
+	for i := 0; i < 3; i++ {
+		cart, _ := newTestCart(t, db, 10, 1)
+		totals, err := ComputeTotals(db, cart)
+		require.NoError(t, err)
+		_, err = CheckoutCart(db, cart, totals, "test")
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Model(&Order{}).Where("id = ?", 1).Update("status", OrderCancelled).Error)
+
+	rec := doRequest(e, http.MethodGet, "/orders?status=pending&per_page=1", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var page OrderPage
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	assert.Equal(t, int64(2), page.Total)
+	require.Len(t, page.Data, 1)
+	assert.Equal(t, uint(3), page.Data[0].ID)
+}
@@ -0,0 +1,727 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Płatności kartą przez PaymentGateway: autoryzacja przed zapisem w bazie, potem capture
+// poza transakcją i rozliczenie zamówienia (captureAuthorizedPayment).
+
+const (
+	PaymentMethodCard = "card"
+	PaymentMethodBlik = "blik"
+	// przelew online na stronie operatora (PayU, Przelewy24)
+	PaymentMethodRedirect = "redirect"
+	// płatności poza bramką, patrz offline_payments.go
+	PaymentMethodCashOnDelivery = "cash_on_delivery"
+	PaymentMethodBankTransfer   = "bank_transfer"
+)
+
+const (
+	PaymentPending    = "pending"
+	PaymentAuthorized = "authorized"
+	PaymentCaptured   = "captured"
+	PaymentFailed     = "failed"
+	PaymentVoided     = "voided"
+	// capture wysłany do bramki, rozliczenie zamówienia jeszcze niezapisane
+	PaymentCapturing = "capturing"
+	// BLIK i przekierowanie: czekamy, aż klient potwierdzi płatność u banku lub operatora
+	PaymentAwaitingConfirmation = "awaiting_confirmation"
+	// za pobraniem: zamówienie potwierdzone, pieniądze pobierze kurier przy doręczeniu
+	PaymentOutstanding = "outstanding"
+	// przelew tradycyjny: czekamy na wpłatę z podanym tytułem
+	PaymentAwaitingTransfer = "awaiting_transfer"
+	// ocena ryzyka: autoryzowana płatność czeka na decyzję obsługi albo została zablokowana
+	PaymentInReview = "in_review"
+	PaymentBlocked  = "blocked"
+	// 3-D Secure: autoryzacja czeka, aż klient przejdzie stronę uwierzytelnienia banku
+	PaymentRequiresAction = "requires_action"
+
+	PaymentPartiallyRefunded = "partially_refunded"
+	PaymentRefunded          = "refunded"
+)
+
+var (
+	// ErrPaymentUnsettled: środki pobrano, ale koszyka nie dało się już rozliczyć (wymaga zwrotu)
+	ErrPaymentUnsettled = errors.New("payment captured but order could not be settled")
+	// ErrPaymentChanged: status płatności zmienił się w międzyczasie (np. wygasła albo rozliczono ją równolegle)
+	ErrPaymentChanged = errors.New("payment status changed concurrently")
+)
+
+// Payment to ślad każdej próby płatności, także nieudanej
+type Payment struct {
+	ID               uint                  `gorm:"primaryKey" json:"id"`
+	CartID           uint                  `gorm:"index" json:"cart_id"`
+	OrderID          *uint                 `gorm:"index" json:"order_id,omitempty"`
+	CustomerID       *uint                 `gorm:"index" json:"customer_id,omitempty"`
+	Status           string                `gorm:"index" json:"status"`
+	Amount           Money                 `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	Currency         string                `json:"currency"`
+	Method           string                `gorm:"default:card" json:"method"`
+	CardToken        string                `json:"-"`
+	CardBrand        string                `json:"card_brand,omitempty"`
+	CardMasked       string                `json:"card_masked,omitempty"`
+	CardFingerprint  string                `gorm:"index" json:"-"`
+	CardExpMonth     int                   `json:"card_exp_month,omitempty"`
+	CardExpYear      int                   `json:"card_exp_year,omitempty"`
+	SaveCard         bool                  `json:"-"`
+	Gateway          string                `json:"gateway"`
+	GatewayReference string                `gorm:"index" json:"gateway_reference,omitempty"`
+	ErrorReason      string                `json:"error_reason,omitempty"`
+	ExpiresAt        *time.Time            `json:"expires_at,omitempty"`
+	RedirectURL      string                `json:"redirect_url,omitempty"`
+	Transfer         *TransferInstructions `gorm:"-" json:"transfer,omitempty"`
+	CapturedAt       *time.Time            `json:"captured_at,omitempty"`
+	Refunds          []Refund              `gorm:"foreignKey:PaymentID" json:"refunds,omitempty"`
+	CreatedAt        time.Time             `json:"created_at"`
+	UpdatedAt        time.Time             `json:"updated_at"`
+}
+
+type PaymentRequest struct {
+	CartID     uint   `json:"cart_id"`
+	Method     string `json:"method"`
+	BlikCode   string `json:"blik_code"`
+	CardNumber string `json:"card_number"`
+	ExpMonth   int    `json:"exp_month"`
+	ExpYear    int    `json:"exp_year"`
+	CVC        string `json:"cvc"`
+	// zapisana karta zalogowanego klienta zamiast danych karty
+	PaymentMethodID uint  `json:"payment_method_id"`
+	SaveCard        bool  `json:"save_card"`
+	Amount          Money `json:"amount"`
+}
+
+// GatewayMiddleware udostępnia domyślną bramkę ("gateway") i wszystkie skonfigurowane ("gateways")
+func GatewayMiddleware(gateways Gateways) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("gateway", gateways.Default())
+			c.Set("gateways", gateways)
+			return next(c)
+		}
+	}
+}
+
+// gatewayError tłumaczy odmowy bramki na odpowiedzi HTTP
+func gatewayError(err error) error {
+	switch {
+	case errors.Is(err, ErrPaymentDeclined):
+		return echo.NewHTTPError(http.StatusPaymentRequired, "Payment declined")
+	case errors.Is(err, ErrInsufficientFunds):
+		return echo.NewHTTPError(http.StatusPaymentRequired, "Insufficient funds")
+	case errors.Is(err, ErrGatewayTimeout), errors.Is(err, context.DeadlineExceeded):
+		return echo.NewHTTPError(http.StatusGatewayTimeout, "Payment gateway timeout")
+	case errors.Is(err, ErrUnknownCardToken):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Invalid card token")
+	case errors.Is(err, ErrGatewayNotConfigured):
+		return echo.NewHTTPError(http.StatusConflict, "Payment gateway of this payment is not configured")
+	}
+	return echo.NewHTTPError(http.StatusBadGateway, "Payment gateway error")
+}
+
+// cardError tłumaczy błędy walidacji karty na odpowiedzi HTTP
+func cardError(err error) error {
+	switch {
+	case errors.Is(err, ErrInvalidCardNumber):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Invalid card number")
+	case errors.Is(err, ErrUnsupportedCard):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Unsupported card brand")
+	case errors.Is(err, ErrInvalidExpiry):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Invalid expiry date")
+	case errors.Is(err, ErrCardExpired):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Card expired")
+	case errors.Is(err, ErrInvalidCVC):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Invalid CVC")
+	}
+	return echo.NewHTTPError(http.StatusUnprocessableEntity, "Invalid card")
+}
+
+// Funkcja obsługującą płatności
+func processPayment(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	gateway := c.Get("gateway").(PaymentGateway)
+	payment := new(PaymentRequest)
+
+	if err := c.Bind(payment); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid payment data")
+	}
+	var card *CardDetails
+	var saved *SavedPaymentMethod
+	var err error
+	switch payment.Method {
+	case "", PaymentMethodCard:
+		if payment.PaymentMethodID != 0 {
+			if saved, err = customerPaymentMethod(c, payment.PaymentMethodID); err != nil {
+				return err
+			}
+			if saved.Expired(time.Now().UTC()) {
+				return cardError(ErrCardExpired)
+			}
+			// token działa tylko w bramce, która go wydała
+			if gateway, err = c.Get("gateways").(Gateways).Lookup(saved.Gateway); err != nil {
+				return gatewayError(err)
+			}
+			break
+		}
+		if payment.SaveCard && currentCustomer(c) == nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Customer token required to save a card")
+		}
+		card, err = ValidateCard(payment.CardNumber, payment.ExpMonth, payment.ExpYear, payment.CVC, time.Now().UTC())
+		// numer karty nie jest potrzebny nigdzie poza walidacją i tokenizacją
+		payment.CardNumber, payment.CVC = "", ""
+		if err != nil {
+			return cardError(err)
+		}
+	case PaymentMethodBlik:
+		if !validBlikCode(payment.BlikCode) {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, "BLIK code must have 6 digits")
+		}
+	case PaymentMethodRedirect, PaymentMethodCashOnDelivery, PaymentMethodBankTransfer:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "Unsupported payment method")
+	}
+
+	cart, err := loadCart(db, payment.CartID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Cart not found")
+	}
+	if cart.Status == CartPaid {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Cart is already paid")
+	}
+	if cart.Status == CartConfirmed {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Cart is already confirmed for cash on delivery")
+	}
+	if len(cart.Items) == 0 {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Cart is empty")
+	}
+	// zamówienie z checkoutu ma zamrożone sumy; bez checkoutu liczymy je z koszyka
+	order, err := findOrderByCart(db, cart.ID)
+	var totals *CartTotals
+	if err != nil {
+		if totals, err = ComputeTotals(db, cart); err != nil {
+			return totalsError(err)
+		}
+	}
+	expected := orderOrCartTotal(order, totals)
+	// ocena ryzyka przed sprawdzeniem kwoty, bo błędne kwoty też są sygnałem
+	var assessment *FraudAssessment
+	if card != nil || saved != nil {
+		fingerprint := ""
+		if saved != nil {
+			fingerprint = savedCardFingerprint(saved.ID)
+		} else {
+			fingerprint = cardFingerprint(card.Number)
+		}
+		if assessment, err = AssessPayment(db, FraudInput{
+			IP:              c.RealIP(),
+			CartID:          cart.ID,
+			CardFingerprint: fingerprint,
+			Amount:          payment.Amount,
+			Expected:        expected,
+		}); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not assess payment risk")
+		}
+	}
+	if payment.Amount.Currency != expected.Currency || payment.Amount.Amount != expected.Amount {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity,
+			fmt.Sprintf("Payment amount %s does not match cart total %s", payment.Amount, expected))
+	}
+	if err := ensureNoAwaitingPayment(db, c.Get("gateways").(Gateways), cart.ID); err != nil {
+		return err
+	}
+	switch payment.Method {
+	case PaymentMethodBlik:
+		return startBlikPayment(c, cart, order, totals, expected, payment.BlikCode)
+	case PaymentMethodRedirect:
+		return startRedirectPayment(c, cart, order, totals, expected)
+	case PaymentMethodCashOnDelivery:
+		return startCashOnDelivery(c, cart, order, totals, expected)
+	case PaymentMethodBankTransfer:
+		return startBankTransfer(c, cart, order, totals, expected)
+	}
+
+	record := &Payment{
+		CartID:          cart.ID,
+		Status:          PaymentPending,
+		Amount:          expected,
+		Currency:        expected.Currency,
+		CardFingerprint: assessment.CardFingerprint,
+		Method:          PaymentMethodCard,
+		Gateway:         gateway.Name(),
+		SaveCard:        payment.SaveCard,
+	}
+	if customer := currentCustomer(c); customer != nil {
+		record.CustomerID = &customer.ID
+	}
+	if saved != nil {
+		record.CardToken = saved.Token
+		record.CardBrand, record.CardMasked = saved.CardBrand, saved.CardMasked
+		record.CardExpMonth, record.CardExpYear = saved.ExpMonth, saved.ExpYear
+		record.SaveCard = false
+	} else {
+		record.CardBrand, record.CardMasked = card.Brand, card.Masked()
+		record.CardExpMonth, record.CardExpYear = card.ExpMonth, card.ExpYear
+	}
+	if assessment.Decision == FraudBlock {
+		record.Status = PaymentBlocked
+		record.ErrorReason = assessment.Reasons()
+		if order != nil {
+			record.OrderID = &order.ID
+		}
+		if err := db.Create(record).Error; err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not record payment")
+		}
+		linkAssessment(db, assessment, record.ID)
+		return echo.NewHTTPError(http.StatusForbidden, "Payment was blocked by fraud checks")
+	}
+	// płatność do przeglądu czeka na zamkniętym koszyku, żeby sumy się nie zmieniły
+	if assessment.Decision == FraudReview && order == nil {
+		if order, err = CheckoutCart(db, cart, totals, "payments"); err != nil {
+			if errors.Is(err, ErrCartLocked) {
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, "Cart can no longer be modified")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not create order")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), paymentGatewayTimeout)
+	defer cancel()
+	if card != nil {
+		if record.CardToken, err = gateway.Tokenize(ctx, *card); err != nil {
+			return gatewayError(err)
+		}
+	}
+	if order != nil {
+		record.OrderID = &order.ID
+	}
+	if err := db.Create(record).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not record payment")
+	}
+	linkAssessment(db, assessment, record.ID)
+
+	auth, err := gateway.Authorize(ctx, AuthorizeRequest{
+		CardToken: record.CardToken,
+		Amount:    expected,
+		Reference: fmt.Sprintf("payment-%d", record.ID),
+	})
+	if err != nil {
+		failPayment(db, record, PaymentFailed, err)
+		return gatewayError(err)
+	}
+	if auth.ChallengeURL != "" {
+		return startChallenge(c, gateway, record, cart, order, totals, auth)
+	}
+	record.Status = PaymentAuthorized
+	record.GatewayReference = auth.Reference
+	if err := db.Model(record).Updates(map[string]interface{}{"status": record.Status, "gateway_reference": auth.Reference}).Error; err != nil {
+		log.Printf("payments: could not update payment %d: %v", record.ID, err)
+	}
+
+	if assessment.Decision == FraudReview {
+		record.Status = PaymentInReview
+		if err := db.Model(record).Update("status", record.Status).Error; err != nil {
+			log.Printf("payments: could not update payment %d: %v", record.ID, err)
+		}
+		return c.JSON(http.StatusAccepted, record)
+	}
+
+	if order, err = captureAuthorizedPayment(ctx, db, gateway, record, cart, order, totals, "payments"); err != nil {
+		return captureError(err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status":         "success",
+		"payment_id":     record.ID,
+		"card_brand":     record.CardBrand,
+		"card_masked":    record.CardMasked,
+		"gateway":        gateway.Name(),
+		"transaction_id": auth.Reference,
+		"cart_id":        payment.CartID,
+		"order_id":       order.ID,
+		"amount":         order.Total,
+	})
+}
+
+// captureAuthorizedPayment pobiera autoryzowane środki i rozlicza zamówienie. Bramka jest wywoływana
+// poza transakcją, żeby nie trzymać blokady zapisu SQLite przez całe wywołanie: najpierw płatność
+// przechodzi w capturing (co zajmuje koszyk), potem capture, a na końcu rozliczenie. Błąd przed
+// pobraniem anuluje autoryzację; po udanym capture płatność zostaje pobrana nawet wtedy,
+// gdy zamówienia nie da się już rozliczyć (ErrPaymentUnsettled, wymaga ręcznego zwrotu).
+func captureAuthorizedPayment(ctx context.Context, db *gorm.DB, gateway PaymentGateway, record *Payment, cart *Cart, order *Order, totals *CartTotals, actor string) (*Order, error) {
+	err := beginCapture(db, record, cart.ID)
+	if err == nil {
+		err = gateway.Capture(ctx, record.GatewayReference, record.Amount)
+	}
+	if err != nil {
+		status := PaymentVoided
+		if voidErr := gateway.Void(context.Background(), record.GatewayReference); voidErr != nil {
+			log.Printf("payments: could not void authorization %s: %v", record.GatewayReference, voidErr)
+			status = PaymentFailed
+		}
+		failPayment(db, record, status, err)
+		return nil, err
+	}
+
+	var paidEvent OrderEvent
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		order, paidEvent, err = settlePayment(tx, record, cart, order, totals, actor)
+		return err
+	})
+	if err != nil {
+		log.Printf("payments: payment %d captured but cart %d could not be settled: %v", record.ID, cart.ID, err)
+		now := time.Now()
+		record.Status = PaymentCaptured
+		record.CapturedAt = &now
+		record.ErrorReason = err.Error()
+		if dbErr := db.Model(record).Updates(map[string]interface{}{
+			"status": record.Status, "captured_at": now, "error_reason": record.ErrorReason,
+		}).Error; dbErr != nil {
+			log.Printf("payments: could not update payment %d: %v", record.ID, dbErr)
+		}
+		return nil, fmt.Errorf("%w: %w", ErrPaymentUnsettled, err)
+	}
+	orderEvents.Publish(paidEvent)
+	saveCardFromPayment(db, record)
+	return order, nil
+}
+
+// beginCapture oznacza płatność jako capturing, o ile koszyk można jeszcze opłacić i żadna
+// inna płatność nie jest w trakcie pobierania - dwie karty nie mogą zapłacić za ten sam koszyk
+func beginCapture(db *gorm.DB, record *Payment, cartID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var cart Cart
+		if err := tx.Select("id", "status").First(&cart, cartID).Error; err != nil {
+			return err
+		}
+		if cart.Status != "" && cart.Status != CartOpen && cart.Status != CartCheckedOut {
+			return ErrCartLocked
+		}
+		var capturing int64
+		if err := tx.Model(&Payment{}).Where("cart_id = ? AND status = ? AND id <> ?", cartID, PaymentCapturing, record.ID).
+			Count(&capturing).Error; err != nil {
+			return err
+		}
+		if capturing > 0 {
+			return ErrCartLocked
+		}
+		res := tx.Model(&Payment{}).Where("id = ? AND status IN ?", record.ID, []string{PaymentAuthorized, PaymentInReview}).
+			Update("status", PaymentCapturing)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInvalidGatewayState
+		}
+		record.Status = PaymentCapturing
+		return nil
+	})
+}
+
+func captureError(err error) error {
+	switch {
+	case errors.Is(err, ErrPaymentUnsettled):
+		return echo.NewHTTPError(http.StatusConflict, "Payment was captured but the order could not be completed, it will be refunded")
+	case errors.Is(err, ErrCartLocked):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Cart is already paid")
+	case errors.Is(err, ErrInsufficientStock):
+		return echo.NewHTTPError(http.StatusConflict, "Insufficient stock")
+	case errors.Is(err, ErrIllegalTransition), errors.Is(err, ErrOrderChanged):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Order can no longer be paid")
+	case errors.Is(err, ErrGatewayTimeout), errors.Is(err, context.DeadlineExceeded):
+		return gatewayError(err)
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, "Could not finalize payment")
+}
+
+// settlePayment oznacza płatność jako pobraną: zamyka koszyk, zdejmuje towar ze stanu
+// i przestawia zamówienie (tworzone, jeśli koszyk nie przeszedł checkoutu) na opłacone.
+// Wywoływane wewnątrz transakcji; zdarzenie należy opublikować po jej zatwierdzeniu.
+func settlePayment(tx *gorm.DB, record *Payment, cart *Cart, order *Order, totals *CartTotals, actor string) (*Order, OrderEvent, error) {
+	// warunkowa zmiana statusu chroni przed podwójnym opłaceniem tego samego koszyka
+	now := time.Now()
+	res := tx.Model(&Cart{}).Where("id = ? AND status IN ?", cart.ID, []string{CartOpen, CartCheckedOut}).
+		Updates(map[string]interface{}{"status": CartPaid, "paid_at": now})
+	if res.Error != nil {
+		return nil, OrderEvent{}, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, OrderEvent{}, ErrCartLocked
+	}
+	if err := CommitReservations(tx, cart.ID, cart.Quantities()); err != nil {
+		return nil, OrderEvent{}, err
+	}
+	var err error
+	if order == nil {
+		if order, err = CreateOrderFromCart(tx, cart, totals, actor); err != nil {
+			return nil, OrderEvent{}, err
+		}
+	}
+	event, err := transitionOrder(tx, order, OrderPaid, actor, "")
+	if err != nil {
+		return nil, OrderEvent{}, err
+	}
+	order.PaidAt = &now
+	order.TransactionID = record.GatewayReference
+	if err := tx.Model(order).Updates(map[string]interface{}{"paid_at": now, "transaction_id": record.GatewayReference}).Error; err != nil {
+		return nil, OrderEvent{}, err
+	}
+	res = tx.Model(&Payment{}).Where("id = ? AND status = ?", record.ID, record.Status).
+		Updates(map[string]interface{}{"status": PaymentCaptured, "order_id": order.ID, "captured_at": now})
+	if res.Error != nil {
+		return nil, OrderEvent{}, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, OrderEvent{}, ErrPaymentChanged
+	}
+	record.Status = PaymentCaptured
+	record.OrderID = &order.ID
+	record.CapturedAt = &now
+	return order, event, nil
+}
+
+// AwaitsConfirmation mówi, czy płatność czeka na potwierdzenie operatora (BLIK, przekierowanie).
+// Autoryzację karty pobiera sam sklep przez Capture, więc potwierdzenie z zewnątrz jej nie rozlicza.
+func (p *Payment) AwaitsConfirmation() bool {
+	if p.Method != PaymentMethodBlik && p.Method != PaymentMethodRedirect {
+		return false
+	}
+	return p.Status == PaymentPending || p.Status == PaymentAwaitingConfirmation
+}
+
+// settlePendingPayment rozlicza płatność potwierdzoną asynchronicznie (webhook, BLIK).
+// Gdy koszyka nie da się już opłacić, płatność zostaje pobrana z opisem błędu
+// i wynikiem "unsettled" - taka wpłata wymaga ręcznego zwrotu.
+func settlePendingPayment(tx *gorm.DB, record *Payment, actor string) (string, *OrderEvent, error) {
+	cart, err := loadCart(tx, record.CartID)
+	if err != nil {
+		return "", nil, err
+	}
+	order, err := paymentOrder(tx, record)
+	var totals *CartTotals
+	if err != nil {
+		if totals, err = ComputeTotals(tx, cart); err != nil {
+			return "", nil, err
+		}
+	}
+	var paidEvent OrderEvent
+	// savepoint: nieudane rozliczenie nie może zostawić częściowych zmian w koszyku
+	err = tx.Transaction(func(sp *gorm.DB) error {
+		_, paidEvent, err = settlePayment(sp, record, cart, order, totals, actor)
+		return err
+	})
+	if errors.Is(err, ErrCartLocked) || errors.Is(err, ErrInsufficientStock) ||
+		errors.Is(err, ErrIllegalTransition) || errors.Is(err, ErrOrderChanged) {
+		log.Printf("payments: payment %d captured but cart %d could not be settled: %v", record.ID, cart.ID, err)
+		if err := updatePaymentStatus(tx, record, PaymentCaptured, err.Error()); err != nil {
+			return "", nil, err
+		}
+		return "unsettled", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return PaymentCaptured, &paidEvent, nil
+}
+
+func failPendingPayment(tx *gorm.DB, record *Payment, reason string) error {
+	return updatePaymentStatus(tx, record, PaymentFailed, reason)
+}
+
+// updatePaymentStatus zmienia status tylko wtedy, gdy w bazie jest nadal ten wczytany do record,
+// więc równoległe potwierdzenie lub wygaśnięcie nie nadpisze już rozstrzygniętej płatności
+func updatePaymentStatus(tx *gorm.DB, record *Payment, status, reason string) error {
+	res := tx.Model(&Payment{}).Where("id = ? AND status = ?", record.ID, record.Status).
+		Updates(map[string]interface{}{"status": status, "error_reason": reason})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrPaymentChanged
+	}
+	record.Status = status
+	record.ErrorReason = reason
+	return nil
+}
+
+// beginAwaitingPayment zamyka koszyk (jeśli nie przeszedł checkoutu), żeby sumy nie zmieniły się
+// w trakcie oczekiwania na klienta, i zapisuje płatność jako pending
+func beginAwaitingPayment(db *gorm.DB, cart *Cart, order *Order, totals *CartTotals, amount Money, method, gateway string) (*Payment, error) {
+	if order == nil {
+		var err error
+		if order, err = CheckoutCart(db, cart, totals, "payments"); err != nil {
+			if errors.Is(err, ErrCartLocked) {
+				return nil, echo.NewHTTPError(http.StatusUnprocessableEntity, "Cart can no longer be modified")
+			}
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "Could not create order")
+		}
+	}
+	record := &Payment{
+		CartID:   cart.ID,
+		OrderID:  &order.ID,
+		Status:   PaymentPending,
+		Amount:   amount,
+		Currency: amount.Currency,
+		Method:   method,
+		Gateway:  gateway,
+	}
+	if err := db.Create(record).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Could not record payment")
+	}
+	return record, nil
+}
+
+// markPaymentAwaiting zapisuje referencję bramki i termin, po którym płatność wygaśnie
+func markPaymentAwaiting(db *gorm.DB, record *Payment, reference string, timeout time.Duration) error {
+	expiresAt := time.Now().Add(timeout)
+	record.Status = PaymentAwaitingConfirmation
+	record.GatewayReference = reference
+	record.ExpiresAt = &expiresAt
+	return db.Model(record).Updates(map[string]interface{}{
+		"status": record.Status, "gateway_reference": reference, "expires_at": expiresAt, "redirect_url": record.RedirectURL,
+	}).Error
+}
+
+// ensureNoAwaitingPayment nie pozwala zapłacić drugi raz, dopóki klient może jeszcze
+// dokończyć wcześniejszą płatność (BLIK, przekierowanie, 3-D Secure, przelew) dla tego koszyka.
+// Oczekujący przelew znika dopiero po anulowaniu zamówienia lub upływie terminu wpłaty.
+func ensureNoAwaitingPayment(db *gorm.DB, gateways Gateways, cartID uint) error {
+	var awaiting []Payment
+	if err := db.Where("cart_id = ? AND status IN ?", cartID, []string{PaymentAwaitingConfirmation, PaymentRequiresAction, PaymentInReview, PaymentAwaitingTransfer, PaymentCapturing}).Find(&awaiting).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not check pending payments")
+	}
+	for i := range awaiting {
+		switch awaiting[i].Status {
+		case PaymentCapturing:
+			return echo.NewHTTPError(http.StatusConflict, "A payment for this cart is being captured")
+		case PaymentInReview:
+			return echo.NewHTTPError(http.StatusConflict, "A payment for this cart is under review")
+		case PaymentAwaitingTransfer:
+			return echo.NewHTTPError(http.StatusConflict, "A bank transfer for this cart is still awaited, cancel the order to pay another way")
+		}
+		if !expireAwaitingPayment(db, gateways, &awaiting[i]) {
+			return echo.NewHTTPError(http.StatusConflict, "A payment for this cart is already awaiting confirmation")
+		}
+	}
+	return nil
+}
+
+// expireAwaitingPayment oznacza niedokończoną płatność jako nieudaną po upływie limitu;
+// zwraca true, jeśli płatność nie czeka już na potwierdzenie
+func expireAwaitingPayment(db *gorm.DB, gateways Gateways, record *Payment) bool {
+	if record.Status != PaymentAwaitingConfirmation && record.Status != PaymentRequiresAction {
+		return true
+	}
+	if record.ExpiresAt == nil || time.Now().Before(*record.ExpiresAt) {
+		return false
+	}
+	res := db.Model(&Payment{}).Where("id = ? AND status = ?", record.ID, record.Status).
+		Updates(map[string]interface{}{"status": PaymentFailed, "error_reason": "payment confirmation timed out"})
+	if res.Error != nil {
+		log.Printf("payments: could not expire payment %d: %v", record.ID, res.Error)
+		return false
+	}
+	if res.RowsAffected > 0 {
+		gateway, err := gateways.Lookup(record.Gateway)
+		if err == nil {
+			err = gateway.Void(context.Background(), record.GatewayReference)
+		}
+		if err != nil {
+			log.Printf("payments: could not void %s: %v", record.GatewayReference, err)
+		}
+	}
+	record.Status = PaymentFailed
+	record.ErrorReason = "payment confirmation timed out"
+	return true
+}
+
+// ExpireAwaitingPayments wygasza zaległe płatności, o które nikt już nie pyta
+// (klient porzucił stronę BLIK, operatora lub 3-D Secure), i anuluje ich autoryzacje
+func ExpireAwaitingPayments(db *gorm.DB, gateways Gateways) (int, error) {
+	var overdue []Payment
+	if err := db.Where("status IN ? AND expires_at <= ?", []string{PaymentAwaitingConfirmation, PaymentRequiresAction}, time.Now()).
+		Find(&overdue).Error; err != nil {
+		return 0, err
+	}
+	expired := 0
+	for i := range overdue {
+		if expireAwaitingPayment(db, gateways, &overdue[i]) {
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+// StartAwaitingPaymentSweeper okresowo wygasza zaległe płatności i nierozpatrzone przeglądy
+// ryzyka; bez tego autoryzacje porzuconych płatności blokowałyby środki klienta
+func StartAwaitingPaymentSweeper(db *gorm.DB, gateways Gateways, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if n, err := ExpireAwaitingPayments(db, gateways); err != nil {
+				log.Printf("payment sweeper: %v", err)
+			} else if n > 0 {
+				log.Printf("payment sweeper: expired %d payments", n)
+			}
+			if n, err := ExpireFraudReviews(db, gateways); err != nil {
+				log.Printf("payment sweeper: %v", err)
+			} else if n > 0 {
+				log.Printf("payment sweeper: voided %d payments not reviewed in time", n)
+			}
+		}
+	}()
+}
+
+// failPayment zapisuje powód niepowodzenia; wywoływane poza transakcją, która została wycofana
+func failPayment(db *gorm.DB, record *Payment, status string, reason error) {
+	record.Status = status
+	record.ErrorReason = reason.Error()
+	if err := db.Model(record).Updates(map[string]interface{}{
+		"status": status, "error_reason": record.ErrorReason,
+	}).Error; err != nil {
+		log.Printf("payments: could not update payment %d: %v", record.ID, err)
+	}
+}
+
+func getPayment(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	var payment Payment
+	if err := db.Preload("Refunds.Items").First(&payment, c.Param("id")).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Payment not found")
+	}
+	// status jest odpytywany przez frontend, więc tu wygasają niedokończone płatności
+	expireAwaitingPayment(db, c.Get("gateways").(Gateways), &payment)
+	return c.JSON(http.StatusOK, payment)
+}
+
+func getCartPayments(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	cartID, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	if err := db.Select("id").First(&Cart{}, cartID).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Cart not found")
+	}
+	payments := []Payment{}
+	if err := db.Where("cart_id = ?", cartID).Order("id").Find(&payments).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch payments")
+	}
+	return c.JSON(http.StatusOK, payments)
+}
+
+func orderOrCartTotal(order *Order, totals *CartTotals) Money {
+	if order != nil {
+		return order.Total
+	}
+	return totals.Total
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestExpireAwaitingPaymentsVoidsOverdueAuthorizations(t *testing.T) {
+	db := newTestDB(t, schemaModels...)
+	gateway := newTestFakeGateway(t)
+	ctx := context.Background()
+
+	challenge := func(expiresAt time.Time) *Payment {
+		token, err := gateway.Tokenize(ctx, CardDetails{Number: FakeCard3DSRequired, ExpMonth: 12, ExpYear: 2030, CVC: "123"})
+		require.NoError(t, err)
+		auth, err := gateway.Authorize(ctx, AuthorizeRequest{CardToken: token, Amount: NewMoney(1000, "PLN")})
+		require.NoError(t, err)
+		require.NotEmpty(t, auth.ChallengeURL)
+		record := &Payment{CartID: 1, Status: PaymentRequiresAction, Amount: auth.Amount, Currency: "PLN",
+			Gateway: gateway.Name(), GatewayReference: auth.Reference, ExpiresAt: &expiresAt}
+		require.NoError(t, db.Create(record).Error)
+		return record
+	}
+	overdue := challenge(time.Now().Add(-time.Minute))
+	current := challenge(time.Now().Add(time.Hour))
+	blik := &Payment{CartID: 2, Status: PaymentAwaitingConfirmation, Amount: NewMoney(500, "PLN"), Currency: "PLN",
+		Method: PaymentMethodBlik, Gateway: "blik", ExpiresAt: overdue.ExpiresAt}
+	require.NoError(t, db.Create(blik).Error)
+
+	n, err := ExpireAwaitingPayments(db, Gateways{gateway})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	require.NoError(t, db.First(overdue, overdue.ID).Error)
+	assert.Equal(t, PaymentFailed, overdue.Status)
+	assert.Equal(t, "payment confirmation timed out", overdue.ErrorReason)
+	// autoryzacja została już anulowana w bramce
+	assert.ErrorIs(t, gateway.Void(ctx, overdue.GatewayReference), ErrInvalidGatewayState)
+
+	require.NoError(t, db.First(blik, blik.ID).Error)
+	assert.Equal(t, PaymentFailed, blik.Status)
+
+	require.NoError(t, db.First(current, current.ID).Error)
+	assert.Equal(t, PaymentRequiresAction, current.Status)
+	assert.NoError(t, gateway.Void(ctx, current.GatewayReference))
+
+	// kolejny przebieg nie ma już nic do zrobienia
+	n, err = ExpireAwaitingPayments(db, Gateways{gateway})
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+// authorizedCardPayment autoryzuje kartą sumę koszyka tak jak processPayment przed capture
+func authorizedCardPayment(t *testing.T, db *gorm.DB, gateway *FakeGateway, cart *Cart) (*Payment, *CartTotals) {
+	t.Helper()
+	totals, err := ComputeTotals(db, cart)
+	require.NoError(t, err)
+	ctx := context.Background()
+	token, err := gateway.Tokenize(ctx, CardDetails{Number: "4242424242424242", ExpMonth: 12, ExpYear: 2030, CVC: "123"})
+	require.NoError(t, err)
+	auth, err := gateway.Authorize(ctx, AuthorizeRequest{CardToken: token, Amount: totals.Total})
+	require.NoError(t, err)
+	record := &Payment{CartID: cart.ID, Status: PaymentAuthorized, Amount: totals.Total, Currency: totals.Currency,
+		Method: PaymentMethodCard, Gateway: gateway.Name(), GatewayReference: auth.Reference}
+	require.NoError(t, db.Create(record).Error)
+	return record, totals
+}
+
+func TestCaptureKeepsPaymentCapturedWhenSettlementFails(t *testing.T) {
+	_, db, gateway := newPaymentTestServer(t)
+	cart, product := newTestCart(t, db, 2, 2)
+	record, totals := authorizedCardPayment(t, db, gateway, cart)
+	// towar sprzedany poza sklepem po dodaniu do koszyka - rozliczenie nie przejdzie
+	require.NoError(t, db.Model(product).Update("stock", 1).Error)
+
+	_, err := captureAuthorizedPayment(context.Background(), db, gateway, record, cart, nil, totals, "test")
+	require.ErrorIs(t, err, ErrPaymentUnsettled)
+	assert.ErrorIs(t, err, ErrInsufficientStock)
+
+	var stored Payment
+	require.NoError(t, db.First(&stored, record.ID).Error)
+	assert.Equal(t, PaymentCaptured, stored.Status, "captured money is never reported as failed")
+	assert.NotNil(t, stored.CapturedAt)
+	assert.Contains(t, stored.ErrorReason, "insufficient stock")
+	// środki są pobrane w bramce, więc można je zwrócić
+	_, err = gateway.Refund(context.Background(), record.GatewayReference, record.Amount)
+	assert.NoError(t, err)
+}
+
+func TestCaptureVoidsAuthorizationWhenCartIsTaken(t *testing.T) {
+	_, db, gateway := newPaymentTestServer(t)
+	cart, _ := newTestCart(t, db, 5, 1)
+	first, totals := authorizedCardPayment(t, db, gateway, cart)
+	second, _ := authorizedCardPayment(t, db, gateway, cart)
+	// pierwsza płatność jest w trakcie pobierania
+	require.NoError(t, db.Model(first).Update("status", PaymentCapturing).Error)
+
+	_, err := captureAuthorizedPayment(context.Background(), db, gateway, second, cart, nil, totals, "test")
+	require.ErrorIs(t, err, ErrCartLocked)
+	require.NoError(t, db.First(second, second.ID).Error)
+	assert.Equal(t, PaymentVoided, second.Status)
+	assert.ErrorIs(t, gateway.Capture(context.Background(), second.GatewayReference, second.Amount), ErrInvalidGatewayState)
+}
+
+func TestPaymentAttemptsArePersisted(t *testing.T) {
+	e, db, _ := newPaymentTestServer(t)
+	e.GET("/payments/:id", getPayment)
+	e.GET("/carts/:id/payments", getCartPayments)
+	cart, _ := newTestCart(t, db, 5, 2)
+	payment := `{"cart_id":%d,"card_number":"%s","exp_month":12,"exp_year":2030,"cvc":"123","amount":"65.00"}`
+
+	rec := doRequest(e, http.MethodPost, "/payments", fmt.Sprintf(payment, cart.ID, FakeCardDeclined))
+	assert.Equal(t, http.StatusPaymentRequired, rec.Code)
+	rec = doRequest(e, http.MethodPost, "/payments", fmt.Sprintf(payment, cart.ID, "4242424242424242"))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var result struct {
+		PaymentID     uint   `json:"payment_id"`
+		TransactionID string `json:"transaction_id"`
+		OrderID       uint   `json:"order_id"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+
+	rec = doRequest(e, http.MethodGet, fmt.Sprintf("/payments/%d", result.PaymentID), "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var stored Payment
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stored))
+	assert.Equal(t, PaymentCaptured, stored.Status)
+	assert.Equal(t, result.TransactionID, stored.GatewayReference)
+	assert.Equal(t, "fake", stored.Gateway)
+	assert.Equal(t, "**** 4242", stored.CardMasked)
+	require.NotNil(t, stored.OrderID)
+	assert.Equal(t, result.OrderID, *stored.OrderID)
+	assert.NotContains(t, rec.Body.String(), "tok_", "card token is not exposed")
+
+	rec = doRequest(e, http.MethodGet, fmt.Sprintf("/carts/%d/payments", cart.ID), "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var attempts []Payment
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &attempts))
+	require.Len(t, attempts, 2)
+	assert.Equal(t, PaymentFailed, attempts[0].Status)
+	assert.Equal(t, ErrPaymentDeclined.Error(), attempts[0].ErrorReason)
+	assert.Equal(t, PaymentCaptured, attempts[1].Status)
+
+	rec = doRequest(e, http.MethodGet, "/payments/999999", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xuri/excelize/v2"
+	"gorm.io/gorm"
+)
+
+// Import katalogu z arkusza (CSV lub XLSX) przez POST /products/import (multipart, pole "file").
+// Produkty są dopasowywane po SKU: istniejący jest aktualizowany, nowy tworzony. Kategoria jest
+// podawana nazwą lub ścieżką "Elektronika > Telefony" i zakładana, jeśli nie istnieje.
+// Cały plik to jedna transakcja: błąd w którymkolwiek wierszu wycofuje wszystko, a odpowiedź
+// zawiera listę błędów per wiersz. dry_run=true wykonuje te same kroki i zawsze je wycofuje.
+
+const (
+	maxImportFileSize = 10 << 20
+	maxImportRows     = 5000
+)
+
+// Pola produktu, które można wczytać z arkusza; domyślnie kolumna nazywa się tak jak pole
+var importFields = []string{"sku", "name", "description", "price", "currency", "stock", "category"}
+
+var requiredImportFields = []string{"sku", "name", "price"}
+
+var errImportRollback = errors.New("import rolled back")
+
+type ImportRowError struct {
+	Row     int    `json:"row"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+type ImportReport struct {
+	DryRun            bool             `json:"dry_run"`
+	Rows              int              `json:"rows"`
+	Created           int              `json:"created"`
+	Updated           int              `json:"updated"`
+	Unchanged         int              `json:"unchanged"`
+	CategoriesCreated []string         `json:"categories_created"`
+	Errors            []ImportRowError `json:"errors"`
+}
+
+// importSheet to wczytany arkusz: nagłówek i wiersze danych
+type importSheet struct {
+	Header []string
+	Rows   [][]string
+	// DecimalComma: ceny zapisano z przecinkiem dziesiętnym (CSV rozdzielany średnikami)
+	DecimalComma bool
+}
+
+func readImportCSV(r io.Reader) (*importSheet, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(string(raw), "\ufeff")))
+	// Excel z polskimi ustawieniami zapisuje CSV ze średnikiem
+	firstLine, _, _ := strings.Cut(string(raw), "\n")
+	if strings.Count(firstLine, ";") > strings.Count(firstLine, ",") {
+		reader.Comma = ';'
+	}
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	sheet, err := newImportSheet(records)
+	if err != nil {
+		return nil, err
+	}
+	// przy przecinku jako separatorze pól "1,234" to kwota z separatorem tysięcy, a nie 1.234
+	sheet.DecimalComma = reader.Comma == ';'
+	return sheet, nil
+}
+
+func readImportXLSX(r io.Reader, sheet string) (*importSheet, error) {
+	// surowe wartości komórek: liczby bez formatowania (separatory tysięcy, waluta) z kropką dziesiętną
+	f, err := excelize.OpenReader(r, excelize.Options{RawCellValue: true})
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if sheet == "" {
+		sheet = f.GetSheetName(f.GetActiveSheetIndex())
+	}
+	records, err := f.GetRows(sheet)
+	if err != nil {
+		return nil, err
+	}
+	return newImportSheet(records)
+}
+
+func newImportSheet(records [][]string) (*importSheet, error) {
+	if len(records) == 0 {
+		return nil, errors.New("file is empty")
+	}
+	sheet := &importSheet{Header: records[0]}
+	for _, record := range records[1:] {
+		// puste wiersze (np. na końcu arkusza) są pomijane
+		if strings.TrimSpace(strings.Join(record, "")) != "" {
+			sheet.Rows = append(sheet.Rows, record)
+		}
+	}
+	return sheet, nil
+}
+
+// importColumns wiąże pola produktu z indeksami kolumn; mapping to {"pole": "nagłówek kolumny"}
+func importColumns(header []string, mapping map[string]string) (map[string]int, error) {
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		positions[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	columns := map[string]int{}
+	for _, field := range importFields {
+		name, mapped := mapping[field]
+		if !mapped {
+			name = field
+		}
+		if i, ok := positions[strings.ToLower(strings.TrimSpace(name))]; ok {
+			columns[field] = i
+		} else if mapped {
+			return nil, fmt.Errorf("column %q mapped to %s not found", name, field)
+		}
+	}
+	for field := range mapping {
+		if _, ok := columns[field]; !ok {
+			return nil, fmt.Errorf("unknown field %q in mapping", field)
+		}
+	}
+	for _, field := range requiredImportFields {
+		if _, ok := columns[field]; !ok {
+			return nil, fmt.Errorf("missing column for %s", field)
+		}
+	}
+	return columns, nil
+}
+
+// productImporter przetwarza wiersze w ramach jednej transakcji
+type productImporter struct {
+	tx           *gorm.DB
+	actor        string
+	columns      map[string]int
+	decimalComma bool
+	report       *ImportReport
+	categories   map[string]uint
+	skus         map[string]int
+}
+
+func (im *productImporter) cell(record []string, field string) (string, bool) {
+	i, ok := im.columns[field]
+	if !ok {
+		return "", false
+	}
+	if i >= len(record) {
+		return "", true
+	}
+	return strings.TrimSpace(record[i]), true
+}
+
+func (im *productImporter) fail(row int, field, format string, args ...interface{}) {
+	im.report.Errors = append(im.report.Errors, ImportRowError{Row: row, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// categoryID zwraca kategorię o podanej ścieżce, zakładając brakujące poziomy
+func (im *productImporter) categoryID(path string) (uint, error) {
+	var parentID *uint
+	var key string
+	var names []string
+	for _, name := range strings.Split(path, ">") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return 0, ErrCategoryNotFound
+		}
+		names = append(names, name)
+		key += "/" + strings.ToLower(name)
+		if id, ok := im.categories[key]; ok {
+			parentID = &id
+			continue
+		}
+		var category Category
+		query := im.tx.Where("LOWER(name) = ?", strings.ToLower(name))
+		if parentID == nil {
+			query = query.Where("parent_id IS NULL")
+		} else {
+			query = query.Where("parent_id = ?", *parentID)
+		}
+		err := query.Order("id").Take(&category).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			category = Category{Name: name, ParentID: parentID, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+			if err := im.tx.Create(&category).Error; err != nil {
+				return 0, err
+			}
+			im.report.CategoriesCreated = append(im.report.CategoriesCreated, strings.Join(names, " > "))
+		} else if err != nil {
+			return 0, err
+		}
+		im.categories[key] = category.ID
+		parentID = &category.ID
+	}
+	return *parentID, nil
+}
+
+// parsePrice czyta cenę w zapisie pliku: przecinek dziesiętny tylko w CSV z polskimi
+// ustawieniami (średnik), kropka w pozostałych; separatory tysięcy są odrzucane
+func (im *productImporter) parsePrice(value, currency string) (Money, error) {
+	if im.decimalComma {
+		if strings.Contains(value, ".") {
+			return Money{}, ErrInvalidAmount
+		}
+		value = strings.Replace(value, ",", ".", 1)
+	}
+	return ParseMoney(value, currency)
+}
+
+// importRow zwraca błąd tylko przy awarii bazy; błędy danych trafiają do raportu
+func (im *productImporter) importRow(row int, record []string) error {
+	sku, _ := im.cell(record, "sku")
+	if sku == "" {
+		im.fail(row, "sku", "SKU is required")
+		return nil
+	}
+	if first, ok := im.skus[sku]; ok {
+		im.fail(row, "sku", "SKU %s already appears in row %d", sku, first)
+		return nil
+	}
+	im.skus[sku] = row
+
+	var product Product
+	err := im.tx.Unscoped().Where("sku = ?", sku).Take(&product).Error
+	exists := err == nil
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		product = Product{SKU: &sku, CreatedAt: time.Now()}
+	case err != nil:
+		return err
+	case product.DeletedAt.Valid:
+		im.fail(row, "sku", "SKU %s belongs to a deleted product, restore it first", sku)
+		return nil
+	}
+	before := product
+
+	errorsBefore := len(im.report.Errors)
+	if name, _ := im.cell(record, "name"); name == "" {
+		im.fail(row, "name", "name is required")
+	} else {
+		product.Name = name
+	}
+	if description, ok := im.cell(record, "description"); ok {
+		product.Description = description
+	}
+	currency := DefaultCurrency
+	if v, _ := im.cell(record, "currency"); v != "" {
+		currency = strings.ToUpper(v)
+	}
+	price, _ := im.cell(record, "price")
+	if m, err := im.parsePrice(price, currency); err != nil || m.Amount < 0 {
+		im.fail(row, "price", "invalid price %q", price)
+	} else {
+		product.Price = m
+	}
+	if v, ok := im.cell(record, "stock"); ok && v != "" {
+		if stock, err := strconv.Atoi(v); err != nil || stock < 0 {
+			im.fail(row, "stock", "invalid stock %q", v)
+		} else {
+			product.Stock = &stock
+		}
+	}
+	if path, _ := im.cell(record, "category"); path != "" {
+		id, err := im.categoryID(path)
+		if errors.Is(err, ErrCategoryNotFound) {
+			im.fail(row, "category", "invalid category path %q", path)
+		} else if err != nil {
+			return err
+		} else {
+			product.CategoryID = id
+		}
+	}
+	if len(im.report.Errors) > errorsBefore {
+		return nil
+	}
+
+	if !exists {
+		product.UpdatedAt = time.Now()
+		if err := im.tx.Create(&product).Error; err != nil {
+			return err
+		}
+		im.report.Created++
+		_, err := RecordProductRevision(im.tx, &product, RevisionCreated, im.actor, nil)
+		return err
+	}
+	if len(diffProduct(&ProductRevision{Name: before.Name, Description: before.Description, Price: before.Price, CategoryID: before.CategoryID}, &product)) == 0 &&
+		equalStock(before.Stock, product.Stock) {
+		im.report.Unchanged++
+		return nil
+	}
+	product.UpdatedAt = time.Now()
+	if err := im.tx.Save(&product).Error; err != nil {
+		return err
+	}
+	im.report.Updated++
+	_, err = RecordProductRevision(im.tx, &product, RevisionUpdated, im.actor, nil)
+	return err
+}
+
+func equalStock(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// ImportProducts wczytuje wiersze arkusza w jednej transakcji; przy błędach lub dry-run
+// transakcja jest wycofywana, a raport opisuje, co zostałoby zrobione
+func ImportProducts(db *gorm.DB, sheet *importSheet, columns map[string]int, dryRun bool, actor string) (*ImportReport, error) {
+	report := &ImportReport{DryRun: dryRun, Rows: len(sheet.Rows), CategoriesCreated: []string{}, Errors: []ImportRowError{}}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		im := &productImporter{tx: tx, actor: actor, columns: columns, decimalComma: sheet.DecimalComma, report: report,
+			categories: map[string]uint{}, skus: map[string]int{}}
+		for i, record := range sheet.Rows {
+			// numer wiersza jak w arkuszu: nagłówek to wiersz 1
+			if err := im.importRow(i+2, record); err != nil {
+				return fmt.Errorf("row %d: %w", i+2, err)
+			}
+		}
+		if dryRun || len(report.Errors) > 0 {
+			return errImportRollback
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errImportRollback) {
+		return nil, err
+	}
+	return report, nil
+}
+
+func importProducts(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	file, err := c.FormFile("file")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "file is required")
+	}
+	if file.Size > maxImportFileSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "File is too large")
+	}
+	dryRun, _ := strconv.ParseBool(c.FormValue("dry_run"))
+	if v := c.QueryParam("dry_run"); v != "" {
+		dryRun, _ = strconv.ParseBool(v)
+	}
+	mapping := map[string]string{}
+	if v := c.FormValue("mapping"); v != "" {
+		if err := json.Unmarshal([]byte(v), &mapping); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "mapping must be a JSON object of field to column name")
+		}
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Could not read file")
+	}
+	defer src.Close()
+	format := strings.ToLower(c.FormValue("format"))
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(file.Filename)), ".")
+	}
+	var sheet *importSheet
+	switch format {
+	case "csv":
+		sheet, err = readImportCSV(src)
+	case "xlsx":
+		sheet, err = readImportXLSX(src, c.FormValue("sheet"))
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "Unsupported format, expected csv or xlsx")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Could not parse file: "+err.Error())
+	}
+	if len(sheet.Rows) > maxImportRows {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("File has more than %d rows", maxImportRows))
+	}
+	columns, err := importColumns(sheet.Header, mapping)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid column mapping: "+err.Error())
+	}
+
+	report, err := ImportProducts(db, sheet, columns, dryRun, requestActor(c))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not import products")
+	}
+	if len(report.Errors) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, report)
+	}
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xuri/excelize/v2"
+	"gorm.io/gorm"
+)
+
+// importCSV wczytuje CSV i importuje go z domyślnym mapowaniem kolumn
+func importCSV(t *testing.T, db *gorm.DB, data string, dryRun bool) *ImportReport {
+	t.Helper()
+	sheet, err := readImportCSV(strings.NewReader(data))
+	require.NoError(t, err)
+	columns, err := importColumns(sheet.Header, nil)
+	require.NoError(t, err)
+	report, err := ImportProducts(db, sheet, columns, dryRun, "test")
+	require.NoError(t, err)
+	return report
+}
+
+func productBySKU(t *testing.T, db *gorm.DB, sku string) Product {
+	t.Helper()
+	var product Product
+	require.NoError(t, db.Where("sku = ?", sku).Take(&product).Error)
+	return product
+}
+
+func TestReadImportCSVDetectsDelimiter(t *testing.T) {
+	sheet, err := readImportCSV(strings.NewReader("\ufeffsku;name;price\nA-1;Herbata;12,50\n\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sku", "name", "price"}, sheet.Header)
+	assert.Equal(t, [][]string{{"A-1", "Herbata", "12,50"}}, sheet.Rows)
+	assert.True(t, sheet.DecimalComma)
+
+	sheet, err = readImportCSV(strings.NewReader("sku,name,price\nA-1,Herbata,12.50\n"))
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"A-1", "Herbata", "12.50"}}, sheet.Rows)
+	assert.False(t, sheet.DecimalComma)
+}
+
+func TestImportPriceDecimalSeparator(t *testing.T) {
+	db := newTestDB(t, schemaModels...)
+
+	report := importCSV(t, db, "sku;name;price\nA-1;Herbata;12,50\nA-2;Kawa;1234\n", false)
+	require.Empty(t, report.Errors)
+	assert.Equal(t, NewMoney(1250, "PLN"), productBySKU(t, db, "A-1").Price)
+	assert.Equal(t, NewMoney(123400, "PLN"), productBySKU(t, db, "A-2").Price)
+
+	// przy przecinku rozdzielającym pola "1,234" nie może stać się ceną 1.23
+	report = importCSV(t, db, "sku,name,price\nB-1,Kubek,\"1,234\"\n", false)
+	if assert.Len(t, report.Errors, 1) {
+		assert.Equal(t, ImportRowError{Row: 2, Field: "price", Message: `invalid price "1,234"`}, report.Errors[0])
+	}
+	// w CSV ze średnikiem kropka nie jest separatorem dziesiętnym
+	report = importCSV(t, db, "sku;name;price\nB-2;Kubek;1.234,50\n", false)
+	assert.Len(t, report.Errors, 1)
+	// więcej miejsc po przecinku niż ma waluta to błąd, a nie zaokrąglenie
+	report = importCSV(t, db, "sku,name,price\nB-3,Kubek,19.999\n", false)
+	assert.Len(t, report.Errors, 1)
+
+	var count int64
+	require.NoError(t, db.Model(&Product{}).Where("sku LIKE ?", "B-%").Count(&count).Error)
+	assert.Zero(t, count)
+}
+
+func TestReadImportXLSXUsesRawValues(t *testing.T) {
+	f := excelize.NewFile()
+	defer f.Close()
+	sheet := f.GetSheetName(0)
+	require.NoError(t, f.SetSheetRow(sheet, "A1", &[]interface{}{"sku", "name", "price", "stock"}))
+	require.NoError(t, f.SetSheetRow(sheet, "A2", &[]interface{}{"X-1", "Czajnik", 1234.5, 1500}))
+	// format z separatorem tysięcy i dwoma miejscami (wbudowany format 4: #,##0.00)
+	style, err := f.NewStyle(&excelize.Style{NumFmt: 4})
+	require.NoError(t, err)
+	require.NoError(t, f.SetCellStyle(sheet, "C2", "D2", style))
+	var buf bytes.Buffer
+	require.NoError(t, f.Write(&buf))
+
+	read, err := readImportXLSX(&buf, "")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"X-1", "Czajnik", "1234.5", "1500"}}, read.Rows)
+	assert.False(t, read.DecimalComma)
+
+	db := newTestDB(t, schemaModels...)
+	columns, err := importColumns(read.Header, nil)
+	require.NoError(t, err)
+	report, err := ImportProducts(db, read, columns, false, "test")
+	require.NoError(t, err)
+	require.Empty(t, report.Errors)
+	product := productBySKU(t, db, "X-1")
+	assert.Equal(t, NewMoney(123450, "PLN"), product.Price)
+	if assert.NotNil(t, product.Stock) {
+		assert.Equal(t, 1500, *product.Stock)
+	}
+}
+
+func TestImportDryRunRollsBack(t *testing.T) {
+	db := newTestDB(t, schemaModels...)
+	data := "sku,name,price,category\nD-1,Herbata,10.00,Napoje > Herbaty\nD-2,Kawa,20.00,Napoje\n"
+
+	report := importCSV(t, db, data, true)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 2, report.Created)
+	assert.Equal(t, []string{"Napoje", "Napoje > Herbaty"}, report.CategoriesCreated)
+	assert.Empty(t, report.Errors)
+	for _, model := range []interface{}{&Product{}, &Category{}, &ProductRevision{}} {
+		var count int64
+		require.NoError(t, db.Model(model).Count(&count).Error)
+		assert.Zero(t, count, "%T", model)
+	}
+
+	// błąd w jednym wierszu wycofuje także poprawne wiersze
+	report = importCSV(t, db, data+"D-3,,5.00,\n", false)
+	assert.Equal(t, []ImportRowError{{Row: 4, Field: "name", Message: "name is required"}}, report.Errors)
+	var count int64
+	require.NoError(t, db.Model(&Product{}).Count(&count).Error)
+	assert.Zero(t, count)
+
+	report = importCSV(t, db, data, false)
+	assert.Equal(t, 2, report.Created)
+	assert.Equal(t, "Kawa", productBySKU(t, db, "D-2").Name)
+	// ponowny import tych samych danych niczego nie zmienia
+	report = importCSV(t, db, data, false)
+	assert.Equal(t, 2, report.Unchanged)
+}
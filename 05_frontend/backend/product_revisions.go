@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Historia zmian produktu. Każda zmiana danych katalogowych (nazwa, opis, cena, kategoria)
+// zapisuje kolejną rewizję z pełnym stanem, listą zmienionych pól, autorem (operator z X-Admin-Token) i czasem.
+// Stan magazynowy nie jest wersjonowany - zmienia się przy każdej sprzedaży i ma własne
+// rezerwacje. GET /products/:id?as_of= odtwarza produkt z ostatniej rewizji sprzed podanej chwili.
+// Historia zostaje także po trwałym usunięciu produktu z kosza.
+
+const (
+	RevisionCreated  = "created"
+	RevisionUpdated  = "updated"
+	RevisionDeleted  = "deleted"
+	RevisionRestored = "restored"
+	RevisionReverted = "reverted"
+	// RevisionPurged zamyka historię produktu usuniętego na stałe z kosza
+	RevisionPurged = "purged"
+	// RevisionBaseline to stan produktów istniejących przed wprowadzeniem historii
+	RevisionBaseline = "baseline"
+)
+
+var ErrRevisionNotFound = errors.New("product revision not found")
+
+type ProductRevision struct {
+	ID           uint          `gorm:"primaryKey" json:"id"`
+	ProductID    uint          `gorm:"uniqueIndex:idx_product_revision" json:"product_id"`
+	Revision     int           `gorm:"uniqueIndex:idx_product_revision" json:"revision"`
+	Action       string        `json:"action"`
+	Author       string        `json:"author"`
+	RevertedFrom *int          `json:"reverted_from,omitempty"`
+	Name         string        `json:"name"`
+	Description  string        `json:"description"`
+	Price        Money         `gorm:"embedded;embeddedPrefix:price_" json:"price"`
+	Currency     string        `gorm:"-" json:"currency"`
+	CategoryID   uint          `json:"category_id"`
+	ChangesJSON  string        `gorm:"column:changes;type:text" json:"-"`
+	Changes      []FieldChange `gorm:"-" json:"changes"`
+	CreatedAt    time.Time     `gorm:"index" json:"created_at"`
+}
+
+// FieldChange to jedna pozycja diffu: wartość pola przed i po zmianie
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+func (r *ProductRevision) BeforeCreate(tx *gorm.DB) error {
+	if r.Changes == nil {
+		r.Changes = []FieldChange{}
+	}
+	raw, err := json.Marshal(r.Changes)
+	if err != nil {
+		return err
+	}
+	r.ChangesJSON = string(raw)
+	return nil
+}
+
+func (r *ProductRevision) AfterFind(tx *gorm.DB) error {
+	r.Currency = r.Price.Currency
+	r.Changes = []FieldChange{}
+	if r.ChangesJSON == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(r.ChangesJSON), &r.Changes)
+}
+
+// diffProduct porównuje wersjonowane pola; prev == nil oznacza pierwszą rewizję
+func diffProduct(prev *ProductRevision, p *Product) []FieldChange {
+	changes := []FieldChange{}
+	add := func(field string, from, to interface{}) {
+		changes = append(changes, FieldChange{Field: field, From: from, To: to})
+	}
+	if prev == nil {
+		add("name", nil, p.Name)
+		add("description", nil, p.Description)
+		add("price", nil, p.Price.String())
+		add("category_id", nil, p.CategoryID)
+		return changes
+	}
+	if prev.Name != p.Name {
+		add("name", prev.Name, p.Name)
+	}
+	if prev.Description != p.Description {
+		add("description", prev.Description, p.Description)
+	}
+	if prev.Price != p.Price {
+		add("price", prev.Price.String(), p.Price.String())
+	}
+	if prev.CategoryID != p.CategoryID {
+		add("category_id", prev.CategoryID, p.CategoryID)
+	}
+	return changes
+}
+
+// RecordProductRevision zapisuje bieżący stan produktu jako kolejną rewizję.
+// Edycja, która nie zmieniła żadnego wersjonowanego pola, nie tworzy rewizji (zwraca nil).
+func RecordProductRevision(tx *gorm.DB, p *Product, action, author string, revertedFrom *int) (*ProductRevision, error) {
+	var last *ProductRevision
+	var prev ProductRevision
+	err := tx.Where("product_id = ?", p.ID).Order("revision DESC").Take(&prev).Error
+	switch {
+	case err == nil:
+		last = &prev
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, err
+	}
+	changes := diffProduct(last, p)
+	if len(changes) == 0 && (action == RevisionUpdated || action == RevisionReverted) {
+		return nil, nil
+	}
+	rev := &ProductRevision{
+		ProductID:    p.ID,
+		Revision:     1,
+		Action:       action,
+		Author:       author,
+		RevertedFrom: revertedFrom,
+		Name:         p.Name,
+		Description:  p.Description,
+		Price:        p.Price,
+		Currency:     p.Price.Currency,
+		CategoryID:   p.CategoryID,
+		Changes:      changes,
+	}
+	if last != nil {
+		rev.Revision = last.Revision + 1
+	}
+	if err := tx.Create(rev).Error; err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+// MigrateProductRevisions zapisuje rewizję bazową dla produktów bez historii,
+// z czasem ostatniej modyfikacji produktu
+func MigrateProductRevisions(db *gorm.DB) error {
+	return db.Exec(`INSERT INTO product_revisions
+		(product_id, revision, action, author, name, description, price_amount, price_currency, category_id, changes, created_at)
+		SELECT p.id, 1, ?, 'system', p.name, p.description, p.price_amount, p.price_currency, p.category_id, '[]', p.updated_at
+		FROM products p
+		WHERE NOT EXISTS (SELECT 1 FROM product_revisions r WHERE r.product_id = p.id)`, RevisionBaseline).Error
+}
+
+// ProductAsOf to produkt odtworzony z historii; stan magazynowy nie jest wersjonowany,
+// więc pola stock z osadzonego produktu nie ma w odpowiedzi
+type ProductAsOf struct {
+	Product
+	Stock    *int      `json:"stock,omitempty"`
+	Revision int       `json:"revision"`
+	AsOf     time.Time `json:"as_of"`
+}
+
+// productAsOf odtwarza produkt z ostatniej rewizji zapisanej nie później niż asOf
+func productAsOf(db *gorm.DB, id uint, asOf time.Time) (*ProductAsOf, error) {
+	// produkt usunięty już z kosza odtwarzamy z samej historii
+	current := Product{ID: id}
+	if err := db.Unscoped().First(&current, id).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch product")
+	}
+	var rev ProductRevision
+	if err := db.Where("product_id = ? AND created_at <= ?", id, asOf).Order("revision DESC").Take(&rev).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Product has no recorded state at that time")
+	}
+	if rev.Action == RevisionDeleted || rev.Action == RevisionPurged {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Product was deleted at that time")
+	}
+	p := current
+	p.Name, p.Description, p.Price, p.Currency, p.CategoryID = rev.Name, rev.Description, rev.Price, rev.Price.Currency, rev.CategoryID
+	p.UpdatedAt, p.DeletedAt, p.Stock, p.Available = rev.CreatedAt, gorm.DeletedAt{}, nil, nil
+	// kategoria mogła zostać usunięta później - wtedy produkt zostaje bez niej
+	if err := db.First(&p.Category, rev.CategoryID).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch product category")
+	}
+	return &ProductAsOf{Product: p, Revision: rev.Revision, AsOf: asOf}, nil
+}
+
+func getProductRevisions(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	id, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	revisions := []ProductRevision{}
+	if err := db.Where("product_id = ?", id).Order("revision DESC").Find(&revisions).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch product revisions")
+	}
+	if len(revisions) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Product not found")
+	}
+	return c.JSON(http.StatusOK, revisions)
+}
+
+// revertProduct przywraca dane katalogowe z wybranej rewizji jako nową rewizję (historia się nie skraca)
+func revertProduct(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	id, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	revision, err := parseUintParam(c, "revision")
+	if err != nil {
+		return err
+	}
+	var p Product
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&p, id).Error; err != nil {
+			return err
+		}
+		var target ProductRevision
+		if err := tx.Where("product_id = ? AND revision = ?", p.ID, revision).Take(&target).Error; err != nil {
+			return ErrRevisionNotFound
+		}
+		p.Name, p.Description, p.Price, p.CategoryID = target.Name, target.Description, target.Price, target.CategoryID
+		p.UpdatedAt = time.Now()
+		if err := tx.Model(&p).Select("name", "description", "price_amount", "price_currency", "category_id", "updated_at").
+			Updates(&p).Error; err != nil {
+			return err
+		}
+		_, err := RecordProductRevision(tx, &p, RevisionReverted, requestActor(c), &target.Revision)
+		return err
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Product not found")
+	case errors.Is(err, ErrRevisionNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Product revision not found")
+	case err != nil:
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not revert product")
+	}
+	db.Preload("Category").First(&p, p.ID)
+	return c.JSON(http.StatusOK, p)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProductRevisionsRecordEveryChange(t *testing.T) {
+	e, _ := newProductTestServer(t)
+	p := postProduct(t, e, "Kubek", "25.00")
+	productURL := fmt.Sprintf("/products/%d", p.ID)
+
+	rec := doRequest(e, http.MethodPut, productURL, `{"price":"29.99","currency":"PLN"}`, adminTokenHeader, testAdminToken)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	// zmiana samego stanu magazynowego nie tworzy rewizji
+	rec = doRequest(e, http.MethodPut, productURL, `{"stock":7}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, http.StatusNoContent, doRequest(e, http.MethodDelete, productURL, "").Code)
+
+	revisions := productRevisions(t, e, p.ID)
+	require.Len(t, revisions, 3)
+	created, updated, deleted := revisions[2], revisions[1], revisions[0]
+
+	assert.Equal(t, 1, created.Revision)
+	assert.Equal(t, RevisionCreated, created.Action)
+	assert.Equal(t, "magazyn", created.Author)
+	assert.Len(t, created.Changes, 4)
+
+	assert.Equal(t, 2, updated.Revision)
+	assert.Equal(t, RevisionUpdated, updated.Action)
+	assert.Equal(t, NewMoney(2999, "PLN"), updated.Price)
+	assert.Equal(t, []FieldChange{{Field: "price", From: "25.00 PLN", To: "29.99 PLN"}}, updated.Changes)
+
+	assert.Equal(t, 3, deleted.Revision)
+	assert.Equal(t, RevisionDeleted, deleted.Action)
+	assert.Equal(t, "api", deleted.Author)
+	assert.Empty(t, deleted.Changes)
+
+	assert.Equal(t, http.StatusNotFound, doRequest(e, http.MethodGet, "/products/999/revisions", "").Code)
+}
+
+func TestRevertProductToEarlierRevision(t *testing.T) {
+	e, _ := newProductTestServer(t)
+	p := postProduct(t, e, "Kubek", "25.00")
+	productURL := fmt.Sprintf("/products/%d", p.ID)
+	rec := doRequest(e, http.MethodPut, productURL, `{"name":"Kubek duży","price":"35.00","currency":"PLN"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = doRequest(e, http.MethodPost, productURL+"/revisions/1/revert", "", adminTokenHeader, testAdminToken)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var reverted Product
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reverted))
+	assert.Equal(t, "Kubek", reverted.Name)
+	assert.Equal(t, NewMoney(2500, "PLN"), reverted.Price)
+
+	revisions := productRevisions(t, e, p.ID)
+	require.Len(t, revisions, 3)
+	assert.Equal(t, RevisionReverted, revisions[0].Action)
+	assert.Equal(t, "magazyn", revisions[0].Author)
+	require.NotNil(t, revisions[0].RevertedFrom)
+	assert.Equal(t, 1, *revisions[0].RevertedFrom)
+
+	// powrót do stanu, który już obowiązuje, nie dopisuje rewizji
+	require.Equal(t, http.StatusOK, doRequest(e, http.MethodPost, productURL+"/revisions/1/revert", "").Code)
+	assert.Len(t, productRevisions(t, e, p.ID), 3)
+	assert.Equal(t, http.StatusNotFound, doRequest(e, http.MethodPost, productURL+"/revisions/9/revert", "").Code)
+
+	// produktu w koszu nie da się cofnąć, zanim nie zostanie przywrócony
+	require.Equal(t, http.StatusNoContent, doRequest(e, http.MethodDelete, productURL, "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(e, http.MethodPost, productURL+"/revisions/2/revert", "").Code)
+	assert.Len(t, productRevisions(t, e, p.ID), 4)
+}
+
+func TestGetProductAsOf(t *testing.T) {
+	e, db := newProductTestServer(t)
+	category := Category{Name: "Kuchnia"}
+	require.NoError(t, db.Create(&category).Error)
+	p := postProduct(t, e, "Kubek", "25.00")
+	productURL := fmt.Sprintf("/products/%d", p.ID)
+	rec := doRequest(e, http.MethodPut, productURL, fmt.Sprintf(`{"price":"30.00","currency":"PLN","category_id":%d}`, category.ID))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// rewizje z różnych chwil: cena 25 PLN dwie godziny temu, 30 PLN godzinę temu
+	now := time.Now()
+	require.NoError(t, db.Model(&ProductRevision{}).Where("product_id = ? AND revision = 1", p.ID).
+		Update("created_at", now.Add(-2*time.Hour)).Error)
+	require.NoError(t, db.Model(&ProductRevision{}).Where("product_id = ? AND revision = 2", p.ID).
+		Update("created_at", now.Add(-time.Hour)).Error)
+	asOf := func(at time.Time) string {
+		return productURL + "?as_of=" + url.QueryEscape(at.UTC().Format(time.RFC3339))
+	}
+	// ProductAsOf nie da się zdekodować wprost, bo osadzony Product ma własne UnmarshalJSON
+	getAsOf := func(at time.Time) (Product, int) {
+		t.Helper()
+		rec := doRequest(e, http.MethodGet, asOf(at), "")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var res Product
+		var meta struct {
+			Revision int `json:"revision"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &meta))
+		return res, meta.Revision
+	}
+
+	before, revision := getAsOf(now.Add(-90 * time.Minute))
+	assert.Equal(t, 1, revision)
+	assert.Equal(t, NewMoney(2500, "PLN"), before.Price)
+	assert.Zero(t, before.CategoryID)
+	assert.NotContains(t, doRequest(e, http.MethodGet, asOf(now.Add(-90*time.Minute)), "").Body.String(), `"stock"`)
+
+	after, revision := getAsOf(now)
+	assert.Equal(t, 2, revision)
+	assert.Equal(t, NewMoney(3000, "PLN"), after.Price)
+	assert.Equal(t, "Kuchnia", after.Category.Name)
+
+	assert.Equal(t, http.StatusNotFound, doRequest(e, http.MethodGet, asOf(now.Add(-3*time.Hour)), "").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(e, http.MethodGet, productURL+"?as_of=wczoraj", "").Code)
+
+	// po usunięciu produkt nie istnieje w chwilach późniejszych, ale wcześniejsze stany zostają
+	require.Equal(t, http.StatusNoContent, doRequest(e, http.MethodDelete, productURL, "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(e, http.MethodGet, asOf(now.Add(time.Minute)), "").Code)
+	_, revision = getAsOf(now.Add(-90 * time.Minute))
+	assert.Equal(t, 1, revision)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Kosz produktów. DELETE /products/:id tylko oznacza produkt jako usunięty (gorm.DeletedAt),
+// więc znika z list, wyszukiwarki i nie da się go dodać do koszyka, a z otwartych koszyków
+// jest od razu zdejmowany. Koszyki w trakcie płatności i zamówienia zachowują swoje pozycje.
+// Po PRODUCT_TRASH_RETENTION produkt jest usuwany z bazy na stałe razem z pozycjami koszyków
+// i rezerwacjami; zamówienia przechowują własną kopię nazwy i ceny, a historia zmian zostaje
+// (z końcową rewizją "purged"), bo identyfikatory produktów nie są używane ponownie.
+
+var productTrashRetention = envDuration("PRODUCT_TRASH_RETENTION", 30*24*time.Hour)
+
+var ErrProductNotDeleted = errors.New("product is not deleted")
+
+// SoftDeleteProduct przenosi produkt do kosza i zdejmuje go z otwartych koszyków
+func SoftDeleteProduct(db *gorm.DB, id uint, actor string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var product Product
+		if err := tx.First(&product, id).Error; err != nil {
+			return err
+		}
+		var items []CartItem
+		if err := tx.Where("product_id = ? AND cart_id IN (?)", product.ID,
+			tx.Model(&Cart{}).Select("id").Where("status = ?", CartOpen)).Find(&items).Error; err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := removeCartItem(tx, item); err != nil {
+				return err
+			}
+		}
+		if err := tx.Delete(&product).Error; err != nil {
+			return err
+		}
+		_, err := RecordProductRevision(tx, &product, RevisionDeleted, actor, nil)
+		return err
+	})
+}
+
+// RestoreProduct wyjmuje produkt z kosza
+func RestoreProduct(db *gorm.DB, id uint, actor string) (*Product, error) {
+	var product Product
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Preload("Category").First(&product, id).Error; err != nil {
+			return err
+		}
+		if !product.DeletedAt.Valid {
+			return ErrProductNotDeleted
+		}
+		product.DeletedAt = gorm.DeletedAt{}
+		if err := tx.Unscoped().Model(&product).Update("deleted_at", nil).Error; err != nil {
+			return err
+		}
+		_, err := RecordProductRevision(tx, &product, RevisionRestored, actor, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// PurgeDeletedProducts trwale usuwa produkty leżące w koszu dłużej niż retention
+func PurgeDeletedProducts(db *gorm.DB, retention time.Duration) (int64, error) {
+	var purged int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var products []Product
+		if err := tx.Unscoped().Where("deleted_at <= ?", time.Now().Add(-retention)).Find(&products).Error; err != nil {
+			return err
+		}
+		if len(products) == 0 {
+			return nil
+		}
+		expired := make([]uint, len(products))
+		for i := range products {
+			expired[i] = products[i].ID
+			if _, err := RecordProductRevision(tx, &products[i], RevisionPurged, "system", nil); err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("product_id IN (?)", expired).Delete(&CartItem{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("product_id IN (?)", expired).Delete(&Reservation{}).Error; err != nil {
+			return err
+		}
+		res := tx.Unscoped().Delete(&Product{}, expired)
+		purged = res.RowsAffected
+		return res.Error
+	})
+	return purged, err
+}
+
+// StartProductTrashPurger okresowo opróżnia kosz z produktów starszych niż PRODUCT_TRASH_RETENTION
+func StartProductTrashPurger(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if n, err := PurgeDeletedProducts(db, productTrashRetention); err != nil {
+				log.Printf("product trash purger: %v", err)
+			} else if n > 0 {
+				log.Printf("product trash purger: purged %d products", n)
+			}
+		}
+	}()
+}
+
+func getProductTrash(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	products := []Product{}
+	if err := db.Unscoped().Preload("Category").Where("deleted_at IS NOT NULL").
+		Order("deleted_at DESC").Find(&products).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch deleted products")
+	}
+	return c.JSON(http.StatusOK, products)
+}
+
+func restoreProduct(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	id, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	product, err := RestoreProduct(db, id, requestActor(c))
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Product not found")
+	case errors.Is(err, ErrProductNotDeleted):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Product is not deleted")
+	case err != nil:
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not restore product")
+	}
+	return c.JSON(http.StatusOK, product)
+}
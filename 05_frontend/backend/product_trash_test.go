@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func newProductTestServer(t *testing.T) (*echo.Echo, *gorm.DB) {
+	db := newTestDB(t, schemaModels...)
+	e := echo.New()
+	e.Use(DBMiddleware(db))
+	e.Use(AdminMiddleware(testAdmins(t)))
+	e.POST("/products", createProduct)
+	e.GET("/products/trash", getProductTrash)
+	e.GET("/products/:id", getProduct)
+	e.GET("/products", getAllProducts)
+	e.PUT("/products/:id", updateProduct)
+	e.DELETE("/products/:id", deleteProduct)
+	e.POST("/products/:id/restore", restoreProduct)
+	e.GET("/products/:id/revisions", getProductRevisions)
+	e.POST("/products/:id/revisions/:revision/revert", revertProduct)
+	return e, db
+}
+
+// postProduct zakłada produkt przez API, żeby zapisała się też pierwsza rewizja
+func postProduct(t *testing.T, e *echo.Echo, name, price string) Product {
+	t.Helper()
+	rec := doRequest(e, http.MethodPost, "/products",
+		fmt.Sprintf(`{"name":%q,"price":%q,"currency":"PLN","stock":5}`, name, price), adminTokenHeader, testAdminToken)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var p Product
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+	return p
+}
+
+func productRevisions(t *testing.T, e *echo.Echo, id uint) []ProductRevision {
+	t.Helper()
+	rec := doRequest(e, http.MethodGet, fmt.Sprintf("/products/%d/revisions", id), "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var revisions []ProductRevision
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &revisions))
+	return revisions
+}
+
+func TestDeletedProductGoesToTrashAndCanBeRestored(t *testing.T) {
+	e, db := newProductTestServer(t)
+	mug := postProduct(t, e, "Kubek", "25.00")
+	plate := postProduct(t, e, "Talerz", "40.00")
+	cart := Cart{}
+	require.NoError(t, db.Create(&cart).Error)
+	require.NoError(t, AddCartItem(db, cart.ID, mug.ID, 2))
+	productURL := fmt.Sprintf("/products/%d", mug.ID)
+
+	rec := doRequest(e, http.MethodDelete, productURL, "")
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+
+	// produkt w koszu znika z katalogu i z otwartych koszyków
+	assert.Equal(t, http.StatusNotFound, doRequest(e, http.MethodGet, productURL, "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(e, http.MethodPut, productURL, `{"name":"Kubek duży"}`).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(e, http.MethodDelete, productURL, "").Code)
+	rec = doRequest(e, http.MethodGet, "/products", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	listed := decodeProducts(t, rec.Body.Bytes())
+	require.Len(t, listed, 1)
+	assert.Equal(t, plate.ID, listed[0].ID)
+	var items int64
+	require.NoError(t, db.Model(&CartItem{}).Where("cart_id = ?", cart.ID).Count(&items).Error)
+	assert.Zero(t, items)
+	assert.ErrorIs(t, AddCartItem(db, cart.ID, mug.ID, 1), gorm.ErrRecordNotFound)
+
+	rec = doRequest(e, http.MethodGet, "/products/trash", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	trash := decodeProducts(t, rec.Body.Bytes())
+	require.Len(t, trash, 1)
+	assert.Equal(t, mug.ID, trash[0].ID)
+
+	rec = doRequest(e, http.MethodPost, productURL+"/restore", "", adminTokenHeader, testAdminToken)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = doRequest(e, http.MethodGet, productURL, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var restored Product
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &restored))
+	assert.Equal(t, "Kubek", restored.Name)
+	assert.Equal(t, NewMoney(2500, "PLN"), restored.Price)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(e, http.MethodPost, productURL+"/restore", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(e, http.MethodPost, "/products/999/restore", "").Code)
+
+	revisions := productRevisions(t, e, mug.ID)
+	require.Len(t, revisions, 3)
+	assert.Equal(t, RevisionRestored, revisions[0].Action)
+	assert.Equal(t, "magazyn", revisions[0].Author)
+	assert.Equal(t, RevisionDeleted, revisions[1].Action)
+	assert.Equal(t, "api", revisions[1].Author)
+}
+
+func TestPurgeDeletedProductsKeepsRevisions(t *testing.T) {
+	e, db := newProductTestServer(t)
+	expired := postProduct(t, e, "Kubek", "25.00")
+	recent := postProduct(t, e, "Talerz", "40.00")
+	for _, p := range []Product{expired, recent} {
+		require.Equal(t, http.StatusNoContent, doRequest(e, http.MethodDelete, fmt.Sprintf("/products/%d", p.ID), "").Code)
+	}
+	require.NoError(t, db.Unscoped().Model(&Product{}).Where("id = ?", expired.ID).
+		Update("deleted_at", time.Now().Add(-productTrashRetention-time.Hour)).Error)
+
+	n, err := PurgeDeletedProducts(db, productTrashRetention)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.ErrorIs(t, db.Unscoped().First(&Product{}, expired.ID).Error, gorm.ErrRecordNotFound)
+	require.NoError(t, db.Unscoped().First(&Product{}, recent.ID).Error)
+
+	// historia usuniętego produktu zostaje i kończy się rewizją "purged"
+	revisions := productRevisions(t, e, expired.ID)
+	require.Len(t, revisions, 3)
+	assert.Equal(t, RevisionPurged, revisions[0].Action)
+	assert.Equal(t, "system", revisions[0].Author)
+	assert.Equal(t, "Kubek", revisions[0].Name)
+	assert.Equal(t, http.StatusNotFound, doRequest(e, http.MethodGet, fmt.Sprintf("/products/%d", expired.ID), "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(e, http.MethodPost, fmt.Sprintf("/products/%d/restore", expired.ID), "").Code)
+
+	n, err = PurgeDeletedProducts(db, productTrashRetention)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Len(t, productRevisions(t, e, expired.ID), 3)
+}
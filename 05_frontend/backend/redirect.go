@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Płatności z przekierowaniem (w stylu PayU/Przelewy24). /payments zwraca redirect_url
+// strony operatora, klient płaci tam i wraca przez /payments/:id/return, a operator
+// niezależnie wysyła podpisany webhook na /webhooks/payments. Lokalnie operatora
+// zastępuje serwer cmd/fakeprovider.
+
+var (
+	redirectGatewayName    = envString("REDIRECT_GATEWAY", "hosted")
+	redirectPaymentTimeout = envDuration("REDIRECT_PAYMENT_TIMEOUT", 30*time.Minute)
+	hostedProviderURL      = envString("HOSTED_PROVIDER_URL", "http://localhost:1324")
+	hostedProviderKey      = envString("HOSTED_PROVIDER_KEY", "local-provider-key")
+	publicURL              = envString("PUBLIC_URL", "http://localhost:1323")
+	frontendURL            = envString("FRONTEND_URL", "http://localhost:3000")
+)
+
+var ErrUnsupportedOperation = errors.New("operation not supported by gateway")
+
+type RedirectRequest struct {
+	Amount      Money
+	Reference   string
+	Description string
+	NotifyURL   string
+	ContinueURL string
+}
+
+type RedirectSession struct {
+	Reference   string
+	RedirectURL string
+}
+
+// RedirectGateway to opcjonalna funkcja bramki: płatność na stronie operatora
+type RedirectGateway interface {
+	StartRedirect(ctx context.Context, req RedirectRequest) (*RedirectSession, error)
+}
+
+// HostedGateway rozmawia z operatorem płatności przez jego REST API.
+// Obsługuje tylko płatności z przekierowaniem oraz ich anulowanie i zwroty.
+type HostedGateway struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func NewHostedGateway(baseURL, apiKey string) *HostedGateway {
+	return &HostedGateway{baseURL: strings.TrimRight(baseURL, "/"), apiKey: apiKey, client: &http.Client{}}
+}
+
+func (g *HostedGateway) Name() string { return "hosted" }
+
+func (g *HostedGateway) Tokenize(ctx context.Context, card CardDetails) (string, error) {
+	return "", ErrUnsupportedOperation
+}
+
+func (g *HostedGateway) Authorize(ctx context.Context, req AuthorizeRequest) (*Authorization, error) {
+	return nil, ErrUnsupportedOperation
+}
+
+func (g *HostedGateway) Capture(ctx context.Context, reference string, amount Money) error {
+	return ErrUnsupportedOperation
+}
+
+func (g *HostedGateway) Void(ctx context.Context, reference string) error {
+	return g.call(ctx, "/api/orders/"+reference+"/cancel", nil, nil)
+}
+
+func (g *HostedGateway) Refund(ctx context.Context, reference string, amount Money) (string, error) {
+	var res struct {
+		RefundID string `json:"refund_id"`
+	}
+	err := g.call(ctx, "/api/orders/"+reference+"/refunds", map[string]interface{}{
+		"amount": amount.Amount, "currency": amount.Currency,
+	}, &res)
+	return res.RefundID, err
+}
+
+func (g *HostedGateway) StartRedirect(ctx context.Context, req RedirectRequest) (*RedirectSession, error) {
+	var res struct {
+		OrderID     string `json:"order_id"`
+		RedirectURI string `json:"redirect_uri"`
+	}
+	// kwoty u operatora są w jednostkach podrzędnych (grosze)
+	err := g.call(ctx, "/api/orders", map[string]interface{}{
+		"total_amount": req.Amount.Amount,
+		"currency":     req.Amount.Currency,
+		"ext_order_id": req.Reference,
+		"description":  req.Description,
+		"notify_url":   req.NotifyURL,
+		"continue_url": req.ContinueURL,
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &RedirectSession{Reference: res.OrderID, RedirectURL: res.RedirectURI}, nil
+}
+
+func (g *HostedGateway) call(ctx context.Context, path string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+g.apiKey)
+	res, err := g.client.Do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return ErrGatewayTimeout
+		}
+		return fmt.Errorf("hosted provider: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&e)
+		switch {
+		case res.StatusCode == http.StatusPaymentRequired:
+			return ErrPaymentDeclined
+		case res.StatusCode == http.StatusNotFound:
+			return ErrUnknownAuthorization
+		case res.StatusCode == http.StatusConflict:
+			return ErrInvalidGatewayState
+		}
+		return fmt.Errorf("hosted provider: %d %s", res.StatusCode, e.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// redirectGateway zwraca pierwszą skonfigurowaną bramkę obsługującą przekierowania
+func redirectGateway(gateways Gateways) (PaymentGateway, RedirectGateway, bool) {
+	for _, g := range gateways {
+		if rg, ok := g.(RedirectGateway); ok {
+			return g, rg, true
+		}
+	}
+	return nil, nil, false
+}
+
+func startRedirectPayment(c echo.Context, cart *Cart, order *Order, totals *CartTotals, amount Money) error {
+	db := c.Get("db").(*gorm.DB)
+	gateway, redirect, ok := redirectGateway(c.Get("gateways").(Gateways))
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Redirect payments are not configured")
+	}
+	record, err := beginAwaitingPayment(db, cart, order, totals, amount, PaymentMethodRedirect, gateway.Name())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), paymentGatewayTimeout)
+	defer cancel()
+	session, err := redirect.StartRedirect(ctx, RedirectRequest{
+		Amount:      amount,
+		Reference:   fmt.Sprintf("payment-%d", record.ID),
+		Description: fmt.Sprintf("Zamówienie %d", *record.OrderID),
+		NotifyURL:   publicURL + "/webhooks/payments",
+		ContinueURL: fmt.Sprintf("%s/payments/%d/return", publicURL, record.ID),
+	})
+	if err != nil {
+		failPayment(db, record, PaymentFailed, err)
+		return gatewayError(err)
+	}
+	record.RedirectURL = session.RedirectURL
+	if err := markPaymentAwaiting(db, record, session.Reference, redirectPaymentTimeout); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not record payment")
+	}
+	return c.JSON(http.StatusAccepted, record)
+}
+
+// paymentReturn to adres powrotu klienta od operatora lub ze strony 3-D Secure; wynik płatności przychodzi
+// webhookiem, więc frontend dostaje tylko id płatności i sam odpytuje jej status
+func paymentReturn(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	var payment Payment
+	if err := db.Select("id").First(&payment, c.Param("id")).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Payment not found")
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/payments?payment_id=%d", frontendURL, payment.ID))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// testProvider udaje REST API operatora płatności (jak cmd/fakeprovider)
+type testProvider struct {
+	mu        sync.Mutex
+	orders    []map[string]interface{}
+	cancelled []string
+	decline   bool
+}
+
+func (p *testProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer test-key" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.URL.Path == "/api/orders":
+		if p.decline {
+			w.WriteHeader(http.StatusPaymentRequired)
+			return
+		}
+		var order map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&order)
+		p.orders = append(p.orders, order)
+		id := fmt.Sprintf("ord_%d", len(p.orders))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"order_id": id, "redirect_uri": "https://pay.example/" + id})
+	case strings.HasSuffix(r.URL.Path, "/cancel"):
+		p.cancelled = append(p.cancelled, strings.Split(r.URL.Path, "/")[3])
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newRedirectTestServer(t *testing.T) (*echo.Echo, *gorm.DB, *testProvider, Gateways) {
+	db := newTestDB(t, schemaModels...)
+	previous := orderEvents
+	orderEvents = &EventBus{}
+	t.Cleanup(func() { orderEvents = previous })
+
+	provider := &testProvider{}
+	server := httptest.NewServer(provider)
+	t.Cleanup(server.Close)
+	gateways := Gateways{newTestFakeGateway(t), NewHostedGateway(server.URL, "test-key")}
+	registerOrderEventHandlers(db, gateways)
+
+	e := echo.New()
+	e.Use(DBMiddleware(db))
+	e.Use(GatewayMiddleware(gateways))
+	e.POST("/payments", processPayment)
+	e.GET("/payments/:id/return", paymentReturn)
+	e.POST("/webhooks/payments", receivePaymentWebhook)
+	return e, db, provider, gateways
+}
+
+func startRedirect(t *testing.T, e *echo.Echo, db *gorm.DB, cart *Cart) *httptest.ResponseRecorder {
+	t.Helper()
+	totals, err := ComputeTotals(db, cart)
+	require.NoError(t, err)
+	return doRequest(e, http.MethodPost, "/payments",
+		fmt.Sprintf(`{"cart_id":%d,"method":"redirect","amount":%s}`, cart.ID, totals.Total.Decimal()))
+}
+
+func TestRedirectPaymentIsSettledByWebhook(t *testing.T) {
+	e, db, provider, _ := newRedirectTestServer(t)
+	cart, product := newTestCart(t, db, 5, 2)
+
+	rec := startRedirect(t, e, db, cart)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var payment Payment
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &payment))
+	assert.Equal(t, PaymentAwaitingConfirmation, payment.Status)
+	assert.Equal(t, "https://pay.example/ord_1", payment.RedirectURL)
+	assert.Equal(t, "ord_1", payment.GatewayReference)
+	require.Len(t, provider.orders, 1)
+	assert.Equal(t, fmt.Sprintf("payment-%d", payment.ID), provider.orders[0]["ext_order_id"])
+	assert.Equal(t, float64(6500), provider.orders[0]["total_amount"], "amount is sent in minor units")
+	assert.Equal(t, publicURL+"/webhooks/payments", provider.orders[0]["notify_url"])
+
+	// powrót klienta niczego nie rozlicza, tylko odsyła do frontendu
+	rec = doRequest(e, http.MethodGet, fmt.Sprintf("/payments/%d/return", payment.ID), "")
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, fmt.Sprintf("%s/payments?payment_id=%d", frontendURL, payment.ID), rec.Header().Get("Location"))
+	require.NoError(t, db.First(&payment, payment.ID).Error)
+	assert.Equal(t, PaymentAwaitingConfirmation, payment.Status)
+
+	code, res := postWebhook(e, `{"id":"evt_r1","type":"payment.succeeded","data":{"gateway_reference":"ord_1"}}`, time.Now())
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, PaymentCaptured, res["result"])
+	require.NoError(t, db.First(&payment, payment.ID).Error)
+	assert.Equal(t, PaymentCaptured, payment.Status)
+	var order Order
+	require.NoError(t, db.First(&order, *payment.OrderID).Error)
+	assert.Equal(t, OrderPaid, order.Status)
+	assert.Equal(t, "ord_1", order.TransactionID)
+	assert.Equal(t, 3, productStock(t, db, product.ID))
+}
+
+func TestExpiredRedirectPaymentIsCancelledAtProvider(t *testing.T) {
+	e, db, provider, gateways := newRedirectTestServer(t)
+	cart, _ := newTestCart(t, db, 5, 1)
+	rec := startRedirect(t, e, db, cart)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var payment Payment
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &payment))
+	require.NoError(t, db.Model(&Payment{}).Where("id = ?", payment.ID).Update("expires_at", time.Now().Add(-time.Second)).Error)
+
+	n, err := ExpireAwaitingPayments(db, gateways)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"ord_1"}, provider.cancelled)
+
+	// spóźnione potwierdzenie nie opłaca już wygaszonej płatności
+	code, res := postWebhook(e, `{"id":"evt_r2","type":"payment.succeeded","data":{"gateway_reference":"ord_1"}}`, time.Now())
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "already_"+PaymentFailed, res["result"])
+	var stored Cart
+	require.NoError(t, db.First(&stored, cart.ID).Error)
+	assert.Equal(t, CartCheckedOut, stored.Status)
+}
+
+func TestRedirectPaymentDeclinedByProvider(t *testing.T) {
+	e, db, provider, _ := newRedirectTestServer(t)
+	cart, _ := newTestCart(t, db, 5, 1)
+	provider.decline = true
+
+	rec := startRedirect(t, e, db, cart)
+	assert.Equal(t, http.StatusPaymentRequired, rec.Code)
+	var payment Payment
+	require.NoError(t, db.Where("cart_id = ?", cart.ID).Take(&payment).Error)
+	assert.Equal(t, PaymentMethodRedirect, payment.Method)
+	assert.Equal(t, PaymentFailed, payment.Status)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Zwroty płatności. Zwrot jest najpierw zapisywany jako pending (co blokuje kwotę
+// przed równoległym zwrotem), potem wysyłany do bramki, a po sukcesie zwrócone
+// pozycje wracają na stan. Zwrot bez pozycji to zwrot samej kwoty, bez zwrotu towaru.
+// Po anulowaniu zamówienia towar jest już na stanie, więc zwrot oddaje tylko pieniądze.
+
+const (
+	RefundPending   = "pending"
+	RefundSucceeded = "succeeded"
+	RefundFailed    = "failed"
+)
+
+var (
+	ErrPaymentNotRefundable = errors.New("payment cannot be refunded")
+	ErrRefundTooLarge       = errors.New("refund exceeds captured amount")
+	ErrInvalidRefundItems   = errors.New("invalid refund items")
+)
+
+type Refund struct {
+	ID               uint         `gorm:"primaryKey" json:"id"`
+	PaymentID        uint         `gorm:"index" json:"payment_id"`
+	OrderID          *uint        `gorm:"index" json:"order_id,omitempty"`
+	Status           string       `gorm:"index" json:"status"`
+	Amount           Money        `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	Currency         string       `json:"currency"`
+	Reason           string       `json:"reason,omitempty"`
+	Items            []RefundItem `gorm:"foreignKey:RefundID" json:"items"`
+	GatewayReference string       `json:"gateway_reference,omitempty"`
+	ErrorReason      string       `json:"error_reason,omitempty"`
+	CreatedAt        time.Time    `json:"created_at"`
+	UpdatedAt        time.Time    `json:"updated_at"`
+}
+
+type RefundItem struct {
+	ID          uint `gorm:"primaryKey" json:"id"`
+	RefundID    uint `gorm:"index" json:"refund_id"`
+	OrderItemID uint `gorm:"index" json:"order_item_id"`
+	ProductID   uint `json:"product_id"`
+	Quantity    int  `json:"quantity"`
+}
+
+type RefundRequest struct {
+	Amount *Money `json:"amount"`
+	Reason string `json:"reason"`
+	Items  []struct {
+		OrderItemID uint `json:"order_item_id"`
+		Quantity    int  `json:"quantity"`
+	} `json:"items"`
+}
+
+// refundedQuantities zwraca orderItemID -> ilość objętą zwrotami w toku lub udanymi
+func refundedQuantities(db *gorm.DB, orderID uint) (map[uint]int, error) {
+	var rows []struct {
+		OrderItemID uint
+		Quantity    int
+	}
+	err := db.Table("refund_items").
+		Select("refund_items.order_item_id, SUM(refund_items.quantity) AS quantity").
+		Joins("JOIN refunds ON refunds.id = refund_items.refund_id").
+		Where("refunds.order_id = ? AND refunds.status IN ?", orderID, []string{RefundPending, RefundSucceeded}).
+		Group("refund_items.order_item_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	quantities := make(map[uint]int, len(rows))
+	for _, r := range rows {
+		quantities[r.OrderItemID] = r.Quantity
+	}
+	return quantities, nil
+}
+
+// reserveRefund sprawdza limity i zapisuje zwrot jako pending
+func reserveRefund(tx *gorm.DB, paymentID uint, req RefundRequest) (*Refund, *Payment, error) {
+	var payment Payment
+	if err := tx.First(&payment, paymentID).Error; err != nil {
+		return nil, nil, err
+	}
+	if payment.Status != PaymentCaptured && payment.Status != PaymentPartiallyRefunded {
+		return nil, nil, ErrPaymentNotRefundable
+	}
+
+	var reserved int64
+	if err := tx.Model(&Refund{}).Select("COALESCE(SUM(amount_amount), 0)").
+		Where("payment_id = ? AND status IN ?", payment.ID, []string{RefundPending, RefundSucceeded}).
+		Scan(&reserved).Error; err != nil {
+		return nil, nil, err
+	}
+	remaining := NewMoney(payment.Amount.Amount-reserved, payment.Amount.Currency)
+
+	var order Order
+	if payment.OrderID != nil {
+		if err := tx.Preload("Items").First(&order, *payment.OrderID).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+	already := map[uint]int{}
+	if order.ID != 0 {
+		var err error
+		if already, err = refundedQuantities(tx, order.ID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	refund := &Refund{PaymentID: payment.ID, OrderID: payment.OrderID, Status: RefundPending, Reason: req.Reason, Items: []RefundItem{}}
+	itemsValue := NewMoney(0, payment.Amount.Currency)
+	byID := make(map[uint]OrderItem, len(order.Items))
+	for _, item := range order.Items {
+		byID[item.ID] = item
+	}
+	for _, ri := range req.Items {
+		item, ok := byID[ri.OrderItemID]
+		if !ok || ri.Quantity < 1 || ri.Quantity > item.Quantity-already[item.ID] {
+			return nil, nil, ErrInvalidRefundItems
+		}
+		already[item.ID] += ri.Quantity
+		refund.Items = append(refund.Items, RefundItem{OrderItemID: item.ID, ProductID: item.ProductID, Quantity: ri.Quantity})
+		value, err := item.UnitPrice.Mul(int64(ri.Quantity))
+		if err != nil {
+			return nil, nil, err
+		}
+		if itemsValue, err = itemsValue.Add(value); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	switch {
+	case req.Amount != nil:
+		refund.Amount = *req.Amount
+	case len(req.Items) > 0:
+		// wartość zwracanych pozycji, ale nie więcej niż pozostało (np. po rabacie)
+		refund.Amount = itemsValue
+		if refund.Amount.Amount > remaining.Amount {
+			refund.Amount = remaining
+		}
+	default:
+		// pełny zwrot pozostałej kwoty razem ze wszystkimi jeszcze niezwróconymi pozycjami
+		refund.Amount = remaining
+		for _, item := range order.Items {
+			if qty := item.Quantity - already[item.ID]; qty > 0 {
+				refund.Items = append(refund.Items, RefundItem{OrderItemID: item.ID, ProductID: item.ProductID, Quantity: qty})
+			}
+		}
+	}
+	if refund.Amount.Currency != payment.Amount.Currency {
+		return nil, nil, ErrCurrencyMismatch
+	}
+	if refund.Amount.Amount <= 0 {
+		return nil, nil, ErrInvalidAmount
+	}
+	if refund.Amount.Amount > remaining.Amount {
+		return nil, nil, ErrRefundTooLarge
+	}
+	refund.Currency = refund.Amount.Currency
+	if err := tx.Create(refund).Error; err != nil {
+		return nil, nil, err
+	}
+	return refund, &payment, nil
+}
+
+// completeRefund zapisuje wynik z bramki, przywraca towar na stan i aktualizuje płatność;
+// po pełnym zwrocie zamówienie przechodzi w refunded (o ile pozwala na to jego status)
+func completeRefund(tx *gorm.DB, refund *Refund, payment *Payment, gatewayRef string) (*OrderEvent, error) {
+	refund.Status = RefundSucceeded
+	refund.GatewayReference = gatewayRef
+	if err := tx.Model(refund).Updates(map[string]interface{}{"status": refund.Status, "gateway_reference": gatewayRef}).Error; err != nil {
+		return nil, err
+	}
+	restock, err := refundRestocks(tx, refund)
+	if err != nil {
+		return nil, err
+	}
+	if restock {
+		quantities := make(map[uint]int, len(refund.Items))
+		for _, item := range refund.Items {
+			quantities[item.ProductID] += item.Quantity
+		}
+		if err := RestockProducts(tx, quantities); err != nil {
+			return nil, err
+		}
+	}
+
+	var refunded int64
+	if err := tx.Model(&Refund{}).Select("COALESCE(SUM(amount_amount), 0)").
+		Where("payment_id = ? AND status = ?", payment.ID, RefundSucceeded).Scan(&refunded).Error; err != nil {
+		return nil, err
+	}
+	payment.Status = PaymentPartiallyRefunded
+	if refunded >= payment.Amount.Amount {
+		payment.Status = PaymentRefunded
+	}
+	if err := tx.Model(payment).Update("status", payment.Status).Error; err != nil {
+		return nil, err
+	}
+	if payment.Status != PaymentRefunded || payment.OrderID == nil {
+		return nil, nil
+	}
+
+	var order Order
+	if err := tx.First(&order, *payment.OrderID).Error; err != nil {
+		return nil, err
+	}
+	if !CanTransition(order.Status, OrderRefunded) {
+		return nil, nil
+	}
+	event, err := transitionOrder(tx, &order, OrderRefunded, "refunds", refund.Reason)
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// refundRestocks mówi, czy pozycje zwrotu mają wrócić na stan. Anulowanie opłaconego
+// zamówienia zwraca na stan wszystko poza pozycjami z wcześniejszych zwrotów, więc zwrot
+// zarezerwowany po anulowaniu nie może zwrócić towaru drugi raz.
+func refundRestocks(tx *gorm.DB, refund *Refund) (bool, error) {
+	if refund.OrderID == nil || len(refund.Items) == 0 {
+		return len(refund.Items) > 0, nil
+	}
+	var order Order
+	if err := tx.Select("id", "status").First(&order, *refund.OrderID).Error; err != nil {
+		return false, err
+	}
+	if order.Status != OrderCancelled {
+		return true, nil
+	}
+	var cancelled OrderTransition
+	if err := tx.Where(&OrderTransition{OrderID: order.ID, To: OrderCancelled}).Order("id DESC").Take(&cancelled).Error; err != nil {
+		return false, err
+	}
+	return refund.CreatedAt.Before(cancelled.CreatedAt), nil
+}
+
+func refundError(err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Payment not found")
+	case errors.Is(err, ErrPaymentNotRefundable):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Payment cannot be refunded")
+	case errors.Is(err, ErrRefundTooLarge):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Refund exceeds the remaining captured amount")
+	case errors.Is(err, ErrInvalidRefundItems):
+		return echo.NewHTTPError(http.StatusBadRequest, "Refund items must reference order items with quantities not yet refunded")
+	case errors.Is(err, ErrCurrencyMismatch):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Refund currency does not match payment currency")
+	case errors.Is(err, ErrInvalidAmount):
+		return echo.NewHTTPError(http.StatusBadRequest, "Refund amount must be positive")
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, "Could not create refund")
+}
+
+func createRefund(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	gateways := c.Get("gateways").(Gateways)
+	paymentID, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	var req RefundRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid refund data")
+	}
+
+	// zwrot musi trafić do bramki, która pobrała płatność - bez niej nie ma czego rezerwować
+	var target Payment
+	if err := db.Select("id", "gateway").First(&target, paymentID).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Payment not found")
+	}
+	gateway, err := gateways.Lookup(target.Gateway)
+	if err != nil {
+		return gatewayError(err)
+	}
+
+	var refund *Refund
+	var payment *Payment
+	err = db.Transaction(func(tx *gorm.DB) error {
+		refund, payment, err = reserveRefund(tx, paymentID, req)
+		return err
+	})
+	if err != nil {
+		return refundError(err)
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), paymentGatewayTimeout)
+	defer cancel()
+	gatewayRef, err := gateway.Refund(ctx, payment.GatewayReference, refund.Amount)
+	if err != nil {
+		refund.Status = RefundFailed
+		refund.ErrorReason = err.Error()
+		if dbErr := db.Model(refund).Updates(map[string]interface{}{
+			"status": refund.Status, "error_reason": refund.ErrorReason,
+		}).Error; dbErr != nil {
+			log.Printf("refunds: could not update refund %d: %v", refund.ID, dbErr)
+		}
+		return gatewayError(err)
+	}
+
+	var event *OrderEvent
+	err = db.Transaction(func(tx *gorm.DB) error {
+		event, err = completeRefund(tx, refund, payment, gatewayRef)
+		return err
+	})
+	if err != nil {
+		// pieniądze zostały zwrócone przez bramkę, więc zwrot zostaje w stanie pending do wyjaśnienia
+		log.Printf("refunds: refund %d (%s) succeeded at gateway but could not be saved: %v", refund.ID, gatewayRef, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Refund %d was sent but could not be recorded", refund.ID))
+	}
+	if event != nil {
+		orderEvents.Publish(*event)
+	}
+	return c.JSON(http.StatusCreated, refund)
+}
+
+func getPaymentRefunds(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	paymentID, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	if err := db.Select("id").First(&Payment{}, paymentID).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Payment not found")
+	}
+	refunds := []Refund{}
+	if err := db.Preload("Items").Where("payment_id = ?", paymentID).Order("id").Find(&refunds).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch refunds")
+	}
+	return c.JSON(http.StatusOK, refunds)
+}
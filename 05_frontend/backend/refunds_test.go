@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// capturedPayment opłaca kartą koszyk z qty sztukami produktu o podanym stanie
+func capturedPayment(t *testing.T, db *gorm.DB, gateway *FakeGateway, stock, qty int) (*Payment, *Order, *Product) {
+	t.Helper()
+	cart, product := newTestCart(t, db, stock, qty)
+	totals, err := ComputeTotals(db, cart)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	token, err := gateway.Tokenize(ctx, CardDetails{Number: "4242424242424242", ExpMonth: 12, ExpYear: 2030, CVC: "123"})
+	require.NoError(t, err)
+	auth, err := gateway.Authorize(ctx, AuthorizeRequest{CardToken: token, Amount: totals.Total})
+	require.NoError(t, err)
+	require.NoError(t, gateway.Capture(ctx, auth.Reference, totals.Total))
+
+	record := &Payment{CartID: cart.ID, Status: PaymentAuthorized, Amount: totals.Total, Currency: totals.Currency,
+		Gateway: gateway.Name(), GatewayReference: auth.Reference}
+	require.NoError(t, db.Create(record).Error)
+	var order *Order
+	require.NoError(t, db.Transaction(func(tx *gorm.DB) error {
+		order, _, err = settlePayment(tx, record, cart, nil, totals, "test")
+		return err
+	}))
+	require.NoError(t, db.Preload("Items").First(order, order.ID).Error)
+	return record, order, product
+}
+
+func productStock(t *testing.T, db *gorm.DB, id uint) int {
+	t.Helper()
+	var product Product
+	require.NoError(t, db.First(&product, id).Error)
+	require.NotNil(t, product.Stock)
+	return *product.Stock
+}
+
+func postRefund(e *echo.Echo, paymentID uint, body string) int {
+	return doRequest(e, http.MethodPost, fmt.Sprintf("/payments/%d/refunds", paymentID), body,
+		adminTokenHeader, testAdminToken).Code
+}
+
+func TestRefundRequiresAdmin(t *testing.T) {
+	e, db, gateway := newPaymentTestServer(t)
+	payment, order, product := capturedPayment(t, db, gateway, 5, 2)
+
+	rec := doRequest(e, http.MethodPost, fmt.Sprintf("/payments/%d/refunds", payment.ID), `{}`)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doRequest(e, http.MethodPost, fmt.Sprintf("/payments/%d/refunds", payment.ID), `{}`, adminTokenHeader, "zgadniety-token-123")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	var refunds int64
+	require.NoError(t, db.Model(&Refund{}).Count(&refunds).Error)
+	assert.Zero(t, refunds)
+	require.NoError(t, db.First(order, order.ID).Error)
+	assert.Equal(t, OrderPaid, order.Status)
+	assert.Equal(t, 3, productStock(t, db, product.ID))
+}
+
+func TestFullRefundRestocksItems(t *testing.T) {
+	e, db, gateway := newPaymentTestServer(t)
+	payment, order, product := capturedPayment(t, db, gateway, 5, 2)
+	require.Equal(t, 3, productStock(t, db, product.ID))
+
+	require.Equal(t, http.StatusCreated, postRefund(e, payment.ID, `{"reason":"zwrot"}`))
+	assert.Equal(t, 5, productStock(t, db, product.ID))
+	require.NoError(t, db.First(payment, payment.ID).Error)
+	assert.Equal(t, PaymentRefunded, payment.Status)
+	require.NoError(t, db.First(order, order.ID).Error)
+	assert.Equal(t, OrderRefunded, order.Status)
+
+	// nic już nie zostało do zwrotu
+	assert.Equal(t, http.StatusUnprocessableEntity, postRefund(e, payment.ID, `{}`))
+	assert.Equal(t, 5, productStock(t, db, product.ID))
+}
+
+func TestPartialRefundRestocksReturnedItems(t *testing.T) {
+	e, db, gateway := newPaymentTestServer(t)
+	payment, order, product := capturedPayment(t, db, gateway, 5, 2)
+	itemID := order.Items[0].ID
+
+	require.Equal(t, http.StatusCreated, postRefund(e, payment.ID, fmt.Sprintf(`{"items":[{"order_item_id":%d,"quantity":1}]}`, itemID)))
+	assert.Equal(t, 4, productStock(t, db, product.ID))
+	require.NoError(t, db.First(payment, payment.ID).Error)
+	assert.Equal(t, PaymentPartiallyRefunded, payment.Status)
+	var refund Refund
+	require.NoError(t, db.Last(&refund).Error)
+	assert.Equal(t, NewMoney(2500, "PLN"), refund.Amount)
+
+	// zwrócona sztuka nie może wrócić drugi raz
+	assert.Equal(t, http.StatusBadRequest, postRefund(e, payment.ID, fmt.Sprintf(`{"items":[{"order_item_id":%d,"quantity":2}]}`, itemID)))
+	// zwrot samej kwoty nie zmienia stanu
+	require.Equal(t, http.StatusCreated, postRefund(e, payment.ID, `{"amount":"1.00"}`))
+	assert.Equal(t, 4, productStock(t, db, product.ID))
+	// pełny zwrot reszty oddaje pozostałą sztukę
+	require.Equal(t, http.StatusCreated, postRefund(e, payment.ID, `{}`))
+	assert.Equal(t, 5, productStock(t, db, product.ID))
+	require.NoError(t, db.First(payment, payment.ID).Error)
+	assert.Equal(t, PaymentRefunded, payment.Status)
+}
+
+func TestRefundAfterCancelDoesNotRestockAgain(t *testing.T) {
+	e, db, gateway := newPaymentTestServer(t)
+	payment, order, product := capturedPayment(t, db, gateway, 5, 2)
+
+	_, err := TransitionOrder(db, order.ID, OrderCancelled, "test", "klient zrezygnował")
+	require.NoError(t, err)
+	require.Equal(t, 5, productStock(t, db, product.ID))
+
+	require.Equal(t, http.StatusCreated, postRefund(e, payment.ID, `{}`))
+	assert.Equal(t, 5, productStock(t, db, product.ID))
+	require.NoError(t, db.First(payment, payment.ID).Error)
+	assert.Equal(t, PaymentRefunded, payment.Status)
+	require.NoError(t, db.First(order, order.ID).Error)
+	assert.Equal(t, OrderCancelled, order.Status)
+}
+
+func TestRefundPendingDuringCancelRestocksItsItems(t *testing.T) {
+	_, db, gateway := newPaymentTestServer(t)
+	payment, order, product := capturedPayment(t, db, gateway, 5, 2)
+
+	// zwrot jednej sztuki czeka na bramkę, gdy zamówienie zostaje anulowane
+	req := RefundRequest{}
+	req.Items = append(req.Items, struct {
+		OrderItemID uint `json:"order_item_id"`
+		Quantity    int  `json:"quantity"`
+	}{order.Items[0].ID, 1})
+	refund, payment, err := reserveRefund(db, payment.ID, req)
+	require.NoError(t, err)
+	_, err = TransitionOrder(db, order.ID, OrderCancelled, "test", "")
+	require.NoError(t, err)
+	require.Equal(t, 4, productStock(t, db, product.ID))
+
+	_, err = completeRefund(db, refund, payment, "fake_refund_1")
+	require.NoError(t, err)
+	assert.Equal(t, 5, productStock(t, db, product.ID))
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Zapisane karty klienta. Przechowywany jest wyłącznie token bramki i dane do wyświetlenia
+// (marka, zamaskowany numer, ważność) - bez odcisku karty, który wiązałby token z numerem.
+// Kartę zapisuje się z ustawień konta albo przy płatności (save_card),
+// wtedy dopiero po udanym pobraniu środków.
+
+type SavedPaymentMethod struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	CustomerID uint      `gorm:"index" json:"customer_id"`
+	Gateway    string    `json:"gateway"`
+	Token      string    `json:"-"`
+	CardBrand  string    `json:"card_brand"`
+	CardMasked string    `json:"card_masked"`
+	ExpMonth   int       `json:"exp_month"`
+	ExpYear    int       `json:"exp_year"`
+	IsDefault  bool      `json:"is_default"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Expired mówi, czy karta jest już po ostatnim dniu miesiąca ważności
+func (m *SavedPaymentMethod) Expired(now time.Time) bool {
+	return !now.Before(time.Date(m.ExpYear, time.Month(m.ExpMonth)+1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+// TokenRemover to opcjonalna funkcja bramki: usunięcie tokenu, gdy klient usuwa kartę
+type TokenRemover interface {
+	DeleteToken(ctx context.Context, token string) error
+}
+
+func (g *FakeGateway) DeleteToken(ctx context.Context, token string) error {
+	return g.db.Where("token = ?", token).Delete(&FakeGatewayToken{}).Error
+}
+
+// SavePaymentMethod zapisuje kartę klienta; karta o tej samej marce, końcówce numeru i ważności
+// zastępuje poprzedni wpis. Pierwsza zapisana karta staje się domyślną.
+func SavePaymentMethod(db *gorm.DB, method *SavedPaymentMethod) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var existing SavedPaymentMethod
+		err := tx.Where("customer_id = ? AND card_brand = ? AND card_masked = ? AND exp_month = ? AND exp_year = ?",
+			method.CustomerID, method.CardBrand, method.CardMasked, method.ExpMonth, method.ExpYear).Take(&existing).Error
+		if err == nil {
+			method.ID = existing.ID
+			method.IsDefault = existing.IsDefault
+			method.CreatedAt = existing.CreatedAt
+			return tx.Save(method).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		var count int64
+		if err := tx.Model(&SavedPaymentMethod{}).Where("customer_id = ?", method.CustomerID).Count(&count).Error; err != nil {
+			return err
+		}
+		method.IsDefault = count == 0
+		return tx.Create(method).Error
+	})
+}
+
+// saveCardFromPayment zapamiętuje kartę z pobranej płatności, jeśli klient o to prosił
+func saveCardFromPayment(db *gorm.DB, record *Payment) {
+	if !record.SaveCard || record.CustomerID == nil || record.CardToken == "" {
+		return
+	}
+	err := SavePaymentMethod(db, &SavedPaymentMethod{
+		CustomerID: *record.CustomerID,
+		Gateway:    record.Gateway,
+		Token:      record.CardToken,
+		CardBrand:  record.CardBrand,
+		CardMasked: record.CardMasked,
+		ExpMonth:   record.CardExpMonth,
+		ExpYear:    record.CardExpYear,
+	})
+	if err != nil {
+		log.Printf("payments: could not save card from payment %d: %v", record.ID, err)
+	}
+}
+
+// MigrateSavedPaymentMethods usuwa kolumnę fingerprint ze starszych baz
+func MigrateSavedPaymentMethods(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&SavedPaymentMethod{}, "fingerprint") {
+		return nil
+	}
+	return db.Migrator().DropColumn(&SavedPaymentMethod{}, "fingerprint")
+}
+
+// customerPaymentMethod zwraca zapisaną kartę zalogowanego klienta
+func customerPaymentMethod(c echo.Context, id uint) (*SavedPaymentMethod, error) {
+	customer, err := requireCustomer(c)
+	if err != nil {
+		return nil, err
+	}
+	db := c.Get("db").(*gorm.DB)
+	var method SavedPaymentMethod
+	if err := db.Where("customer_id = ?", customer.ID).First(&method, id).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Payment method not found")
+	}
+	return &method, nil
+}
+
+func getPaymentMethods(c echo.Context) error {
+	customer, err := requireCustomer(c)
+	if err != nil {
+		return err
+	}
+	db := c.Get("db").(*gorm.DB)
+	methods := []SavedPaymentMethod{}
+	if err := db.Where("customer_id = ?", customer.ID).Order("is_default DESC, id").Find(&methods).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch payment methods")
+	}
+	return c.JSON(http.StatusOK, methods)
+}
+
+// createPaymentMethod dodaje kartę z ustawień konta: walidacja i tokenizacja jak przy płatności
+func createPaymentMethod(c echo.Context) error {
+	customer, err := requireCustomer(c)
+	if err != nil {
+		return err
+	}
+	db := c.Get("db").(*gorm.DB)
+	gateway := c.Get("gateway").(PaymentGateway)
+	var body struct {
+		CardNumber string `json:"card_number"`
+		ExpMonth   int    `json:"exp_month"`
+		ExpYear    int    `json:"exp_year"`
+		CVC        string `json:"cvc"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid card data")
+	}
+	card, err := ValidateCard(body.CardNumber, body.ExpMonth, body.ExpYear, body.CVC, time.Now().UTC())
+	body.CardNumber, body.CVC = "", ""
+	if err != nil {
+		return cardError(err)
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), paymentGatewayTimeout)
+	defer cancel()
+	token, err := gateway.Tokenize(ctx, *card)
+	if err != nil {
+		return gatewayError(err)
+	}
+	method := &SavedPaymentMethod{
+		CustomerID: customer.ID,
+		Gateway:    gateway.Name(),
+		Token:      token,
+		CardBrand:  card.Brand,
+		CardMasked: card.Masked(),
+		ExpMonth:   card.ExpMonth,
+		ExpYear:    card.ExpYear,
+	}
+	if err := SavePaymentMethod(db, method); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not save payment method")
+	}
+	return c.JSON(http.StatusCreated, method)
+}
+
+func deletePaymentMethod(c echo.Context) error {
+	id, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	method, err := customerPaymentMethod(c, id)
+	if err != nil {
+		return err
+	}
+	db := c.Get("db").(*gorm.DB)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(method).Error; err != nil {
+			return err
+		}
+		if !method.IsDefault {
+			return nil
+		}
+		// domyślną staje się najstarsza z pozostałych kart
+		var next SavedPaymentMethod
+		if err := tx.Where("customer_id = ?", method.CustomerID).Order("id").Take(&next).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+		return tx.Model(&next).Update("is_default", true).Error
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not delete payment method")
+	}
+	gateway, ok := c.Get("gateways").(Gateways).ByName(method.Gateway)
+	if !ok {
+		log.Printf("payments: token of payment method %d not deleted: gateway %q is not configured", method.ID, method.Gateway)
+	} else if remover, ok := gateway.(TokenRemover); ok {
+		if err := remover.DeleteToken(c.Request().Context(), method.Token); err != nil {
+			log.Printf("payments: could not delete token of payment method %d: %v", method.ID, err)
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func setDefaultPaymentMethod(c echo.Context) error {
+	id, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	method, err := customerPaymentMethod(c, id)
+	if err != nil {
+		return err
+	}
+	db := c.Get("db").(*gorm.DB)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&SavedPaymentMethod{}).Where("customer_id = ? AND id <> ?", method.CustomerID, method.ID).
+			Update("is_default", false).Error; err != nil {
+			return err
+		}
+		return tx.Model(method).Update("is_default", true).Error
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not update payment method")
+	}
+	return c.JSON(http.StatusOK, method)
+}
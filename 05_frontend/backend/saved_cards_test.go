@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func newSavedCardsTestServer(t *testing.T) (*echo.Echo, *gorm.DB, *FakeGateway) {
+	e, db, gateway := newPaymentTestServer(t)
+	e.Use(CustomerMiddleware(db))
+	e.GET("/customers/me/payment-methods", getPaymentMethods)
+	e.POST("/customers/me/payment-methods", createPaymentMethod)
+	e.DELETE("/customers/me/payment-methods/:id", deletePaymentMethod)
+	e.PUT("/customers/me/payment-methods/:id/default", setDefaultPaymentMethod)
+	return e, db, gateway
+}
+
+// testCustomer zapisuje klienta i zwraca nagłówki, którymi się uwierzytelnia
+func testCustomer(t *testing.T, db *gorm.DB, email string) (*Customer, []string) {
+	t.Helper()
+	token := "cus_" + email
+	customer := &Customer{Email: email, TokenHash: hashCustomerToken(token)}
+	require.NoError(t, db.Create(customer).Error)
+	return customer, []string{echo.HeaderAuthorization, "Bearer " + token}
+}
+
+func saveCard(t *testing.T, e *echo.Echo, auth []string, number string) SavedPaymentMethod {
+	t.Helper()
+	rec := doRequest(e, http.MethodPost, "/customers/me/payment-methods",
+		fmt.Sprintf(`{"card_number":%q,"exp_month":12,"exp_year":2030,"cvc":"123"}`, number), auth...)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var method SavedPaymentMethod
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &method))
+	return method
+}
+
+func listCards(t *testing.T, e *echo.Echo, auth []string) []SavedPaymentMethod {
+	t.Helper()
+	rec := doRequest(e, http.MethodGet, "/customers/me/payment-methods", "", auth...)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var methods []SavedPaymentMethod
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &methods))
+	return methods
+}
+
+func TestSavedPaymentMethodsListDefaultAndDelete(t *testing.T) {
+	e, db, _ := newSavedCardsTestServer(t)
+	_, auth := testCustomer(t, db, "anna@example.com")
+
+	visa := saveCard(t, e, auth, "4242424242424242")
+	assert.True(t, visa.IsDefault, "first card becomes the default")
+	assert.Equal(t, "**** 4242", visa.CardMasked)
+	mastercard := saveCard(t, e, auth, "5555555555554444")
+	assert.False(t, mastercard.IsDefault)
+	// ta sama karta dodana ponownie zastępuje wpis zamiast go powielać
+	again := saveCard(t, e, auth, "4242424242424242")
+	assert.Equal(t, visa.ID, again.ID)
+
+	methods := listCards(t, e, auth)
+	require.Len(t, methods, 2)
+	assert.Equal(t, visa.ID, methods[0].ID)
+
+	rec := doRequest(e, http.MethodGet, "/customers/me/payment-methods", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.NotContains(t, doRequest(e, http.MethodGet, "/customers/me/payment-methods", "", auth...).Body.String(), "token")
+
+	rec = doRequest(e, http.MethodPut, fmt.Sprintf("/customers/me/payment-methods/%d/default", mastercard.ID), "", auth...)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	methods = listCards(t, e, auth)
+	require.Len(t, methods, 2)
+	assert.Equal(t, mastercard.ID, methods[0].ID)
+	assert.True(t, methods[0].IsDefault)
+	assert.False(t, methods[1].IsDefault)
+
+	// po usunięciu domyślnej karty domyślną staje się pozostała, a token znika z bramki
+	var stored SavedPaymentMethod
+	require.NoError(t, db.First(&stored, mastercard.ID).Error)
+	rec = doRequest(e, http.MethodDelete, fmt.Sprintf("/customers/me/payment-methods/%d", mastercard.ID), "", auth...)
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	methods = listCards(t, e, auth)
+	require.Len(t, methods, 1)
+	assert.Equal(t, visa.ID, methods[0].ID)
+	assert.True(t, methods[0].IsDefault)
+	assert.Error(t, db.Where("token = ?", stored.Token).Take(&FakeGatewayToken{}).Error)
+
+	rec = doRequest(e, http.MethodDelete, fmt.Sprintf("/customers/me/payment-methods/%d", mastercard.ID), "", auth...)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestPayWithSavedPaymentMethod(t *testing.T) {
+	e, db, _ := newSavedCardsTestServer(t)
+	customer, auth := testCustomer(t, db, "anna@example.com")
+	method := saveCard(t, e, auth, "4242424242424242")
+	cart, product := newTestCart(t, db, 5, 2)
+	totals, err := ComputeTotals(db, cart)
+	require.NoError(t, err)
+
+	rec := doRequest(e, http.MethodPost, "/payments",
+		fmt.Sprintf(`{"cart_id":%d,"payment_method_id":%d,"amount":%s}`, cart.ID, method.ID, totals.Total.Decimal()), auth...)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var res struct {
+		PaymentID  uint   `json:"payment_id"`
+		CardMasked string `json:"card_masked"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, "**** 4242", res.CardMasked)
+
+	var payment Payment
+	require.NoError(t, db.First(&payment, res.PaymentID).Error)
+	assert.Equal(t, PaymentCaptured, payment.Status)
+	require.NotNil(t, payment.CustomerID)
+	assert.Equal(t, customer.ID, *payment.CustomerID)
+	assert.Equal(t, 3, productStock(t, db, product.ID))
+}
+
+func TestSavedPaymentMethodOfAnotherCustomerIsBlocked(t *testing.T) {
+	e, db, _ := newSavedCardsTestServer(t)
+	_, owner := testCustomer(t, db, "anna@example.com")
+	_, other := testCustomer(t, db, "piotr@example.com")
+	method := saveCard(t, e, owner, "4242424242424242")
+	cart, _ := newTestCart(t, db, 5, 1)
+	totals, err := ComputeTotals(db, cart)
+	require.NoError(t, err)
+	pay := fmt.Sprintf(`{"cart_id":%d,"payment_method_id":%d,"amount":%s}`, cart.ID, method.ID, totals.Total.Decimal())
+
+	rec := doRequest(e, http.MethodPost, "/payments", pay, other...)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = doRequest(e, http.MethodPost, "/payments", pay)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = doRequest(e, http.MethodPut, fmt.Sprintf("/customers/me/payment-methods/%d/default", method.ID), "", other...)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = doRequest(e, http.MethodDelete, fmt.Sprintf("/customers/me/payment-methods/%d", method.ID), "", other...)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Empty(t, listCards(t, e, other))
+
+	var payments int64
+	require.NoError(t, db.Model(&Payment{}).Count(&payments).Error)
+	assert.Zero(t, payments)
+	require.Len(t, listCards(t, e, owner), 1)
+}
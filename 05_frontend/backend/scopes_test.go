@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func newProductListTestServer(t *testing.T, count int) (*echo.Echo, *gorm.DB) {
+	db := newTestDB(t, schemaModels...)
+	for i := 1; i <= count; i++ {
+		product := Product{Name: fmt.Sprintf("Produkt %03d", i), Price: NewMoney(int64(i*100), "PLN"), Currency: "PLN"}
+		require.NoError(t, db.Create(&product).Error)
+	}
+	e := echo.New()
+	e.Use(DBMiddleware(db))
+	e.GET("/products", getAllProducts)
+	return e, db
+}
+
+func decodeProducts(t *testing.T, body []byte) []Product {
+	t.Helper()
+	var products []Product
+	require.NoError(t, json.Unmarshal(body, &products), "GET /products must return a JSON array")
+	return products
+}
+
+func TestListProductsWithoutPagingIsCapped(t *testing.T) {
+	e, _ := newProductListTestServer(t, maxPerPage+5)
+
+	rec := doRequest(e, http.MethodGet, "/products", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Len(t, decodeProducts(t, rec.Body.Bytes()), maxPerPage)
+	assert.Equal(t, strconv.Itoa(maxPerPage+5), rec.Header().Get("X-Total-Count"))
+	cursor := rec.Header().Get("X-Next-Cursor")
+	require.NotEmpty(t, cursor)
+
+	rec = doRequest(e, http.MethodGet, "/products?per_page=10&cursor="+cursor, "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rest := decodeProducts(t, rec.Body.Bytes())
+	assert.Len(t, rest, 5)
+	assert.Empty(t, rec.Header().Get("X-Next-Cursor"))
+}
+
+func TestListProductsPageAndEnvelope(t *testing.T) {
+	e, _ := newProductListTestServer(t, 3)
+
+	rec := doRequest(e, http.MethodGet, "/products?per_page=1&sort=-price", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	page := decodeProducts(t, rec.Body.Bytes())
+	require.Len(t, page, 1)
+	assert.Equal(t, "Produkt 003", page[0].Name)
+	assert.Equal(t, "3", rec.Header().Get("X-Total-Count"))
+
+	rec = doRequest(e, http.MethodGet, "/products?envelope=true&per_page=2&page=2", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var envelope ProductPage
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &envelope))
+	assert.Len(t, envelope.Data, 1)
+	assert.Equal(t, int64(3), envelope.Total)
+	assert.Equal(t, 2, envelope.Page)
+	assert.Equal(t, 2, envelope.PerPage)
+	assert.Empty(t, envelope.NextCursor)
+}
+
+func TestListProductsFilters(t *testing.T) {
+	e, db := newProductListTestServer(t, 3)
+	require.NoError(t, db.Create(&Product{Name: "Rabat 100%", Price: NewMoney(100, "PLN"), Currency: "PLN"}).Error)
+
+	rec := doRequest(e, http.MethodGet, "/products?min_price=2.00&max_price=3.00", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Len(t, decodeProducts(t, rec.Body.Bytes()), 2)
+
+	// % w zapytaniu jest literałem, a nie wzorcem LIKE
+	rec = doRequest(e, http.MethodGet, "/products?q=%25", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	products := decodeProducts(t, rec.Body.Bytes())
+	require.Len(t, products, 1)
+	assert.Equal(t, "Rabat 100%", products[0].Name)
+
+	rec = doRequest(e, http.MethodGet, "/products?per_page=0", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
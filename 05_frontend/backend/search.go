@@ -0,0 +1,166 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Indeks pełnotekstowy FTS5 nad products(name, description).
+// Tabela products_fts korzysta z zawartości tabeli products (external content),
+// a triggery utrzymują ją w synchronizacji przy każdym INSERT/UPDATE/DELETE -
+// również przy zapisach z pominięciem GORM. Produkty w koszu pozostają w indeksie
+// (rebuild i tak indeksuje całą tabelę), wyszukiwanie odfiltrowuje je przed LIMIT.
+var productSearchSchema = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS products_fts USING fts5(
+		name, description,
+		content='products', content_rowid='id',
+		tokenize='unicode61 remove_diacritics 2'
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS products_fts_ai AFTER INSERT ON products BEGIN
+		INSERT INTO products_fts(rowid, name, description) VALUES (new.id, new.name, new.description);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS products_fts_ad AFTER DELETE ON products BEGIN
+		INSERT INTO products_fts(products_fts, rowid, name, description) VALUES ('delete', old.id, old.name, old.description);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS products_fts_au AFTER UPDATE OF name, description ON products BEGIN
+		INSERT INTO products_fts(products_fts, rowid, name, description) VALUES ('delete', old.id, old.name, old.description);
+		INSERT INTO products_fts(rowid, name, description) VALUES (new.id, new.name, new.description);
+	END`,
+}
+
+// Znaczniki wstawiane przez highlight()/snippet(); zamieniane na <mark> dopiero po escapowaniu HTML
+const (
+	highlightOpen  = "\x02"
+	highlightClose = "\x03"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+type ProductSearchResult struct {
+	Product
+	NameHighlight string  `json:"name_highlight"`
+	Snippet       string  `json:"snippet"`
+	Rank          float64 `json:"rank"`
+}
+
+// EnsureProductSearchIndex tworzy indeks i triggery; świeżo utworzony indeks jest od razu
+// wypełniany, żeby istniejące bazy (np. test.db) nie wymagały ręcznej przebudowy.
+func EnsureProductSearchIndex(db *gorm.DB) error {
+	existed := db.Migrator().HasTable("products_fts")
+	for _, stmt := range productSearchSchema {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	if !existed {
+		return RebuildProductSearchIndex(db)
+	}
+	return nil
+}
+
+func RebuildProductSearchIndex(db *gorm.DB) error {
+	return db.Exec("INSERT INTO products_fts(products_fts) VALUES ('rebuild')").Error
+}
+
+// buildMatchQuery zamienia tekst użytkownika na zapytanie FTS5: każde słowo jest
+// cytowane (brak wstrzykiwania składni FTS) i dopasowywane prefiksowo.
+func buildMatchQuery(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		terms = append(terms, `"`+w+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+func renderHighlight(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, highlightOpen, "<mark>")
+	return strings.ReplaceAll(s, highlightClose, "</mark>")
+}
+
+func searchProducts(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+
+	match := buildMatchQuery(c.QueryParam("q"))
+	if match == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Query parameter q is required")
+	}
+	limit := defaultSearchLimit
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > maxSearchLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid limit")
+		}
+		limit = l
+	}
+
+	var hits []struct {
+		ID            uint
+		NameHighlight string
+		Snippet       string
+		Rank          float64
+	}
+	// bm25: trafienie w nazwie waży 10x więcej niż w opisie; niższy wynik = lepsze dopasowanie
+	err := db.Raw(`
+		SELECT products_fts.rowid AS id,
+			highlight(products_fts, 0, ?, ?) AS name_highlight,
+			snippet(products_fts, 1, ?, ?, '…', 12) AS snippet,
+			bm25(products_fts, 10.0, 1.0) AS rank
+		FROM products_fts
+		JOIN products ON products.id = products_fts.rowid
+		WHERE products_fts MATCH ? AND products.deleted_at IS NULL
+		ORDER BY rank
+		LIMIT ?`,
+		highlightOpen, highlightClose, highlightOpen, highlightClose, match, limit,
+	).Scan(&hits).Error
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid search query")
+	}
+
+	results := make([]ProductSearchResult, 0, len(hits))
+	if len(hits) == 0 {
+		return c.JSON(http.StatusOK, map[string]interface{}{"query": c.QueryParam("q"), "data": results})
+	}
+
+	ids := make([]uint, 0, len(hits))
+	for _, h := range hits {
+		ids = append(ids, h.ID)
+	}
+	var products []Product
+	if err := db.Preload("Category").Find(&products, ids).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not fetch products")
+	}
+	byID := make(map[uint]Product, len(products))
+	for _, p := range products {
+		byID[p.ID] = p
+	}
+
+	for _, h := range hits {
+		p, ok := byID[h.ID]
+		if !ok {
+			continue
+		}
+		results = append(results, ProductSearchResult{
+			Product:       p,
+			NameHighlight: renderHighlight(h.NameHighlight),
+			Snippet:       renderHighlight(h.Snippet),
+			Rank:          h.Rank,
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"query": c.QueryParam("q"),
+		"data":  results,
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func newSearchTestServer(t *testing.T) (*echo.Echo, *gorm.DB) {
+	db := newTestDB(t, schemaModels...)
+	require.NoError(t, EnsureProductSearchIndex(db))
+	e := echo.New()
+	e.Use(DBMiddleware(db))
+	e.GET("/products/search", searchProducts)
+	return e, db
+}
+
+// searchHit to wynik z odpowiedzi; ProductSearchResult nie da się zdekodować wprost,
+// bo osadzony Product ma własne UnmarshalJSON
+type searchHit struct {
+	ID            uint    `json:"id"`
+	Name          string  `json:"name"`
+	NameHighlight string  `json:"name_highlight"`
+	Snippet       string  `json:"snippet"`
+	Rank          float64 `json:"rank"`
+}
+
+func search(t *testing.T, e *echo.Echo, q string) (int, []searchHit) {
+	t.Helper()
+	rec := doRequest(e, http.MethodGet, "/products/search?q="+url.QueryEscape(q), "")
+	var res struct {
+		Data []searchHit `json:"data"`
+	}
+	if rec.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	}
+	return rec.Code, res.Data
+}
+
+func TestBuildMatchQueryQuotesEveryWord(t *testing.T) {
+	cases := map[string]string{
+		"kubek":                  `"kubek"*`,
+		`kubek "biały`:           `"kubek"* "biały"*`,
+		"kubek OR NOT talerz":    `"kubek"* "OR"* "NOT"* "talerz"*`,
+		"name:kubek* -(talerz)^": `"name"* "kubek"* "talerz"*`,
+		`"" * :`:                 "",
+	}
+	for q, want := range cases {
+		assert.Equal(t, want, buildMatchQuery(q), q)
+	}
+}
+
+func TestRenderHighlightEscapesHTML(t *testing.T) {
+	assert.Equal(t, "&lt;b&gt;<mark>Kubek</mark>&lt;/b&gt; &amp; spodek",
+		renderHighlight("<b>"+highlightOpen+"Kubek"+highlightClose+"</b> & spodek"))
+}
+
+func TestSearchRanksNameAboveDescription(t *testing.T) {
+	e, db := newSearchTestServer(t)
+	for _, p := range []Product{
+		{Name: "Talerz", Description: "Pasuje do kubka i kubeczka, kubek w zestawie", Price: NewMoney(1000, "PLN"), Currency: "PLN"},
+		{Name: "Kubek <emaliowany>", Description: "Biały", Price: NewMoney(2500, "PLN"), Currency: "PLN"},
+		{Name: "Miska", Description: "Ceramiczna", Price: NewMoney(1500, "PLN"), Currency: "PLN"},
+	} {
+		require.NoError(t, db.Create(&p).Error)
+	}
+
+	code, results := search(t, e, "kub")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, results, 2, "prefix match")
+	assert.Equal(t, "Kubek <emaliowany>", results[0].Name)
+	assert.Equal(t, "<mark>Kubek</mark> &lt;emaliowany&gt;", results[0].NameHighlight)
+	assert.Equal(t, "Talerz", results[1].Name)
+	assert.Less(t, results[0].Rank, results[1].Rank)
+
+	// składnia FTS w zapytaniu jest traktowana jak zwykłe słowa
+	code, results = search(t, e, `"kubek" OR miska`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, results)
+	code, _ = search(t, e, "*")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestSearchSkipsTrashedProducts(t *testing.T) {
+	e, db := newSearchTestServer(t)
+	trashed := Product{Name: "Kubek stary", Price: NewMoney(1000, "PLN"), Currency: "PLN"}
+	kept := Product{Name: "Kubek nowy", Price: NewMoney(1000, "PLN"), Currency: "PLN"}
+	require.NoError(t, db.Create(&trashed).Error)
+	require.NoError(t, db.Create(&kept).Error)
+	require.NoError(t, db.Delete(&trashed).Error)
+
+	code, results := search(t, e, "kubek")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, results, 1)
+	assert.Equal(t, kept.ID, results[0].ID)
+}
+
+func TestSearchIndexIsBuiltForExistingDatabase(t *testing.T) {
+	db := newTestDB(t, schemaModels...)
+	// produkty zapisane, zanim baza miała indeks (triggery jeszcze nie istniały)
+	require.NoError(t, db.Create(&Product{Name: "Kubek", Price: NewMoney(1000, "PLN"), Currency: "PLN"}).Error)
+	require.NoError(t, EnsureProductSearchIndex(db))
+	e := echo.New()
+	e.Use(DBMiddleware(db))
+	e.GET("/products/search", searchProducts)
+
+	_, results := search(t, e, "kubek")
+	assert.Len(t, results, 1)
+
+	// rozjechany indeks naprawia RebuildProductSearchIndex
+	require.NoError(t, db.Exec("INSERT INTO products_fts(products_fts) VALUES ('delete-all')").Error)
+	_, results = search(t, e, "kubek")
+	assert.Empty(t, results)
+	require.NoError(t, RebuildProductSearchIndex(db))
+	_, results = search(t, e, "kubek")
+	assert.Len(t, results, 1)
+}
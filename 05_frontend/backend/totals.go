@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Sumy koszyka liczone po stronie serwera: pozycje, rabat z kuponu, wysyłka i VAT.
+// Ceny są brutto, więc podatek jest wyliczany jako część sumy (tax_included).
+
+const (
+	CartOpen = "open"
+	CartPaid = "paid"
+)
+
+var (
+	ErrCartLocked     = errors.New("cart is locked")
+	ErrInvalidCoupon  = errors.New("coupon needs a code and a percent off between 1 and 100")
+	ErrNoShippingRate = errors.New("no shipping rate for currency")
+)
+
+// Stawki wysyłki podawane osobno dla każdej waluty, w jej jednostkach podrzędnych ("PLN:1500,JPY:800"),
+// bo kwoty dziesiętnej nie da się sensownie przenieść między walutami o różnej liczbie miejsc po przecinku
+var (
+	shippingFees           = envString("SHIPPING_FEES", "PLN:1500,EUR:500,USD:500,GBP:500,CHF:500,CZK:10000,HUF:150000,SEK:5000,JPY:800,KWD:1500")
+	freeShippingThresholds = envString("FREE_SHIPPING_THRESHOLDS", "PLN:20000,EUR:5000,USD:5000,GBP:5000,CHF:5000,CZK:120000,HUF:2000000,SEK:60000,JPY:8000,KWD:15000")
+	taxRatePercent         = envInt("TAX_RATE_PERCENT", 23)
+
+	shippingRates, errShippingConfig = parseShippingRates(shippingFees, freeShippingThresholds)
+)
+
+type shippingRate struct {
+	Fee      Money
+	FreeFrom Money
+}
+
+// parseShippingRates łączy opłaty i progi darmowej wysyłki; każda waluta musi mieć oba
+func parseShippingRates(fees, thresholds string) (map[string]shippingRate, error) {
+	feeByCurrency, err := parseCurrencyAmounts(fees)
+	if err != nil {
+		return nil, fmt.Errorf("SHIPPING_FEES: %w", err)
+	}
+	thresholdByCurrency, err := parseCurrencyAmounts(thresholds)
+	if err != nil {
+		return nil, fmt.Errorf("FREE_SHIPPING_THRESHOLDS: %w", err)
+	}
+	rates := make(map[string]shippingRate, len(feeByCurrency))
+	for currency, fee := range feeByCurrency {
+		threshold, ok := thresholdByCurrency[currency]
+		if !ok {
+			return nil, fmt.Errorf("FREE_SHIPPING_THRESHOLDS: missing %s", currency)
+		}
+		rates[currency] = shippingRate{Fee: fee, FreeFrom: threshold}
+	}
+	for currency := range thresholdByCurrency {
+		if _, ok := feeByCurrency[currency]; !ok {
+			return nil, fmt.Errorf("SHIPPING_FEES: missing %s", currency)
+		}
+	}
+	return rates, nil
+}
+
+// parseCurrencyAmounts wczytuje listę "PLN:1500,EUR:500" z kwotami w jednostkach podrzędnych
+func parseCurrencyAmounts(s string) (map[string]Money, error) {
+	amounts := make(map[string]Money)
+	for _, entry := range strings.Split(s, ",") {
+		currency, value, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: %q is not CURRENCY:amount", ErrInvalidAmount, entry)
+		}
+		currency = strings.ToUpper(strings.TrimSpace(currency))
+		if _, err := currencyExponent(currency); err != nil {
+			return nil, err
+		}
+		amount, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || amount < 0 {
+			return nil, fmt.Errorf("%w: %q for %s must be a whole number of minor units", ErrInvalidAmount, value, currency)
+		}
+		amounts[currency] = NewMoney(amount, currency)
+	}
+	return amounts, nil
+}
+
+type Coupon struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	Code       string    `gorm:"uniqueIndex" json:"code"`
+	PercentOff int       `json:"percent_off"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type CartTotals struct {
+	CartID      uint   `json:"cart_id"`
+	Currency    string `json:"currency"`
+	Subtotal    Money  `json:"subtotal"`
+	Discount    Money  `json:"discount"`
+	CouponCode  string `json:"coupon_code,omitempty"`
+	Shipping    Money  `json:"shipping"`
+	Tax         Money  `json:"tax"`
+	TaxRate     int    `json:"tax_rate"`
+	TaxIncluded bool   `json:"tax_included"`
+	Total       Money  `json:"total"`
+}
+
+// ComputeTotals liczy sumy dla koszyka wczytanego przez loadCart
+func ComputeTotals(db *gorm.DB, cart *Cart) (*CartTotals, error) {
+	currency := cart.Subtotal.Currency
+	totals := &CartTotals{
+		CartID:      cart.ID,
+		Currency:    currency,
+		Subtotal:    cart.Subtotal,
+		Discount:    NewMoney(0, currency),
+		Shipping:    NewMoney(0, currency),
+		TaxRate:     taxRatePercent,
+		TaxIncluded: true,
+	}
+
+	if cart.CouponCode != "" {
+		var coupon Coupon
+		if err := db.Where("code = ? AND active = ?", cart.CouponCode, true).Take(&coupon).Error; err == nil {
+			totals.CouponCode = coupon.Code
+			if totals.Discount, err = cart.Subtotal.MulRatio(int64(coupon.PercentOff), 100); err != nil {
+				return nil, err
+			}
+		}
+	}
+	afterDiscount, err := totals.Subtotal.Sub(totals.Discount)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cart.Items) > 0 {
+		rate, ok := shippingRates[currency]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNoShippingRate, currency)
+		}
+		if afterDiscount.Amount < rate.FreeFrom.Amount {
+			totals.Shipping = rate.Fee
+		}
+	}
+
+	if totals.Total, err = afterDiscount.Add(totals.Shipping); err != nil {
+		return nil, err
+	}
+	if totals.Tax, err = totals.Total.MulRatio(int64(taxRatePercent), int64(100+taxRatePercent)); err != nil {
+		return nil, err
+	}
+	return totals, nil
+}
+
+// ensureCartOpen blokuje zmiany w opłaconym koszyku; wywoływane wewnątrz transakcji
+func ensureCartOpen(tx *gorm.DB, cartID uint) error {
+	var cart Cart
+	if err := tx.Select("id", "status").First(&cart, cartID).Error; err != nil {
+		return err
+	}
+	if cart.Status != "" && cart.Status != CartOpen {
+		return ErrCartLocked
+	}
+	return nil
+}
+
+func getCartTotals(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	cart, err := loadCart(db, c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Cart not found")
+	}
+	totals, err := ComputeTotals(db, cart)
+	if err != nil {
+		return totalsError(err)
+	}
+	return c.JSON(http.StatusOK, totals)
+}
+
+// totalsError tłumaczy błąd ComputeTotals na odpowiedź HTTP
+func totalsError(err error) error {
+	if errors.Is(err, ErrNoShippingRate) {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Shipping is not available for the cart currency")
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, "Could not compute totals")
+}
+
+func applyCoupon(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	cartID, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	code := strings.ToUpper(strings.TrimSpace(body.Code))
+
+	var coupon Coupon
+	if err := db.Where("code = ? AND active = ?", code, true).Take(&coupon).Error; err != nil {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Invalid coupon code")
+	}
+	if err := setCartCoupon(db, cartID, coupon.Code); err != nil {
+		return err
+	}
+	return getCartTotals(c)
+}
+
+func removeCoupon(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	cartID, err := parseUintParam(c, "id")
+	if err != nil {
+		return err
+	}
+	if err := setCartCoupon(db, cartID, ""); err != nil {
+		return err
+	}
+	return getCartTotals(c)
+}
+
+func setCartCoupon(db *gorm.DB, cartID uint, code string) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := ensureCartOpen(tx, cartID); err != nil {
+			return err
+		}
+		return tx.Model(&Cart{}).Where("id = ?", cartID).Update("coupon_code", code).Error
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Cart not found")
+	case errors.Is(err, ErrCartLocked):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Cart can no longer be modified")
+	case err != nil:
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not update cart")
+	}
+	return nil
+}
+
+// CreateCoupon dodaje aktywny kupon; kupony tworzy się tylko flagą -coupon przy starcie serwera
+func CreateCoupon(db *gorm.DB, code string, percentOff int) (*Coupon, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" || percentOff < 1 || percentOff > 100 {
+		return nil, ErrInvalidCoupon
+	}
+	coupon := &Coupon{Code: code, PercentOff: percentOff, Active: true}
+	if err := db.Create(coupon).Error; err != nil {
+		return nil, err
+	}
+	return coupon, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func newTotalsTestServer(t *testing.T) (*echo.Echo, *gorm.DB) {
+	e, db, _ := newPaymentTestServer(t)
+	e.GET("/carts/:id/totals", getCartTotals)
+	e.PUT("/carts/:id/coupon", applyCoupon)
+	e.DELETE("/carts/:id/coupon", removeCoupon)
+	return e, db
+}
+
+func decodeTotals(t *testing.T, body []byte) CartTotals {
+	t.Helper()
+	var totals CartTotals
+	require.NoError(t, json.Unmarshal(body, &totals))
+	return totals
+}
+
+func TestCartTotalsAddShippingBelowThreshold(t *testing.T) {
+	e, db := newTotalsTestServer(t)
+	cart, _ := newTestCart(t, db, 10, 2)
+
+	rec := doRequest(e, http.MethodGet, fmt.Sprintf("/carts/%d/totals", cart.ID), "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	totals := decodeTotals(t, rec.Body.Bytes())
+	assert.Equal(t, NewMoney(5000, "PLN"), totals.Subtotal)
+	assert.Equal(t, NewMoney(1500, "PLN"), totals.Shipping)
+	assert.Equal(t, NewMoney(6500, "PLN"), totals.Total)
+	// VAT 23% zawarty w cenie brutto: 65.00 * 23/123 = 12.1544
+	assert.Equal(t, NewMoney(1215, "PLN"), totals.Tax)
+	assert.True(t, totals.TaxIncluded)
+
+	cart, _ = newTestCart(t, db, 10, 8)
+	totals2, err := ComputeTotals(db, cart)
+	require.NoError(t, err)
+	assert.True(t, totals2.Shipping.IsZero(), "free shipping from 200.00")
+	assert.Equal(t, NewMoney(20000, "PLN"), totals2.Total)
+}
+
+func TestCouponDiscountsCartTotals(t *testing.T) {
+	e, db := newTotalsTestServer(t)
+	cart, _ := newTestCart(t, db, 10, 2)
+	_, err := CreateCoupon(db, " lato10 ", 10)
+	require.NoError(t, err)
+	couponURL := fmt.Sprintf("/carts/%d/coupon", cart.ID)
+
+	rec := doRequest(e, http.MethodPut, couponURL, `{"code":"ZIMA50"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = doRequest(e, http.MethodPut, couponURL, `{"code":"lato10"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	totals := decodeTotals(t, rec.Body.Bytes())
+	assert.Equal(t, "LATO10", totals.CouponCode)
+	assert.Equal(t, NewMoney(500, "PLN"), totals.Discount)
+	assert.Equal(t, NewMoney(6000, "PLN"), totals.Total)
+
+	rec = doRequest(e, http.MethodDelete, couponURL, "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, NewMoney(6500, "PLN"), decodeTotals(t, rec.Body.Bytes()).Total)
+
+	_, err = CreateCoupon(db, "ZA-DUZO", 101)
+	assert.ErrorIs(t, err, ErrInvalidCoupon)
+}
+
+func TestPaymentAmountMustMatchCartTotal(t *testing.T) {
+	e, db := newTotalsTestServer(t)
+	cart, _ := newTestCart(t, db, 10, 2)
+	_, err := CreateCoupon(db, "LATO10", 10)
+	require.NoError(t, err)
+	payment := `{"cart_id":%d,"card_number":"4242424242424242","exp_month":12,"exp_year":2030,"cvc":"123","amount":%s}`
+
+	rec := doRequest(e, http.MethodPost, "/payments", fmt.Sprintf(payment, cart.ID, "50.00"))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code, "amount without shipping is rejected")
+
+	rec = doRequest(e, http.MethodPost, "/payments", fmt.Sprintf(payment, cart.ID, "65.00"))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var locked Cart
+	require.NoError(t, db.First(&locked, cart.ID).Error)
+	assert.Equal(t, CartPaid, locked.Status)
+	assert.NotNil(t, locked.PaidAt)
+
+	rec = doRequest(e, http.MethodPost, "/payments", fmt.Sprintf(payment, cart.ID, "65.00"))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code, "paid cart cannot be paid again")
+	rec = doRequest(e, http.MethodPut, fmt.Sprintf("/carts/%d/coupon", cart.ID), `{"code":"LATO10"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+}
+
+func TestPaymentRejectsEmptyCart(t *testing.T) {
+	e, db := newTotalsTestServer(t)
+	cart := Cart{}
+	require.NoError(t, db.Create(&cart).Error)
+
+	rec := doRequest(e, http.MethodPost, "/payments",
+		fmt.Sprintf(`{"cart_id":%d,"card_number":"4242424242424242","exp_month":12,"exp_year":2030,"cvc":"123","amount":0}`, cart.ID))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+}
+
+func TestCartTotalsInJPY(t *testing.T) {
+	e, db := newTotalsTestServer(t)
+	product := Product{Name: "Kubek", Price: NewMoney(1200, "JPY"), Currency: "JPY"}
+	require.NoError(t, db.Create(&product).Error)
+	cart := Cart{}
+	require.NoError(t, db.Create(&cart).Error)
+	require.NoError(t, AddCartItem(db, cart.ID, product.ID, 2))
+
+	rec := doRequest(e, http.MethodGet, fmt.Sprintf("/carts/%d/totals", cart.ID), "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var totals struct {
+		Currency string          `json:"currency"`
+		Shipping json.RawMessage `json:"shipping"`
+		Tax      json.RawMessage `json:"tax"`
+		Total    json.RawMessage `json:"total"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &totals))
+	assert.Equal(t, "JPY", totals.Currency)
+	// jen nie ma części ułamkowej: 2400 + 800 wysyłki, VAT 3200 * 23/123 = 598.37
+	assert.JSONEq(t, "800", string(totals.Shipping))
+	assert.JSONEq(t, "3200", string(totals.Total))
+	assert.JSONEq(t, "598", string(totals.Tax))
+
+	require.NoError(t, AddCartItem(db, cart.ID, product.ID, 5))
+	loaded, err := loadCart(db, cart.ID)
+	require.NoError(t, err)
+	free, err := ComputeTotals(db, loaded)
+	require.NoError(t, err)
+	assert.Equal(t, NewMoney(0, "JPY"), free.Shipping, "free shipping from 8000 JPY")
+	assert.Equal(t, NewMoney(8400, "JPY"), free.Total)
+}
+
+func TestCartTotalsWithoutShippingRate(t *testing.T) {
+	e, db := newTotalsTestServer(t)
+	previous := shippingRates
+	t.Cleanup(func() { shippingRates = previous })
+	rates, err := parseShippingRates("PLN:1500", "PLN:20000")
+	require.NoError(t, err)
+	shippingRates = rates
+
+	product := Product{Name: "Mug", Price: NewMoney(500, "EUR"), Currency: "EUR"}
+	require.NoError(t, db.Create(&product).Error)
+	cart := Cart{}
+	require.NoError(t, db.Create(&cart).Error)
+	require.NoError(t, AddCartItem(db, cart.ID, product.ID, 1))
+
+	rec := doRequest(e, http.MethodGet, fmt.Sprintf("/carts/%d/totals", cart.ID), "")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+}
+
+func TestParseShippingRates(t *testing.T) {
+	rates, err := parseShippingRates(" pln:1500, JPY:800", "PLN:20000,JPY:8000")
+	require.NoError(t, err)
+	assert.Equal(t, shippingRate{Fee: NewMoney(800, "JPY"), FreeFrom: NewMoney(8000, "JPY")}, rates["JPY"])
+	assert.Equal(t, NewMoney(1500, "PLN"), rates["PLN"].Fee)
+
+	for _, tc := range [][2]string{
+		{"JPY:15.00", "JPY:200"}, // kwoty w jednostkach podrzędnych, bez przecinka
+		{"XXX:100", "XXX:100"},   // nieznana waluta
+		{"PLN:1500", "EUR:5000"}, // brak progu dla PLN
+		{"PLN:1500,EUR:500", "PLN:20000"},
+		{"PLN:-1", "PLN:20000"},
+		{"PLN", "PLN:20000"},
+	} {
+		_, err := parseShippingRates(tc[0], tc[1])
+		assert.Error(t, err, "%v", tc)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+
+	"ecommerce/internal/webhooksig"
+)
+
+// Webhooki bramki płatności. Podpis w nagłówku Webhook-Signature sprawdza pakiet
+// internal/webhooksig (ten sam, którego używają cmd/webhook-signer i cmd/fakeprovider).
+// Zdarzenia są deduplikowane po id, więc ponowne doręczenie niczego nie zmienia.
+
+const (
+	WebhookPaymentSucceeded = "payment.succeeded"
+	WebhookPaymentFailed    = "payment.failed"
+)
+
+// devWebhookSecret to jawny sekret, którym domyślnie podpisują cmd/fakeprovider i cmd/webhook-signer
+const devWebhookSecret = "whsec_local_development"
+
+var (
+	webhookSecret    = envString("PAYMENT_WEBHOOK_SECRET", devWebhookSecret)
+	webhookTolerance = envDuration("PAYMENT_WEBHOOK_TOLERANCE", 5*time.Minute)
+)
+
+// checkWebhookSecret nie pozwala przyjmować webhooków podpisanych jawnym sekretem deweloperskim,
+// chyba że operatorem płatności jest lokalny cmd/fakeprovider
+func checkWebhookSecret() error {
+	if webhookSecret != devWebhookSecret || isLocalURL(hostedProviderURL) {
+		return nil
+	}
+	return errors.New("PAYMENT_WEBHOOK_SECRET must be set when HOSTED_PROVIDER_URL is not local")
+}
+
+type WebhookEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		PaymentID        uint   `json:"payment_id"`
+		GatewayReference string `json:"gateway_reference"`
+		Reason           string `json:"reason"`
+	} `json:"data"`
+}
+
+// ProcessedWebhook zapamiętuje obsłużone zdarzenia (deduplikacja po EventID)
+type ProcessedWebhook struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	EventID   string    `gorm:"uniqueIndex" json:"event_id"`
+	Type      string    `json:"type"`
+	PaymentID *uint     `gorm:"index" json:"payment_id,omitempty"`
+	Result    string    `json:"result"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func receivePaymentWebhook(c echo.Context) error {
+	db := c.Get("db").(*gorm.DB)
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Could not read request body")
+	}
+	err = webhooksig.Verify(webhookSecret, c.Request().Header.Get(webhooksig.Header), body, time.Now(), webhookTolerance)
+	switch {
+	case errors.Is(err, webhooksig.ErrStale):
+		return echo.NewHTTPError(http.StatusBadRequest, "Webhook timestamp outside tolerance")
+	case err != nil:
+		return echo.NewHTTPError(http.StatusUnauthorized, "Invalid webhook signature")
+	}
+
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.ID == "" || event.Type == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid webhook event")
+	}
+
+	var paidEvent *OrderEvent
+	var result string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		processed := ProcessedWebhook{EventID: event.ID, Type: event.Type}
+		res := tx.Where(ProcessedWebhook{EventID: event.ID}).FirstOrCreate(&processed)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			result = "duplicate"
+			return nil
+		}
+
+		var record *Payment
+		if result, record, paidEvent, err = applyWebhookEvent(tx, event); err != nil {
+			return err
+		}
+		if record != nil {
+			processed.PaymentID = &record.ID
+		}
+		return tx.Model(&processed).Updates(map[string]interface{}{"payment_id": processed.PaymentID, "result": result}).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "Payment not found")
+	}
+	// zdarzenie nie zostało zapamiętane, więc ponowne doręczenie zobaczy już nowy status
+	if errors.Is(err, ErrPaymentChanged) {
+		return echo.NewHTTPError(http.StatusConflict, "Payment changed concurrently")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not process webhook")
+	}
+	if paidEvent != nil {
+		orderEvents.Publish(*paidEvent)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"event_id": event.ID, "result": result})
+}
+
+// applyWebhookEvent zmienia stan płatności zgodnie ze zdarzeniem i zwraca opis wyniku
+func applyWebhookEvent(tx *gorm.DB, event WebhookEvent) (string, *Payment, *OrderEvent, error) {
+	if event.Type != WebhookPaymentSucceeded && event.Type != WebhookPaymentFailed {
+		return "ignored", nil, nil, nil
+	}
+
+	var record Payment
+	q := tx.Where("id = ?", event.Data.PaymentID)
+	if event.Data.PaymentID == 0 {
+		q = tx.Where("gateway_reference = ? AND gateway_reference <> ''", event.Data.GatewayReference)
+	}
+	if err := q.Take(&record).Error; err != nil {
+		return "", nil, nil, err
+	}
+	if record.Method != PaymentMethodBlik && record.Method != PaymentMethodRedirect {
+		return "ignored_" + record.Method, &record, nil, nil
+	}
+	if !record.AwaitsConfirmation() {
+		return "already_" + record.Status, &record, nil, nil
+	}
+
+	if event.Type == WebhookPaymentFailed {
+		reason := event.Data.Reason
+		if reason == "" {
+			reason = "failed at gateway"
+		}
+		return PaymentFailed, &record, nil, failPendingPayment(tx, &record, reason)
+	}
+
+	result, paidEvent, err := settlePendingPayment(tx, &record, "webhook")
+	return result, &record, paidEvent, err
+}
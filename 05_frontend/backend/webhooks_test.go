@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"ecommerce/internal/webhooksig"
+)
+
+func newWebhookTestServer(t *testing.T) (*echo.Echo, *gorm.DB) {
+	db := newTestDB(t, schemaModels...)
+	e := echo.New()
+	e.Use(DBMiddleware(db))
+	e.POST("/webhooks/payments", receivePaymentWebhook)
+	return e, db
+}
+
+func postWebhook(e *echo.Echo, body string, signedAt time.Time) (int, map[string]interface{}) {
+	rec := doRequest(e, http.MethodPost, "/webhooks/payments", body,
+		webhooksig.Header, webhooksig.Sign(webhookSecret, signedAt, []byte(body)))
+	var res map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &res)
+	return rec.Code, res
+}
+
+func TestWebhookDeduplicatesEvents(t *testing.T) {
+	e, db := newWebhookTestServer(t)
+	payment := Payment{CartID: 1, Status: PaymentAwaitingConfirmation, Amount: NewMoney(1000, "PLN"), Currency: "PLN",
+		Method: PaymentMethodRedirect, Gateway: "hosted", GatewayReference: "ord_1"}
+	require.NoError(t, db.Create(&payment).Error)
+
+	body := `{"id":"evt_1","type":"payment.failed","data":{"gateway_reference":"ord_1","reason":"rejected"}}`
+	code, res := postWebhook(e, body, time.Now())
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, PaymentFailed, res["result"])
+
+	// ponowne doręczenie tego samego zdarzenia niczego nie zmienia
+	code, res = postWebhook(e, body, time.Now())
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "duplicate", res["result"])
+
+	var processed []ProcessedWebhook
+	require.NoError(t, db.Find(&processed).Error)
+	if assert.Len(t, processed, 1) {
+		assert.Equal(t, "evt_1", processed[0].EventID)
+		assert.Equal(t, PaymentFailed, processed[0].Result)
+		assert.Equal(t, &payment.ID, processed[0].PaymentID)
+	}
+	require.NoError(t, db.First(&payment, payment.ID).Error)
+	assert.Equal(t, PaymentFailed, payment.Status)
+	assert.Equal(t, "rejected", payment.ErrorReason)
+}
+
+func TestWebhookDoesNotSettleCardAuthorizations(t *testing.T) {
+	e, db := newWebhookTestServer(t)
+	cart, _ := newTestCart(t, db, 5, 1)
+	payment := Payment{CartID: cart.ID, Status: PaymentAuthorized, Amount: NewMoney(4000, "PLN"), Currency: "PLN",
+		Method: PaymentMethodCard, Gateway: "fake", GatewayReference: "fake_auth_1"}
+	require.NoError(t, db.Create(&payment).Error)
+
+	// autoryzacja karty bez Capture nie może zostać uznana za pobraną
+	code, res := postWebhook(e, `{"id":"evt_4","type":"payment.succeeded","data":{"gateway_reference":"fake_auth_1"}}`, time.Now())
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ignored_card", res["result"])
+
+	require.NoError(t, db.First(&payment, payment.ID).Error)
+	assert.Equal(t, PaymentAuthorized, payment.Status)
+	assert.Nil(t, payment.CapturedAt)
+	var stored Cart
+	require.NoError(t, db.First(&stored, cart.ID).Error)
+	assert.Equal(t, CartOpen, stored.Status)
+}
+
+func TestWebhookIgnoresUnknownEventTypes(t *testing.T) {
+	e, _ := newWebhookTestServer(t)
+	code, res := postWebhook(e, `{"id":"evt_2","type":"payment.disputed","data":{}}`, time.Now())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ignored", res["result"])
+}
+
+func TestWebhookRejectsBadSignatures(t *testing.T) {
+	e, db := newWebhookTestServer(t)
+	body := `{"id":"evt_3","type":"payment.failed","data":{"payment_id":1}}`
+
+	rec := doRequest(e, http.MethodPost, "/webhooks/payments", body)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	signature := webhooksig.Sign(webhookSecret, time.Now(), []byte(body))
+	rec = doRequest(e, http.MethodPost, "/webhooks/payments", `{"id":"evt_3","type":"payment.failed","data":{"payment_id":2}}`,
+		webhooksig.Header, signature)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	code, _ := postWebhook(e, body, time.Now().Add(-webhookTolerance-time.Minute))
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// odrzucone zdarzenia nie są zapamiętywane, więc poprawne doręczenie zostanie obsłużone
+	var count int64
+	require.NoError(t, db.Model(&ProcessedWebhook{}).Count(&count).Error)
+	assert.Zero(t, count)
+}
+
+func TestDevWebhookSecretOnlyWithLocalProvider(t *testing.T) {
+	secret, providerURL := webhookSecret, hostedProviderURL
+	t.Cleanup(func() { webhookSecret, hostedProviderURL = secret, providerURL })
+
+	webhookSecret = devWebhookSecret
+	hostedProviderURL = "http://localhost:1324"
+	assert.NoError(t, checkWebhookSecret())
+
+	hostedProviderURL = "https://secure.payu.com"
+	assert.Error(t, checkWebhookSecret())
+	webhookSecret = "whsec_production"
+	assert.NoError(t, checkWebhookSecret())
+}
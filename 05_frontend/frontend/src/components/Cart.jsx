@@ -1,15 +1,14 @@
-import { useState, useEffect } from 'react';
+import { useEffect } from 'react';
 import { useCart } from '../context/CartContext';
 import { Link } from 'react-router-dom';
+import { formatMoney } from '../utils/money';
 
 const Cart = () => {
-  const { cart, fetchCart, removeFromCart } = useCart();
-  const [total, setTotal] = useState(0);
+  const { cart, subtotal, fetchCart, updateQuantity, removeFromCart } = useCart();
 
   useEffect(() => {
     fetchCart();
-    setTotal(cart.reduce((sum, item) => sum + item.price, 0));
-  }, [cart, fetchCart]);
+  }, [fetchCart]);
 
   return (
     <div className="cart-container">
@@ -22,10 +21,12 @@ const Cart = () => {
             {cart.map(item => (
               <div key={item.id} className="cart-item">
                 <div className="item-info">
-                  <h3>{item.name}</h3>
-                  <p>Cena: {item.price.toFixed(2)} zł</p>
+                  <h3>{item.product.name}</h3>
+                  <p>Cena: {formatMoney(item.unit_price)} zł × {item.quantity} = {formatMoney(item.line_total)} zł</p>
                 </div>
-                <button 
+                <button onClick={() => updateQuantity(item.id, item.quantity - 1)}>−</button>
+                <button onClick={() => updateQuantity(item.id, item.quantity + 1)}>+</button>
+                <button
                   className="remove-button"
                   onClick={() => removeFromCart(item.id)}
                 >
@@ -35,7 +36,7 @@ const Cart = () => {
             ))}
           </div>
           <div className="cart-summary">
-            <h3>Suma całkowita: {total.toFixed(2)} zł</h3>
+            <h3>Suma całkowita: {formatMoney(subtotal)} zł</h3>
             <Link to="/payments" className="checkout-button">
               Przejdź do płatności
             </Link>
@@ -46,4 +47,4 @@ const Cart = () => {
   );
 }
 
-export default Cart;
\ No newline at end of file
+export default Cart;
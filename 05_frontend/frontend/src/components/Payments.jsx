@@ -1,43 +1,265 @@
-import { useState } from 'react';
+import { useState, useEffect, useRef } from 'react';
 import axios from 'axios';
 import { useCart } from '../context/CartContext';
+import { formatMoney } from '../utils/money';
+
+const POLL_INTERVAL = 2000;
+// płatność nie jest jeszcze rozstrzygnięta (BLIK, 3-D Secure, weryfikacja przez sklep)
+const WAITING_STATUSES = ['awaiting_confirmation', 'requires_action', 'in_review'];
+
+// po powrocie od operatora płatności w adresie jest ?payment_id=
+const returnedPaymentId = () => {
+  const id = new URLSearchParams(window.location.search).get('payment_id');
+  return id ? Number(id) : null;
+};
+
+// token konta klienta, pod którym zapisywane są karty
+const CUSTOMER_TOKEN_KEY = 'customerToken';
+const authHeaders = (token) => token ? { Authorization: `Bearer ${token}` } : {};
 
 function Payments() {
+  const [method, setMethod] = useState('card');
+  const [blikCode, setBlikCode] = useState('');
+  const [awaitingPaymentId, setAwaitingPaymentId] = useState(returnedPaymentId);
   const [cardNumber, setCardNumber] = useState('');
-  const { cartId, cart, fetchCart } = useCart();
-  const [message, setMessage] = useState('');
+  const [expiry, setExpiry] = useState('');
+  const [cvc, setCvc] = useState('');
+  const [totals, setTotals] = useState(null);
+  const { cartId, cart, resetCart } = useCart();
+  const [message, setMessage] = useState(() => returnedPaymentId() ? 'Sprawdzamy status płatności...' : '');
+  const [submitting, setSubmitting] = useState(false);
+  const [transfer, setTransfer] = useState(null);
+  const [customerToken, setCustomerToken] = useState(() => localStorage.getItem(CUSTOMER_TOKEN_KEY));
+  const [savedCards, setSavedCards] = useState([]);
+  const [savedCardId, setSavedCardId] = useState('');
+  const [saveCard, setSaveCard] = useState(false);
+  const [email, setEmail] = useState('');
+  // ten sam klucz przy ponowieniu po błędzie sieci, żeby nie obciążyć karty dwa razy
+  const paymentKey = useRef(null);
+
+  useEffect(() => {
+    if (!cartId) return;
+    axios.get(`http://localhost:1323/carts/${cartId}/totals`)
+      .then(response => setTotals(response.data));
+  }, [cartId, cart]);
+
+  useEffect(() => {
+    if (!customerToken) return;
+    axios.get('http://localhost:1323/customers/me/payment-methods', { headers: authHeaders(customerToken) })
+      .then(response => {
+        setSavedCards(response.data);
+        const preferred = response.data.find(card => card.is_default);
+        setSavedCardId(preferred ? String(preferred.id) : '');
+      })
+      .catch(error => {
+        // token nieważny (np. po wyczyszczeniu bazy) - zapominamy go
+        if (error.response?.status === 401) {
+          localStorage.removeItem(CUSTOMER_TOKEN_KEY);
+          setCustomerToken(null);
+        }
+      });
+  }, [customerToken, cart]);
+
+  // zapisanie karty wymaga konta; zakładamy je przy pierwszej płatności z zapamiętaniem karty
+  const ensureCustomer = async () => {
+    if (customerToken || !saveCard) return customerToken;
+    const { data } = await axios.post('http://localhost:1323/customers', { email });
+    localStorage.setItem(CUSTOMER_TOKEN_KEY, data.token);
+    setCustomerToken(data.token);
+    return data.token;
+  };
+
+  // BLIK i przelew online: odpytujemy status, dopóki bank lub operator nie potwierdzi płatności
+  useEffect(() => {
+    if (!awaitingPaymentId) return;
+    const timer = setInterval(async () => {
+      const { data } = await axios.get(`http://localhost:1323/payments/${awaitingPaymentId}`);
+      if (WAITING_STATUSES.includes(data.status)) return;
+      setAwaitingPaymentId(null);
+      if (data.status === 'captured') {
+        setMessage(`Płatność zakończona sukcesem! Numer zamówienia: ${data.order_id}`);
+        setTotals(null);
+        resetCart();
+      } else {
+        setMessage(`Płatność nieudana: ${data.error_reason || data.status}`);
+      }
+    }, POLL_INTERVAL);
+    return () => clearInterval(timer);
+  }, [awaitingPaymentId, resetCart]);
+
+  const paymentDetails = () => {
+    if (method === 'blik') {
+      return { method, blik_code: blikCode };
+    }
+    if (['redirect', 'cash_on_delivery', 'bank_transfer'].includes(method)) {
+      return { method };
+    }
+    if (savedCardId) {
+      return { method, payment_method_id: Number(savedCardId) };
+    }
+    const [expMonth, expYear] = expiry.split('/').map(v => parseInt(v, 10));
+    return { method, card_number: cardNumber, exp_month: expMonth, exp_year: expYear, cvc, save_card: saveCard };
+  };
 
   const handleSubmit = async (e) => {
     e.preventDefault();
+    paymentKey.current ??= crypto.randomUUID();
+    setSubmitting(true);
+    setTransfer(null);
     try {
-      await axios.post('http://localhost:1323/payments', {
+      const token = method === 'card' ? await ensureCustomer() : customerToken;
+      const response = await axios.post('http://localhost:1323/payments', {
         cart_id: cartId,
-        card_number: cardNumber,
-        amount: cart.reduce((sum, item) => sum + item.price, 0)
+        ...paymentDetails(),
+        amount: totals.total
+      }, {
+        headers: { 'Idempotency-Key': paymentKey.current, ...authHeaders(token) }
       });
-      setMessage('Płatność zakończona sukcesem!');
-      fetchCart([]);
+      paymentKey.current = null;
+      setBlikCode('');
+      if (response.data.redirect_url) {
+        window.location.href = response.data.redirect_url;
+        return;
+      }
+      if (response.data.transfer) {
+        setTransfer(response.data.transfer);
+        setMessage(`Zamówienie ${response.data.order_id} czeka na przelew.`);
+        setTotals(null);
+        resetCart();
+        return;
+      }
+      if (method === 'cash_on_delivery') {
+        setMessage(`Zamówienie ${response.data.order_id} przyjęte, zapłacisz przy odbiorze.`);
+        setTotals(null);
+        resetCart();
+        return;
+      }
+      if (response.status === 202) {
+        setAwaitingPaymentId(response.data.id);
+        setMessage(response.data.status === 'in_review'
+          ? 'Płatność czeka na weryfikację przez sklep...'
+          : 'Potwierdź płatność w aplikacji banku...');
+        return;
+      }
+      setMessage(`Płatność kartą ${response.data.card_masked} zakończona sukcesem! Numer zamówienia: ${response.data.order_id}`);
+      setCardNumber('');
+      setExpiry('');
+      setCvc('');
+      setSaveCard(false);
+      setTotals(null);
+      resetCart();
     } catch (error) {
-      setMessage('Błąd płatności');
+      if (error.response) paymentKey.current = null;
+      setMessage(error.response?.data?.message || 'Błąd płatności');
+    } finally {
+      setSubmitting(false);
     }
   };
 
   return (
     <div>
       <h2>Płatności</h2>
+      {totals && (
+        <div className="payment-summary">
+          <p>Produkty: {formatMoney(totals.subtotal)} zł</p>
+          {totals.discount > 0 && <p>Rabat: -{formatMoney(totals.discount)} zł</p>}
+          <p>Wysyłka: {formatMoney(totals.shipping)} zł</p>
+          <p>W tym VAT ({totals.tax_rate}%): {formatMoney(totals.tax)} zł</p>
+          <h3>Do zapłaty: {formatMoney(totals.total)} zł</h3>
+        </div>
+      )}
       <form onSubmit={handleSubmit}>
-        <input
-          type="text"
-          placeholder="Numer karty"
-          value={cardNumber}
-          onChange={(e) => setCardNumber(e.target.value)}
-          required
-        />
-        <button type="submit">Zapłać</button>
+        <select value={method} onChange={(e) => setMethod(e.target.value)}>
+          <option value="card">Karta</option>
+          <option value="blik">BLIK</option>
+          <option value="redirect">Przelew online</option>
+          <option value="bank_transfer">Przelew tradycyjny</option>
+          <option value="cash_on_delivery">Za pobraniem</option>
+        </select>
+        {method === 'redirect' ? (
+          <p>Zostaniesz przekierowany na stronę operatora płatności.</p>
+        ) : method === 'bank_transfer' ? (
+          <p>Dane do przelewu pokażemy po złożeniu zamówienia.</p>
+        ) : method === 'cash_on_delivery' ? (
+          <p>Zapłacisz kurierowi przy odbiorze przesyłki.</p>
+        ) : method === 'blik' ? (
+          <input
+            type="text"
+            inputMode="numeric"
+            placeholder="Kod BLIK"
+            value={blikCode}
+            onChange={(e) => setBlikCode(e.target.value)}
+            pattern="[0-9]{6}"
+            maxLength={6}
+            required
+          />
+        ) : (
+          <>
+            {savedCards.length > 0 && (
+              <select value={savedCardId} onChange={(e) => setSavedCardId(e.target.value)}>
+                {savedCards.map(card => (
+                  <option key={card.id} value={card.id}>
+                    {card.card_masked} ({String(card.exp_month).padStart(2, '0')}/{card.exp_year % 100})
+                  </option>
+                ))}
+                <option value="">Nowa karta</option>
+              </select>
+            )}
+            {!savedCardId && (
+              <>
+                <input
+                  type="text"
+                  placeholder="Numer karty"
+                  value={cardNumber}
+                  onChange={(e) => setCardNumber(e.target.value)}
+                  required
+                />
+                <input
+                  type="text"
+                  placeholder="MM/RR"
+                  value={expiry}
+                  onChange={(e) => setExpiry(e.target.value)}
+                  required
+                />
+                <input
+                  type="password"
+                  placeholder="CVC"
+                  value={cvc}
+                  onChange={(e) => setCvc(e.target.value)}
+                  maxLength={4}
+                  required
+                />
+                <label>
+                  <input type="checkbox" checked={saveCard} onChange={(e) => setSaveCard(e.target.checked)} />
+                  Zapamiętaj kartę
+                </label>
+                {saveCard && !customerToken && (
+                  <input
+                    type="email"
+                    placeholder="E-mail do konta"
+                    value={email}
+                    onChange={(e) => setEmail(e.target.value)}
+                    required
+                  />
+                )}
+              </>
+            )}
+          </>
+        )}
+        <button type="submit" disabled={!totals || submitting || awaitingPaymentId !== null}>Zapłać</button>
       </form>
       {message && <p>{message}</p>}
+      {transfer && (
+        <div className="transfer-details">
+          <p>Odbiorca: {transfer.recipient}</p>
+          <p>Numer konta: {transfer.account_number}</p>
+          <p>Tytuł przelewu: {transfer.title}</p>
+          <p>Kwota: {formatMoney(transfer.amount)} zł</p>
+          <p>Termin: {new Date(transfer.due_at).toLocaleDateString('pl-PL')}</p>
+        </div>
+      )}
     </div>
   );
 }
 
-export default Payments;
\ No newline at end of file
+export default Payments;
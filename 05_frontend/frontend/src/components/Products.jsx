@@ -4,30 +4,65 @@ import { useCart } from '../context/CartContext';
 
 function Products() {
   const [products, setProducts] = useState([]);
+  const [nextCursor, setNextCursor] = useState(null);
+  const [query, setQuery] = useState('');
+  const [results, setResults] = useState(null);
   const { addToCart } = useCart();
 
+  const fetchProducts = async (cursor) => {
+    const response = await axios.get('http://localhost:1323/products', {
+      params: cursor ? { envelope: true, cursor } : { envelope: true }
+    });
+    setProducts(prev => (cursor ? [...prev, ...response.data.data] : response.data.data));
+    setNextCursor(response.data.next_cursor || null);
+  };
+
   useEffect(() => {
-    const fetchProducts = async () => {
-      const response = await axios.get('http://localhost:1323/products');
-      setProducts(response.data);
-    };
     fetchProducts();
   }, []);
 
+  useEffect(() => {
+    if (!query.trim()) {
+      setResults(null);
+      return;
+    }
+    const timeout = setTimeout(async () => {
+      const response = await axios.get('http://localhost:1323/products/search', {
+        params: { q: query }
+      });
+      setResults(response.data.data);
+    }, 250);
+    return () => clearTimeout(timeout);
+  }, [query]);
+
+  // name_highlight jest escapowany po stronie serwera, zawiera jedynie znaczniki <mark>
+  const visible = results ?? products;
+
   return (
     <div>
       <h2>Produkty</h2>
+      <input
+        type="search"
+        placeholder="Szukaj produktów"
+        value={query}
+        onChange={(e) => setQuery(e.target.value)}
+      />
       <div className="products-list">
-        {products.map(product => (
+        {visible.map(product => (
           <div key={product.id} className="product-card">
-            <h3>{product.name}</h3>
+            {product.name_highlight
+              ? <h3 dangerouslySetInnerHTML={{ __html: product.name_highlight }} />
+              : <h3>{product.name}</h3>}
             <p>Cena: {product.price} zł</p>
             <button onClick={() => addToCart(product.id)}>Dodaj do koszyka</button>
           </div>
         ))}
       </div>
+      {!results && nextCursor && (
+        <button onClick={() => fetchProducts(nextCursor)}>Pokaż więcej</button>
+      )}
     </div>
   );
 }
 
-export default Products;
\ No newline at end of file
+export default Products;
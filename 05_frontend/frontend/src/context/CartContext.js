@@ -1,52 +1,90 @@
-import { createContext, useState, useEffect, useContext, useCallback } from 'react';
+import { createContext, useState, useEffect, useContext, useCallback, useRef } from 'react';
 import axios from 'axios';
 
 const CartContext = createContext();
 
 export function CartProvider({ children }) {
   const [cart, setCart] = useState([]);
+  const [subtotal, setSubtotal] = useState(0);
   const [cartId, setCartId] = useState(null);
+  // szybkie kliknięcia przed utworzeniem koszyka trafiają do tego samego koszyka
+  const cartKey = useRef(null);
 
   const createNewCart = async () => {
-    const response = await axios.post('http://localhost:1323/carts');
+    cartKey.current ??= crypto.randomUUID();
+    const response = await axios.post('http://localhost:1323/carts', null, {
+      headers: { 'Idempotency-Key': cartKey.current }
+    });
     setCartId(response.data.id);
+    return response.data.id;
   };
 
-  const addToCart = async (productId) => {
-    if (!cartId) await createNewCart();
-    await axios.post(`http://localhost:1323/carts/${cartId}/products`, {
-      product_id: productId
-    });
-    fetchCart();
+  const applyCart = (data) => {
+    setCart(data.items);
+    setSubtotal(data.subtotal);
+  };
+
+  const addToCart = async (productId, quantity = 1) => {
+    const id = cartId ?? await createNewCart();
+    try {
+      const response = await axios.post(`http://localhost:1323/carts/${id}/items`, {
+        product_id: productId,
+        quantity
+      });
+      applyCart(response.data);
+    } catch (error) {
+      console.error('Błąd dodawania produktu:', error);
+    }
   };
 
   const fetchCart = useCallback(async () => {
     if (cartId) {
       const response = await axios.get(`http://localhost:1323/carts/${cartId}`);
-      setCart(response.data.products);
+      applyCart(response.data);
     }
   }, [cartId]);
 
-  const removeFromCart = async (productId) => {
+  const updateQuantity = async (itemId, quantity) => {
+    if (!cartId) return;
+
+    try {
+      const response = await axios.patch(`http://localhost:1323/carts/${cartId}/items/${itemId}`, {
+        quantity
+      });
+      applyCart(response.data);
+    } catch (error) {
+      console.error('Błąd zmiany ilości:', error);
+    }
+  };
+
+  const removeFromCart = async (itemId) => {
     if (!cartId) return;
-    
+
     try {
-      await axios.delete(`http://localhost:1323/carts/${cartId}/products/${productId}`);
-      fetchCart();
+      const response = await axios.delete(`http://localhost:1323/carts/${cartId}/items/${itemId}`);
+      applyCart(response.data);
     } catch (error) {
       console.error('Błąd usuwania produktu:', error);
     }
   };
 
+  // po opłaceniu koszyk jest zablokowany, kolejne zakupy trafiają do nowego
+  const resetCart = useCallback(() => {
+    cartKey.current = null;
+    setCartId(null);
+    setCart([]);
+    setSubtotal(0);
+  }, []);
+
   useEffect(() => {
     if (cartId) fetchCart();
   }, [cartId, fetchCart]);
 
   return (
-    <CartContext.Provider value={{ cart, addToCart, removeFromCart, cartId, fetchCart }}>
+    <CartContext.Provider value={{ cart, subtotal, addToCart, updateQuantity, removeFromCart, cartId, fetchCart, resetCart }}>
       {children}
     </CartContext.Provider>
   );
 }
 
-export const useCart = () => useContext(CartContext);
\ No newline at end of file
+export const useCart = () => useContext(CartContext);
@@ -0,0 +1,2 @@
+// Kwoty z API są liczbami dziesiętnymi wyliczonymi po stronie serwera - tutaj tylko je formatujemy
+export const formatMoney = (amount) => Number(amount).toFixed(2);